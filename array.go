@@ -20,10 +20,18 @@ func matchArray1(R Ruler, in *bufio.Reader, ctx *Context, fCheckNil bool) (v int
 
 	t := R.RetType()
 	ret := reflect.MakeSlice(reflect.SliceOf(t), 0, 4)
-	for {
+	vis := ctx.beginArray(in)
+	rec := ctx.beginRepeat(in)
+	defer func() {
+		ctx.endRepeat(rec, err == nil)
+	}()
+	for i := 0; ; i++ {
 		_, err = in.Peek(1)
 		if err != nil {
 			if err == io.EOF {
+				if vis != nil {
+					vis.EndArray(ctx.member, ctx.Tell(in))
+				}
 				if fCheckNil {
 					return
 				}
@@ -31,11 +39,16 @@ func matchArray1(R Ruler, in *bufio.Reader, ctx *Context, fCheckNil bool) (v int
 			}
 			return
 		}
-		v, err = R.Match(in, ctx.NewSub())
+		sub, offset := ctx.newElem(vis, in)
+		v, err = ctx.matchElem(R, in, sub, i, rec)
 		if err != nil {
-			return
+			return appendPartial(ret, partialOf(v, sub)), err
 		}
+		ctx.endElem(vis, in, sub, v, offset)
 		ret = reflect.Append(ret, valueOf(v, t))
+		if err = ctx.addNode(in); err != nil {
+			return ret.Interface(), err
+		}
 		fCheckNil = false
 	}
 }
@@ -48,12 +61,21 @@ func matchArray(R Ruler, n int, in *bufio.Reader, ctx *Context) (v interface{},
 
 	t := R.RetType()
 	ret := reflect.MakeSlice(reflect.SliceOf(t), 0, n)
+	vis := ctx.beginArray(in)
 	for i := 0; i < n; i++ {
-		v, err = R.Match(in, ctx.NewSub())
+		sub, offset := ctx.newElem(vis, in)
+		v, err = R.Match(in, sub)
 		if err != nil {
-			return
+			return appendPartial(ret, partialOf(v, sub)), err
 		}
+		ctx.endElem(vis, in, sub, v, offset)
 		ret = reflect.Append(ret, valueOf(v, t))
+		if err = ctx.addNode(in); err != nil {
+			return ret.Interface(), err
+		}
+	}
+	if vis != nil {
+		vis.EndArray(ctx.member, ctx.Tell(in))
 	}
 	return ret.Interface(), nil
 }
@@ -166,6 +188,8 @@ func Array(r Ruler, n int) Ruler {
 		return charArray(n)
 	} else if r == Uint8 {
 		return byteArray(n)
+	} else if isStrElem(r) {
+		return newStrArray(r, n)
 	}
 	return &array{r: r, n: n}
 }
@@ -205,6 +229,8 @@ func Dynarray(r Ruler, n func(ctx *Context) int) Ruler {
 		return charDynarray(n)
 	} else if r == Uint8 {
 		return byteDynarray(n)
+	} else if isStrElem(r) {
+		return &strArray{r: r, n: n, size: -1}
 	}
 	return &dynarray{r: r, n: n}
 }
@@ -3,10 +3,9 @@ package bpl
 import (
 	"bufio"
 	"io"
+	"io/ioutil"
 	"reflect"
 	"unsafe"
-
-	"qiniupkg.com/x/bufiox.v7"
 )
 
 // -----------------------------------------------------------------------------
@@ -17,10 +16,17 @@ func matchCharArray(n int, in *bufio.Reader, ctx *Context) (v interface{}, err e
 		return "", nil
 	}
 
+	if n <= in.Size() {
+		if b, err := in.Peek(n); err == nil {
+			v = string(b)
+			in.Discard(n)
+			return v, nil
+		}
+	}
 	b := make([]byte, n)
-	_, err = io.ReadFull(in, b)
+	nr, err := io.ReadFull(in, b)
 	if err != nil {
-		return
+		return nil, truncated(err, n, nr)
 	}
 	return string(b), nil
 }
@@ -31,10 +37,13 @@ func matchByteArray(n int, in *bufio.Reader, ctx *Context) (v interface{}, err e
 		return []byte(nil), nil
 	}
 
+	if b := ctx.sliceBytes(in, n); b != nil {
+		return b, nil
+	}
 	b := make([]byte, n)
-	_, err = io.ReadFull(in, b)
+	nr, err := io.ReadFull(in, b)
 	if err != nil {
-		return
+		return nil, truncated(err, n, nr)
 	}
 	return b, nil
 }
@@ -49,7 +58,10 @@ func matchBaseArray(R BaseType, n int, in *bufio.Reader, ctx *Context) (v interf
 	v = t.newn(n)
 	data := (*reflect.SliceHeader)(unsafe.Pointer(reflect.ValueOf(v).UnsafeAddr())).Data
 	b := (*[1 << 30]byte)(unsafe.Pointer(data))
-	_, err = io.ReadFull(in, b[:n*t.sizeOf])
+	nr, err := io.ReadFull(in, b[:n*t.sizeOf])
+	if err != nil {
+		return nil, truncated(err, n*t.sizeOf, nr)
+	}
 	return
 }
 
@@ -119,7 +131,7 @@ type byteArray0 int
 
 func (p byteArray0) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
 
-	v, err = bufiox.ReadAll(in)
+	v, err = ctx.readAll(in)
 	return
 }
 
@@ -143,12 +155,12 @@ type byteArray1 int
 
 func (p byteArray1) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
 
-	ret, err := bufiox.ReadAll(in)
+	ret, err := ctx.readAll(in)
 	if err != nil {
 		return
 	}
 	if len(ret) == 0 {
-		panic("match +byte failed: EOF encountered")
+		return nil, truncated(io.EOF, 1, 0)
 	}
 	return ret, nil
 }
@@ -274,3 +286,72 @@ func CharDynarray(n func(ctx *Context) int) Ruler {
 }
 
 // -----------------------------------------------------------------------------
+
+// SetLazyBytes sets lazy mode of matching. In lazy mode, byte arrays made lazy by
+// LazyBytes (eg. hidden members never referenced by bpl source code) are skipped
+// without reading, and their matching results are nil.
+//
+func (p *Context) SetLazyBytes(lazy bool) {
+
+	p.st.lazy = lazy
+}
+
+func discardBytes(n int, in *bufio.Reader) (err error) {
+
+	d, err := in.Discard(n)
+	return truncated(err, n, d)
+}
+
+type lazyBytes struct {
+	r Ruler
+}
+
+func (p *lazyBytes) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	if !ctx.st.lazy {
+		return p.r.Match(in, ctx)
+	}
+	switch r := p.r.(type) {
+	case byteArray:
+		err = discardBytes(int(r), in)
+	case byteDynarray:
+		err = discardBytes(r(ctx), in)
+	case byteArray1:
+		if _, err = in.Peek(1); err == io.EOF {
+			return nil, truncated(err, 1, 0)
+		}
+		if err == nil {
+			_, err = in.WriteTo(ioutil.Discard)
+		}
+	default:
+		_, err = in.WriteTo(ioutil.Discard)
+	}
+	return
+}
+
+func (p *lazyBytes) RetType() reflect.Type {
+
+	return tyByteSlice
+}
+
+func (p *lazyBytes) SizeOf() int {
+
+	return p.r.SizeOf()
+}
+
+// LazyBytes returns a matching unit that skips bytes matched by R without reading
+// them in lazy mode (see Context.SetLazyBytes), if R is a byte array (`[n]byte`,
+// `*byte` or `+byte`). Its matching result is nil then. Otherwise it matches R. It is
+// used for byte arrays whose matching results are never used. If R isn't a byte
+// array, it returns R itself.
+//
+func LazyBytes(R Ruler) Ruler {
+
+	switch R.(type) {
+	case byteArray, byteDynarray, byteArray0, byteArray1:
+		return &lazyBytes{r: R}
+	}
+	return R
+}
+
+// -----------------------------------------------------------------------------
@@ -320,10 +320,10 @@ func (p *fixedType) Match(in *bufio.Reader, ctx *Context) (v interface{}, err er
 	size := typ.Size()
 	val := reflect.New(typ)
 	b := (*[1 << 30]byte)(unsafe.Pointer(val.UnsafeAddr()))
-	_, err = io.ReadFull(in, b[:size])
+	nr, err := io.ReadFull(in, b[:size])
 	if err != nil {
 		log.Warn("fixedType.Match: io.ReadFull failed -", err)
-		return
+		return nil, truncated(err, int(size), nr)
 	}
 	return val.Interface(), nil
 }
@@ -4,12 +4,48 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"math"
 	"reflect"
-	"unsafe"
 )
 
 // -----------------------------------------------------------------------------
 
+func writeUint(w *bufio.Writer, val uint64, size int, be bool) (err error) {
+
+	var b [8]byte
+	for i := 0; i < size; i++ {
+		shift := uint(i) << 3
+		if be {
+			shift = uint(size-1-i) << 3
+		}
+		b[i] = byte(val >> shift)
+	}
+	_, err = w.Write(b[:size])
+	return
+}
+
+func writeLen(w *bufio.Writer, n int, opts fieldOpts, name string, field func(name string) (interface{}, bool)) (err error) {
+
+	switch {
+	case opts.lenType != reflect.Invalid:
+		size := 1 << uint(opts.lenType-reflect.Uint8)
+		return writeUint(w, uint64(n), size, opts.be)
+	case opts.lenFrom != "":
+		v, ok := field(opts.lenFrom)
+		if !ok {
+			return fmt.Errorf("bpl/binary.Write - length field `%s` of %s not found", opts.lenFrom, name)
+		}
+		if val, ok := toUint64(v); !ok || val != uint64(n) {
+			return fmt.Errorf("bpl/binary.Write - length of %s is %d, but %s is %v", name, n, opts.lenFrom, v)
+		}
+	case opts.hasLen:
+		if n != opts.lenFix {
+			return fmt.Errorf("bpl/binary.Write - length of %s is %d, but %d is required", name, n, opts.lenFix)
+		}
+	}
+	return
+}
+
 func writeCString(w *bufio.Writer, v string) (err error) {
 
 	_, err = w.WriteString(v)
@@ -19,16 +55,98 @@ func writeCString(w *bufio.Writer, v string) (err error) {
 	return w.WriteByte(0)
 }
 
-func writeStruct(w *bufio.Writer, v reflect.Value) (err error) {
+func writeArray(w *bufio.Writer, v reflect.Value, opts fieldOpts) (err error) {
+
+	elemOpts := fieldOpts{be: opts.be}
+	n := v.Len()
+	for i := 0; i < n; i++ {
+		err = writeValue(w, v.Index(i), elemOpts)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func writeBits(w *bufio.Writer, v reflect.Value, group []int, total int, be bool) (err error) {
+
+	if total != 8 && total != 16 && total != 32 && total != 64 {
+		return fmt.Errorf("bpl/binary.Write - bitfields of %v aren't 8/16/32/64 bits (%d bits)", v.Type(), total)
+	}
+
+	var val uint64
+	shift := uint(total)
+	for _, i := range group {
+		opts, _ := parseTag(v.Type().Field(i), be)
+		fv, _ := toUint64(v.Field(i).Interface())
+		shift -= uint(opts.bits)
+		val |= (fv & (1<<uint(opts.bits) - 1)) << shift
+	}
+	return writeUint(w, val, total>>3, be)
+}
+
+func writeStruct(w *bufio.Writer, v reflect.Value, be bool) (err error) {
 
+	t := v.Type()
+	field := func(name string) (interface{}, bool) {
+		if sf, ok := t.FieldByName(name); ok && sf.PkgPath == "" {
+			return v.FieldByIndex(sf.Index).Interface(), true
+		}
+		return nil, false
+	}
+
+	var group []int
+	var total int
 	n := v.NumField()
 	for i := 0; i < n; i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" { // unexported
+			continue
+		}
+		opts, err1 := parseTag(sf, be)
+		if err1 != nil {
+			return err1
+		}
+		if opts.skip {
+			continue
+		}
+		if opts.bits > 0 {
+			group = append(group, i)
+			total += opts.bits
+			continue
+		}
+		if group != nil {
+			if err = writeBits(w, v, group, total, be); err != nil {
+				return
+			}
+			group, total = nil, 0
+		}
+		if opts.cond != nil {
+			ok, err1 := opts.cond.eval(field)
+			if err1 != nil {
+				return err1
+			}
+			if !ok {
+				continue
+			}
+		}
 		fv := v.Field(i)
-		err = WriteValue(w, fv)
+		switch fv.Kind() {
+		case reflect.String, reflect.Slice:
+			if opts.hasLen {
+				if err = writeLen(w, fv.Len(), opts, sf.Name, field); err != nil {
+					return
+				}
+			}
+		}
+		err = writeValue(w, fv, opts)
 		if err != nil {
 			return
 		}
 	}
+	if group != nil {
+		err = writeBits(w, v, group, total, be)
+	}
 	return
 }
 
@@ -36,39 +154,63 @@ func writeStruct(w *bufio.Writer, v reflect.Value) (err error) {
 //
 func WriteValue(w *bufio.Writer, v reflect.Value) (err error) {
 
+	return writeValue(w, v, fieldOpts{})
+}
+
+func writeValue(w *bufio.Writer, v reflect.Value, opts fieldOpts) (err error) {
+
 	var val uint64
 
 retry:
 	kind := v.Kind()
 	switch {
 	case kind == reflect.Struct:
-		return writeStruct(w, v)
+		return writeStruct(w, v, opts.be)
 	case kind >= reflect.Int8 && kind <= reflect.Int64:
 		val = uint64(v.Int())
 		kind -= reflect.Int8
 	case kind >= reflect.Uint8 && kind <= reflect.Uint64:
 		val = v.Uint()
 		kind -= reflect.Uint8
+	case kind == reflect.Bool:
+		if v.Bool() {
+			val = 1
+		}
+		kind = 0
 	case kind == reflect.String:
+		if opts.hasLen {
+			_, err = w.WriteString(v.String())
+			return
+		}
 		return writeCString(w, v.String())
+	case kind == reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			_, err = w.Write(v.Bytes())
+			return
+		}
+		return writeArray(w, v, opts)
+	case kind == reflect.Array:
+		return writeArray(w, v, opts)
 	case kind == reflect.Float64:
-		*(*float64)(unsafe.Pointer(&val)) = v.Float()
+		val = math.Float64bits(v.Float())
 		kind = 3
 	case kind == reflect.Float32:
-		*(*float32)(unsafe.Pointer(&val)) = float32(v.Float())
+		val = uint64(math.Float32bits(float32(v.Float())))
 		kind = 2
 	case kind == reflect.Ptr:
+		if v.IsNil() {
+			return fmt.Errorf("bpl/binary.Write - nil pointer: %v", v.Type())
+		}
 		v = v.Elem()
 		goto retry
 	default:
 		return fmt.Errorf("bpl/binary.Write - unsupported type: %v", v.Type())
 	}
-	b := (*[8]byte)(unsafe.Pointer(&val))
-	_, err = w.Write(b[:1<<kind])
-	return
+	return writeUint(w, val, 1<<uint(kind), opts.be)
 }
 
-// Write serializes data into a writer.
+// Write serializes data into a writer. Struct fields can be controlled by
+// `bpl` tags, see Unmarshal for details.
 //
 func Write(w *bufio.Writer, v interface{}) (err error) {
 
@@ -0,0 +1,115 @@
+package binary
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// -----------------------------------------------------------------------------
+
+type itemType struct {
+	ID   uint16
+	Name string `bpl:"len=uint8"`
+}
+
+type extType struct {
+	Timestamp uint32
+}
+
+type headerType struct {
+	Version  uint8      `bpl:"bits=4"`
+	Flags    uint8      `bpl:"bits=4"`
+	Count    uint16     `bpl:"be"`
+	Items    []itemType `bpl:"be,len=Count"`
+	Magic    [4]byte
+	Tag      string   `bpl:"len=3"`
+	Ext      *extType `bpl:"if=Flags&0x01"`
+	Missing  *extType `bpl:"if=Flags&0x02"`
+	Delta    int16    `bpl:"be"`
+	Comment  string
+	internal int
+	Ignored  int `bpl:"-"`
+}
+
+func TestUnmarshal(t *testing.T) {
+
+	b := []byte{
+		0x21,       // Version = 2, Flags = 1
+		0x00, 0x02, // Count = 2
+		0x00, 0x01, 3, 'f', 'o', 'o', // Items[0]
+		0x00, 0x02, 3, 'b', 'a', 'r', // Items[1]
+		'b', 'p', 'l', '!', // Magic
+		'a', 'b', 'c', // Tag
+		0x04, 0x03, 0x02, 0x01, // Ext.Timestamp (little endian)
+		0xff, 0xfe, // Delta = -2
+		'h', 'i', 0,
+	}
+
+	var v headerType
+	err := Unmarshal(b, &v)
+	if err != nil {
+		t.Fatal("Unmarshal failed:", err)
+	}
+	expected := headerType{
+		Version: 2, Flags: 1, Count: 2,
+		Items:   []itemType{{ID: 1, Name: "foo"}, {ID: 2, Name: "bar"}},
+		Magic:   [4]byte{'b', 'p', 'l', '!'},
+		Tag:     "abc",
+		Ext:     &extType{Timestamp: 0x01020304},
+		Delta:   -2,
+		Comment: "hi",
+	}
+	if !reflect.DeepEqual(v, expected) {
+		t.Fatalf("Unmarshal result: %+v", v)
+	}
+
+	b2, err := Marshal(&v)
+	if err != nil {
+		t.Fatal("Marshal failed:", err)
+	}
+	if !bytes.Equal(b, b2) {
+		t.Fatal("Marshal result:", b2)
+	}
+}
+
+func TestMarshalLenMismatch(t *testing.T) {
+
+	v := headerType{Count: 1}
+	_, err := Marshal(&v)
+	if err == nil {
+		t.Fatal("Marshal: length mismatch is not reported")
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+type nodeType struct {
+	Value   uint8
+	HasNext uint8
+	Next    *nodeType `bpl:"if=HasNext"`
+}
+
+func TestRecursive(t *testing.T) {
+
+	b := []byte{1, 1, 2, 1, 3, 0}
+	var v nodeType
+	err := Unmarshal(b, &v)
+	if err != nil {
+		t.Fatal("Unmarshal failed:", err)
+	}
+	if v.Value != 1 || v.Next.Value != 2 || v.Next.Next.Value != 3 || v.Next.Next.Next != nil {
+		t.Fatalf("Unmarshal result: %+v", v)
+	}
+}
+
+func TestUnmarshalEOF(t *testing.T) {
+
+	var v nodeType
+	err := Unmarshal([]byte{1, 1, 2}, &v)
+	if err == nil {
+		t.Fatal("Unmarshal: EOF is not reported")
+	}
+}
+
+// -----------------------------------------------------------------------------
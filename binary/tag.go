@@ -0,0 +1,151 @@
+package binary
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+
+// A fieldOpts represents the options of a struct field specified by `bpl` tag.
+// See Unmarshal for details.
+//
+type fieldOpts struct {
+	be      bool
+	skip    bool
+	lenFrom string       // len=Count
+	lenType reflect.Kind // len=uint16
+	lenFix  int          // len=16
+	hasLen  bool
+	bits    int
+	cond    *condition
+}
+
+type condition struct {
+	field string
+	op    string
+	val   uint64
+}
+
+var lenTypes = map[string]reflect.Kind{
+	"uint8":  reflect.Uint8,
+	"uint16": reflect.Uint16,
+	"uint32": reflect.Uint32,
+	"uint64": reflect.Uint64,
+}
+
+var condOps = []string{"==", "!=", "<=", ">=", "&", "<", ">"}
+
+func parseCond(expr string) (c *condition, err error) {
+
+	for _, op := range condOps {
+		if pos := strings.Index(expr, op); pos > 0 {
+			val, err := strconv.ParseUint(strings.TrimSpace(expr[pos+len(op):]), 0, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bpl/binary: invalid condition `%s` - %v", expr, err)
+			}
+			return &condition{field: strings.TrimSpace(expr[:pos]), op: op, val: val}, nil
+		}
+	}
+	return &condition{field: strings.TrimSpace(expr), op: "!=", val: 0}, nil
+}
+
+func parseTag(sf reflect.StructField, be bool) (opts fieldOpts, err error) {
+
+	opts.be = be
+	tag := sf.Tag.Get("bpl")
+	if tag == "" {
+		return
+	}
+	if tag == "-" {
+		opts.skip = true
+		return
+	}
+	for _, item := range strings.Split(tag, ",") {
+		item = strings.TrimSpace(item)
+		key, val := item, ""
+		if pos := strings.Index(item, "="); pos >= 0 {
+			key, val = item[:pos], item[pos+1:]
+		}
+		switch key {
+		case "be":
+			opts.be = true
+		case "le":
+			opts.be = false
+		case "cstring":
+		case "len":
+			opts.hasLen = true
+			if kind, ok := lenTypes[val]; ok {
+				opts.lenType = kind
+			} else if n, err1 := strconv.Atoi(val); err1 == nil {
+				opts.lenFix = n
+			} else {
+				opts.lenFrom = val
+			}
+		case "bits":
+			opts.bits, err = strconv.Atoi(val)
+			if err != nil || opts.bits <= 0 || opts.bits > 64 {
+				return opts, fmt.Errorf("bpl/binary: invalid tag `%s` of field %s", item, sf.Name)
+			}
+		case "if":
+			opts.cond, err = parseCond(val)
+			if err != nil {
+				return
+			}
+		default:
+			return opts, fmt.Errorf("bpl/binary: unknown tag `%s` of field %s", item, sf.Name)
+		}
+	}
+	return
+}
+
+// -----------------------------------------------------------------------------
+
+func toUint64(v interface{}) (uint64, bool) {
+
+	val := reflect.ValueOf(v)
+	switch kind := val.Kind(); {
+	case kind >= reflect.Int && kind <= reflect.Int64:
+		return uint64(val.Int()), true
+	case kind >= reflect.Uint && kind <= reflect.Uintptr:
+		return val.Uint(), true
+	case kind == reflect.Bool:
+		if val.Bool() {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func (p *condition) eval(field func(name string) (interface{}, bool)) (ok bool, err error) {
+
+	v, ok := field(p.field)
+	if !ok {
+		return false, fmt.Errorf("bpl/binary: condition field `%s` not found", p.field)
+	}
+	a, ok := toUint64(v)
+	if !ok {
+		return false, fmt.Errorf("bpl/binary: condition field `%s` isn't an integer", p.field)
+	}
+	switch p.op {
+	case "&":
+		return a&p.val != 0, nil
+	case "==":
+		return a == p.val, nil
+	case "!=":
+		return a != p.val, nil
+	case "<":
+		return a < p.val, nil
+	case "<=":
+		return a <= p.val, nil
+	case ">":
+		return a > p.val, nil
+	default: // ">="
+		return a >= p.val, nil
+	}
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,401 @@
+package binary
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"qiniu.com/bpl"
+	"qiniupkg.com/x/bufiox.v7"
+)
+
+// -----------------------------------------------------------------------------
+
+func domVar(ctx *bpl.Context, name string) (v interface{}, ok bool) {
+
+	if vars, ok := ctx.Dom().(map[string]interface{}); ok {
+		v, ok = vars[name]
+		return v, ok
+	}
+	return
+}
+
+func lenOf(ctx *bpl.Context, name string) int {
+
+	v, ok := domVar(ctx.Parent, name)
+	if !ok {
+		panic(fmt.Errorf("bpl/binary: length field `%s` not found", name))
+	}
+	n, ok := toUint64(v)
+	if !ok {
+		panic(fmt.Errorf("bpl/binary: length field `%s` isn't an integer", name))
+	}
+	return int(n)
+}
+
+func uintRuler(size int, be bool) bpl.Ruler {
+
+	switch {
+	case size == 1:
+		return bpl.Uint8
+	case be:
+		return bpl.Uintbe(size)
+	case size == 2:
+		return bpl.Uint16
+	case size == 4:
+		return bpl.Uint32
+	}
+	return bpl.Uint64
+}
+
+// -----------------------------------------------------------------------------
+
+type typeKey struct {
+	t  reflect.Type
+	be bool
+}
+
+type builder struct {
+	vars map[typeKey]*bpl.TypeVar
+}
+
+func (p *builder) typeOf(t reflect.Type, opts fieldOpts) (r bpl.Ruler, err error) {
+
+retry:
+	kind := t.Kind()
+	switch {
+	case kind == reflect.Struct:
+		return p.structOf(t, opts.be)
+	case kind == reflect.Bool || kind == reflect.Int8 || kind == reflect.Uint8:
+		return bpl.Uint8, nil
+	case kind >= reflect.Int16 && kind <= reflect.Int64:
+		if opts.be {
+			return bpl.Uintbe(int(t.Size())), nil
+		}
+		return bpl.BaseType(kind), nil
+	case kind >= reflect.Uint16 && kind <= reflect.Uint64:
+		return uintRuler(int(t.Size()), opts.be), nil
+	case kind == reflect.Float32:
+		if opts.be {
+			return bpl.Float32be, nil
+		}
+		return bpl.Float32, nil
+	case kind == reflect.Float64:
+		if opts.be {
+			return bpl.Float64be, nil
+		}
+		return bpl.Float64, nil
+	case kind == reflect.String:
+		switch {
+		case opts.lenFrom != "" || opts.lenType != reflect.Invalid:
+			return bpl.CharDynarray(p.lenFn(opts)), nil
+		case opts.hasLen:
+			return bpl.CharArray(opts.lenFix), nil
+		}
+		return bpl.CString, nil
+	case kind == reflect.Slice:
+		elem, err := p.typeOf(t.Elem(), fieldOpts{be: opts.be})
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case opts.lenFrom != "" || opts.lenType != reflect.Invalid:
+			return bpl.Dynarray(elem, p.lenFn(opts)), nil
+		case opts.hasLen:
+			return bpl.Array(elem, opts.lenFix), nil
+		}
+		return bpl.Array0(elem), nil
+	case kind == reflect.Array:
+		elem, err := p.typeOf(t.Elem(), fieldOpts{be: opts.be})
+		if err != nil {
+			return nil, err
+		}
+		return bpl.Array(elem, t.Len()), nil
+	case kind == reflect.Ptr:
+		t = t.Elem()
+		goto retry
+	}
+	return nil, fmt.Errorf("bpl/binary: unsupported type - %v", t)
+}
+
+func (p *builder) lenFn(opts fieldOpts) func(ctx *bpl.Context) int {
+
+	name := opts.lenFrom
+	return func(ctx *bpl.Context) int {
+		return lenOf(ctx, name)
+	}
+}
+
+type bitField struct {
+	name string
+	bits int
+}
+
+func bitsOf(hidden string, group []bitField, total int) bpl.Ruler {
+
+	return bpl.Do(func(ctx *bpl.Context) error {
+		v, _ := domVar(ctx, hidden)
+		val, _ := toUint64(v)
+		shift := uint(total)
+		for _, f := range group {
+			shift -= uint(f.bits)
+			ctx.SetVar(f.name, (val>>shift)&(1<<uint(f.bits)-1))
+		}
+		return nil
+	})
+}
+
+func (p *builder) structOf(t reflect.Type, be bool) (r bpl.Ruler, err error) {
+
+	key := typeKey{t, be}
+	if v, ok := p.vars[key]; ok { // recursive type
+		return v, nil
+	}
+	v := &bpl.TypeVar{Name: t.String()}
+	p.vars[key] = v
+
+	var rulers []bpl.Ruler
+	var group []bitField
+	var total int
+	flush := func() error {
+		if total != 8 && total != 16 && total != 32 && total != 64 {
+			return fmt.Errorf("bpl/binary: bitfields of %v aren't 8/16/32/64 bits (%d bits)", t, total)
+		}
+		hidden := fmt.Sprintf("_bits%d", len(rulers))
+		rulers = append(rulers,
+			&bpl.Member{Name: hidden, Type: uintRuler(total>>3, be)},
+			bitsOf(hidden, group, total))
+		group, total = nil, 0
+		return nil
+	}
+
+	n := t.NumField()
+	for i := 0; i < n; i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" { // unexported
+			continue
+		}
+		opts, err := parseTag(sf, be)
+		if err != nil {
+			return nil, err
+		}
+		if opts.skip {
+			continue
+		}
+		if opts.bits > 0 {
+			if opts.cond != nil {
+				return nil, fmt.Errorf("bpl/binary: bitfield %s can't be conditional", sf.Name)
+			}
+			group = append(group, bitField{name: sf.Name, bits: opts.bits})
+			total += opts.bits
+			continue
+		}
+		if group != nil {
+			if err = flush(); err != nil {
+				return nil, err
+			}
+		}
+		var member []bpl.Ruler
+		if opts.lenType != reflect.Invalid {
+			opts.lenFrom = "_" + sf.Name + ".len"
+			size := 1 << uint(opts.lenType-reflect.Uint8)
+			member = append(member, &bpl.Member{Name: opts.lenFrom, Type: uintRuler(size, opts.be)})
+		}
+		elem, err := p.typeOf(sf.Type, opts)
+		if err != nil {
+			return nil, err
+		}
+		member = append(member, &bpl.Member{Name: sf.Name, Type: elem})
+		if c := opts.cond; c != nil {
+			cond := func(ctx *bpl.Context) bool {
+				ok, err := c.eval(func(name string) (interface{}, bool) {
+					return domVar(ctx, name)
+				})
+				if err != nil {
+					panic(err)
+				}
+				return ok
+			}
+			rulers = append(rulers, bpl.If(cond, bpl.And(member...)))
+		} else {
+			rulers = append(rulers, member...)
+		}
+	}
+	if group != nil {
+		if err = flush(); err != nil {
+			return nil, err
+		}
+	}
+	r = bpl.Struct(rulers)
+	v.Assign(r)
+	return
+}
+
+var (
+	rulers   = make(map[reflect.Type]bpl.Ruler)
+	mutRuler sync.Mutex
+)
+
+// TypeOf returns the matching unit of a Go type, whose struct fields are controlled
+// by `bpl` tags (see Unmarshal). Unlike bpl.TypeFrom, the matching result keeps the
+// Go names of the struct fields.
+//
+func TypeOf(t reflect.Type) (r bpl.Ruler, err error) {
+
+	mutRuler.Lock()
+	defer mutRuler.Unlock()
+
+	r, ok := rulers[t]
+	if !ok {
+		p := &builder{vars: make(map[typeKey]*bpl.TypeVar)}
+		r, err = p.typeOf(t, fieldOpts{})
+		if err != nil {
+			return
+		}
+		rulers[t] = r
+	}
+	return
+}
+
+// -----------------------------------------------------------------------------
+
+func assign(v reflect.Value, dom interface{}) (err error) {
+
+	if dom == nil {
+		return
+	}
+
+	switch kind := v.Kind(); {
+	case kind == reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return assign(v.Elem(), dom)
+	case kind == reflect.Struct:
+		vars, ok := dom.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("bpl/binary: can't assign %T to %v", dom, v.Type())
+		}
+		t := v.Type()
+		for i, n := 0, t.NumField(); i < n; i++ {
+			sf := t.Field(i)
+			if sf.PkgPath != "" {
+				continue
+			}
+			if val, ok := vars[sf.Name]; ok {
+				if err = assign(v.Field(i), val); err != nil {
+					return
+				}
+			}
+		}
+	case kind == reflect.Slice || kind == reflect.Array:
+		dv := reflect.ValueOf(dom)
+		if dv.Kind() != reflect.Slice && dv.Kind() != reflect.String {
+			return fmt.Errorf("bpl/binary: can't assign %T to %v", dom, v.Type())
+		}
+		if dv.Type() == v.Type() {
+			v.Set(dv)
+			return
+		}
+		n := dv.Len()
+		if kind == reflect.Slice {
+			v.Set(reflect.MakeSlice(v.Type(), n, n))
+		} else if n > v.Len() {
+			n = v.Len()
+		}
+		for i := 0; i < n; i++ {
+			if err = assign(v.Index(i), dv.Index(i).Interface()); err != nil {
+				return
+			}
+		}
+	case kind == reflect.Bool:
+		val, ok := toUint64(dom)
+		if !ok {
+			return fmt.Errorf("bpl/binary: can't assign %T to %v", dom, v.Type())
+		}
+		v.SetBool(val != 0)
+	default:
+		dv := reflect.ValueOf(dom)
+		if !dv.Type().ConvertibleTo(v.Type()) {
+			return fmt.Errorf("bpl/binary: can't assign %T to %v", dom, v.Type())
+		}
+		v.Set(dv.Convert(v.Type()))
+	}
+	return
+}
+
+// -----------------------------------------------------------------------------
+
+// ErrNotPointer is returned when the argument of Unmarshal/Read isn't a non-nil pointer.
+//
+var ErrNotPointer = errors.New("bpl/binary: argument isn't a non-nil pointer")
+
+// Read deserializes data from a reader into the value pointed to by `v`.
+//
+func Read(in *bufio.Reader, v interface{}) (err error) {
+
+	val := reflect.ValueOf(v)
+	if val.Kind() != reflect.Ptr || val.IsNil() {
+		return ErrNotPointer
+	}
+
+	r, err := TypeOf(val.Type())
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			switch v := e.(type) {
+			case string:
+				err = errors.New(v)
+			case error:
+				err = v
+			default:
+				panic(e)
+			}
+		}
+	}()
+
+	dom, err := bpl.MatchStream(r, in, bpl.NewContext())
+	if err != nil {
+		return
+	}
+	return assign(val, dom)
+}
+
+// Unmarshal deserializes data `b` into the value pointed to by `v`. It is the
+// counterpart of Marshal. Decoding is done by the same matching units that bpl
+// specs use (see TypeOf), and struct fields can be controlled by `bpl` tags:
+//
+//	be, le        - byte order of the field (inherited by nested structs and elements).
+//	len=Count     - length of a slice/string comes from a previous field named `Count`.
+//	len=uint16    - length of a slice/string is a uint8/uint16/uint32/uint64 prefix.
+//	len=16        - fixed length of a slice/string.
+//	bits=4        - a bitfield. successive bitfields are packed into a 8/16/32/64 bits
+//	                integer, and the first bitfield takes the most significant bits.
+//	if=Flags&0x01 - the field exists only if the condition is true. operators can be
+//	                `&`, `==`, `!=`, `<`, `<=`, `>`, `>=`. `if=Flags` means `Flags != 0`.
+//	cstring       - a NUL terminated string (default for strings without `len`).
+//	-             - the field is ignored.
+//
+// Fixed size arrays are matched element by element, a slice without `len` matches
+// the rest of input, and the default byte order is little endian. For example:
+//
+//	type Header struct {
+//		Version uint8  `bpl:"bits=4"`
+//		Flags   uint8  `bpl:"bits=4"`
+//		Count   uint16 `bpl:"be"`
+//		Items   []Item `bpl:"be,len=Count"`
+//		Name    string `bpl:"len=uint8"`
+//		Ext     *Ext   `bpl:"if=Flags&0x01"`
+//	}
+//
+func Unmarshal(b []byte, v interface{}) (err error) {
+
+	return Read(bufiox.NewReaderBuffer(b), v)
+}
+
+// -----------------------------------------------------------------------------
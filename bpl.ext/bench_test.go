@@ -0,0 +1,251 @@
+package bpl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+
+	"qiniu.com/bpl"
+	"qiniupkg.com/x/bufiox.v7"
+)
+
+// -----------------------------------------------------------------------------
+
+// benchFormat benchmarks matching `data` by formats/<name>.bpl, with qlang expressions
+// interpreted and compiled.
+//
+func benchFormat(b *testing.B, name, dir string, data []byte) {
+
+	modes := []struct {
+		name    string
+		compile bool
+	}{
+		{"interpreted", false},
+		{"compiled", true},
+	}
+
+	old := Dumper
+	SetDumper(ioutil.Discard)
+	defer func() {
+		Dumper = old
+	}()
+
+	for _, mode := range modes {
+		CompileExpr = mode.compile
+		r, err := NewFromFile("../formats/" + name + ".bpl")
+		CompileExpr = true
+		if err != nil {
+			b.Fatal("NewFromFile failed:", err)
+		}
+		b.Run(mode.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				ctx := bpl.NewContext()
+				ctx.Globals.SetVar("BPL_DIRECTION", dir)
+				in := ctx.NewReader(bytes.NewReader(data))
+				if _, err := r.SafeMatch(in, ctx); err != nil {
+					b.Fatal("Match failed:", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGif(b *testing.B) {
+
+	data, err := ioutil.ReadFile("../formats/1.gif")
+	if err != nil {
+		b.Fatal("ReadFile failed:", err)
+	}
+	benchFormat(b, "gif", "REQ", data)
+}
+
+func BenchmarkRedis(b *testing.B) {
+
+	var w bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		w.WriteString("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n")
+	}
+	benchFormat(b, "redis", "REQ", w.Bytes())
+}
+
+func BenchmarkMemcached(b *testing.B) {
+
+	var w bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		header := make([]byte, 24)
+		header[0], header[1] = 0x80, 0x01 // Set
+		binary.BigEndian.PutUint16(header[2:], 3)
+		header[4] = 8
+		binary.BigEndian.PutUint32(header[8:], 8+3+5)
+		binary.BigEndian.PutUint32(header[12:], uint32(i))
+		w.Write(header)
+		w.Write(make([]byte, 8))
+		w.WriteString("keyvalue")
+	}
+	benchFormat(b, "memcached", "REQ", w.Bytes())
+}
+
+func postgresMessage(w *bytes.Buffer, typ byte, payload []byte) {
+
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(payload)+4))
+	w.WriteByte(typ)
+	w.Write(n[:])
+	w.Write(payload)
+}
+
+func BenchmarkPostgres(b *testing.B) {
+
+	var w, p bytes.Buffer
+	postgresMessage(&w, 'R', []byte{0, 0, 0, 0}) // AuthenticationOk
+	p.Write([]byte{0, 3})
+	for _, name := range []string{"id", "name", "age"} {
+		p.WriteString(name)
+		p.Write(make([]byte, 1+4+2+4+2+4+2))
+	}
+	postgresMessage(&w, 'T', p.Bytes())
+	for i := 0; i < 1000; i++ {
+		p.Reset()
+		p.Write([]byte{0, 3})
+		for _, v := range []string{"1000", "alice", "42"} {
+			p.Write([]byte{0, 0, 0, byte(len(v))})
+			p.WriteString(v)
+		}
+		postgresMessage(&w, 'D', p.Bytes())
+	}
+	postgresMessage(&w, 'C', []byte("SELECT 1000\x00"))
+	postgresMessage(&w, 'Z', []byte{'I'})
+	benchFormat(b, "postgres", "RESP", w.Bytes())
+}
+
+// -----------------------------------------------------------------------------
+
+// benchAllocs benchmarks matching `data` by formats/<name>.bpl from a stream, from a
+// buffer, and from a buffer in zero-copy mode, and reports allocations.
+//
+func benchAllocs(b *testing.B, name, dir string, data []byte) {
+
+	modes := []struct {
+		name     string
+		buffer   bool
+		zeroCopy bool
+	}{
+		{"stream", false, false},
+		{"buffer", true, false},
+		{"zerocopy", true, true},
+	}
+
+	old := Dumper
+	SetDumper(ioutil.Discard)
+	defer func() {
+		Dumper = old
+	}()
+
+	r, err := NewFromFile("../formats/" + name + ".bpl")
+	if err != nil {
+		b.Fatal("NewFromFile failed:", err)
+	}
+	for _, mode := range modes {
+		b.Run(mode.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				ctx := bpl.NewContext()
+				ctx.Globals.SetVar("BPL_FILTER", map[string]interface{}{})
+				ctx.Globals.SetVar("BPL_DIRECTION", dir)
+				ctx.SetZeroCopy(mode.zeroCopy)
+				var in *bufio.Reader
+				if mode.buffer {
+					in = bufiox.NewReaderBuffer(data)
+				} else {
+					in = ctx.NewReader(bytes.NewReader(data))
+				}
+				if _, err := r.SafeMatch(in, ctx); err != nil {
+					b.Fatal("Match failed:", err)
+				}
+			}
+		})
+	}
+}
+
+func mp4Box(w *bytes.Buffer, typ string, body []byte) {
+
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(body)+8))
+	w.Write(n[:])
+	w.WriteString(typ)
+	w.Write(body)
+}
+
+func mp4Data() []byte {
+
+	var w, moov, trak bytes.Buffer
+	mp4Box(&w, "ftyp", []byte("isom\x00\x00\x02\x00isomiso2avc1mp41"))
+	mp4Box(&moov, "mvhd", make([]byte, 100))
+	for i := 0; i < 100; i++ {
+		trak.Reset()
+		mp4Box(&trak, "tkhd", make([]byte, 84))
+		mp4Box(&trak, "udta", make([]byte, 2000))
+		mp4Box(&moov, "trak", trak.Bytes())
+	}
+	mp4Box(&w, "moov", moov.Bytes())
+	mp4Box(&w, "free", make([]byte, 1000))
+	mp4Box(&w, "mdat", make([]byte, 1<<20))
+	return w.Bytes()
+}
+
+func BenchmarkMp4Allocs(b *testing.B) {
+
+	benchAllocs(b, "mp4", "REQ", mp4Data())
+}
+
+// rtmpMessage writes a message of chunk stream `csid` in chunks of 128 bytes (the
+// default chunk size).
+//
+func rtmpMessage(w *bytes.Buffer, csid, typeid byte, body []byte) {
+
+	var h [12]byte
+	h[0] = csid // format 0
+	h[4], h[5], h[6] = byte(len(body)>>16), byte(len(body)>>8), byte(len(body))
+	h[7] = typeid
+	h[8] = 1 // streamid
+	w.Write(h[:])
+	for {
+		n := len(body)
+		if n > 128 {
+			n = 128
+		}
+		w.Write(body[:n])
+		body = body[n:]
+		if len(body) == 0 {
+			break
+		}
+		w.WriteByte(3<<6 | csid) // format 3
+	}
+}
+
+func rtmpData(n int) []byte {
+
+	var w bytes.Buffer
+	w.WriteByte(3)
+	w.Write(make([]byte, 1536*2))
+	audio := make([]byte, 100)
+	audio[0], audio[1] = 0xaf, 1 // AAC raw data
+	video := make([]byte, 1000)
+	video[0], video[1] = 0x27, 1 // AVC inter frame, NALU
+	for i := 0; i < n; i++ {
+		rtmpMessage(&w, 4, 8, audio)
+		rtmpMessage(&w, 6, 9, video)
+	}
+	return w.Bytes()
+}
+
+func BenchmarkRtmpAllocs(b *testing.B) {
+
+	benchAllocs(b, "rtmp", "REQ", rtmpData(500))
+}
+
+// -----------------------------------------------------------------------------
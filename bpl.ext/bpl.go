@@ -3,15 +3,18 @@ package bpl
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"reflect"
 	"sort"
 	"strings"
+	"time"
 
 	"qiniu.com/bpl"
 	"qlang.io/qlang.spec.v1"
@@ -147,6 +150,12 @@ retry:
 			b.WriteString("<nil>")
 			return
 		}
+		if d, ok := dom.Interface().(varsGetter); ok { // eg. a bson document
+			if vars, err := d.Vars(); err == nil {
+				dumpDomValue(b, reflect.ValueOf(vars), lvl)
+				return
+			}
+		}
 		dom = dom.Elem()
 		goto retry
 	default:
@@ -166,12 +175,33 @@ func (p dump) Match(in *bufio.Reader, ctx *bpl.Context) (v interface{}, err erro
 		return
 	}
 
+	s, _ := ctx.Globals.Var(htmlStream)
+	stream, _ := s.(*htmlStreamRef)
+	if stream != nil {
+		stream.dumped = true
+	}
+
+	if f := DumpFilter; f != nil {
+		if !f.Match(ctx) {
+			return
+		}
+		dom = f.Select(dom)
+	}
+
+	if stream != nil {
+		stream.add(in, ctx)
+	}
+
 	var b bytes.Buffer
 	if prefix, ok := ctx.Globals.Var("BPL_DUMP_PREFIX"); ok {
 		b.WriteString(prefix.(string))
 	}
 	b.WriteByte('\n')
-	DumpDom(&b, dom, 0)
+	if node := ctx.Node(); DumpHexView != nil && node != nil {
+		DumpHexView.Dump(&b, node, ctx.Offset(in))
+	} else {
+		DumpDom(&b, dom, 0)
+	}
 	Dumper.Info(b.String())
 	return
 }
@@ -188,7 +218,51 @@ func (p dump) SizeOf() int {
 
 // -----------------------------------------------------------------------------
 
-// A Ruler is a matching unit.
+type tracer struct {
+	w      io.Writer
+	starts []int64
+}
+
+func (p *tracer) Enter(path []string, offset int64) {
+
+	p.starts = append(p.starts, offset)
+}
+
+func (p *tracer) Exit(path []string, offset int64, v interface{}, err error) {
+
+	n := len(p.starts) - 1
+	start := p.starts[n]
+	p.starts = p.starts[:n]
+
+	var b bytes.Buffer
+	b.WriteString(strings.Join(path, " > "))
+	if start >= 0 {
+		fmt.Fprintf(&b, " [offset %d", start)
+		if offset >= 0 {
+			fmt.Fprintf(&b, ", %d bytes", offset-start)
+		}
+		b.WriteByte(']')
+	}
+	if err != nil {
+		b.WriteString(" failed")
+	}
+	b.WriteByte('\n')
+	p.w.Write(b.Bytes())
+}
+
+// NewTracer returns a Tracer that prints the rule stack and bytes consumed of each
+// named rule after it is matched, eg. `doc > msg > header [offset 0, 16 bytes]`.
+//
+func NewTracer(w io.Writer) bpl.Tracer {
+
+	return &tracer{w: w}
+}
+
+// -----------------------------------------------------------------------------
+
+// A Ruler is a matching unit. It's immutable after bpl source code is compiled, so
+// it's safe for concurrent use by multiple goroutines, eg. connections of qbplproxy,
+// as long as each goroutine matches with its own Context.
 //
 type Ruler struct {
 	Impl bpl.Ruler
@@ -201,10 +275,30 @@ func (p Ruler) Match(in *bufio.Reader, ctx *bpl.Context) (v interface{}, err err
 	return bpl.MatchStream(p.Impl, in, ctx)
 }
 
+// MatchContext is the same as Match, except that matching is canceled when `c` is
+// done. See bpl.MatchContext.
+//
+func (p Ruler) MatchContext(c context.Context, in *bufio.Reader, ctx *bpl.Context) (v interface{}, err error) {
+
+	return bpl.MatchContext(c, p.Impl, in, ctx)
+}
+
 // SafeMatch matches input stream `in`, and returns matching result.
 //
 func (p Ruler) SafeMatch(in *bufio.Reader, ctx *bpl.Context) (v interface{}, err error) {
 
+	return p.SafeMatchContext(context.Background(), in, ctx)
+}
+
+// SafeMatchContext is the same as SafeMatch, except that matching is canceled when `c`
+// is done. Matching also fails with a *bpl.LimitError if it exceeds limits of `ctx`
+// (see bpl.Context.SetLimits).
+//
+// If matching fails, the error is a *bpl.PartialError which carries the matching result
+// before the failure. It wraps the error of matching, so use errors.As to get it.
+//
+func (p Ruler) SafeMatchContext(c context.Context, in *bufio.Reader, ctx *bpl.Context) (v interface{}, err error) {
+
 	defer func() {
 		if e := recover(); e != nil {
 			switch val := e.(type) {
@@ -218,17 +312,18 @@ func (p Ruler) SafeMatch(in *bufio.Reader, ctx *bpl.Context) (v interface{}, err
 				panic(e)
 			}
 		}
+		err = ctx.WithPartial(err)
 	}()
 
-	return bpl.MatchStream(p.Impl, in, ctx)
+	return bpl.MatchContext(c, p.Impl, in, ctx)
 }
 
 // MatchStream matches input stream `r`, and returns matching result.
 //
 func (p Ruler) MatchStream(r io.Reader) (v interface{}, err error) {
 
-	in := bufio.NewReader(r)
 	ctx := bpl.NewContext()
+	in := ctx.NewReader(r)
 	return p.SafeMatch(in, ctx)
 }
 
@@ -261,6 +356,72 @@ func New(code []byte, fname string) (r Ruler, err error) {
 	}()
 
 	p := newCompiler()
+	err = p.compile(code, fname)
+	if err != nil {
+		return
+	}
+	return p.Ret()
+}
+
+func (p *Compiler) compile(code []byte, fname string) (err error) {
+
+	if err = p.compileFile(code, fname); err != nil {
+		return
+	}
+	return p.compileIncludes()
+}
+
+// compileIncludes compiles files of `include` statements, after the including file.
+//
+func (p *Compiler) compileIncludes() error {
+
+	src := p.src
+	defer func() {
+		p.src = src
+	}()
+
+	for len(p.includes) > 0 {
+		inc := p.includes[0]
+		p.includes = p.includes[1:]
+		if _, ok := p.files[inc.name]; ok {
+			continue
+		}
+		b, err := ioutil.ReadFile(inc.name)
+		if err != nil {
+			return ErrorList{newCompileError(p.files[inc.pos.Filename], inc.pos, err.Error())}
+		}
+		p.included = true
+		if err = p.compileFile(b, inc.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Compiler) compileFile(code []byte, fname string) (err error) {
+
+	p.src = code
+	p.files[fname] = code
+	defer func() {
+		if e := recover(); e != nil {
+			switch v := e.(type) {
+			case string:
+				err = errors.New(v)
+			case error:
+				err = v
+			default:
+				panic(e)
+			}
+		}
+		if err != nil {
+			syntax := isSyntaxError(err) && p.grammar == grammar
+			err = p.compileError(err)
+			if syntax {
+				err = p.moreSyntaxErrors(err.(ErrorList), fname)
+			}
+		}
+	}()
+
 	engine, err := interpreter.New(p, interpreter.InsertSemis)
 	if err != nil {
 		return
@@ -275,7 +436,7 @@ func New(code []byte, fname string) (r Ruler, err error) {
 	if DumpCode != 0 {
 		p.code.Dump()
 	}
-	return p.Ret()
+	return
 }
 
 // NewFromString compiles bpl source code and returns the corresponding matching unit.
@@ -296,6 +457,79 @@ func NewFromFile(fname string) (r Ruler, err error) {
 	return New(b, fname)
 }
 
+// -----------------------------------------------------------------------------
+
+// A Module represents all named matching units of bpl source code. Unlike New,
+// NewModule doesn't require the `doc` rule.
+//
+type Module struct {
+	p *Compiler
+}
+
+// NewModule compiles bpl source code and returns all named matching units.
+//
+func NewModule(code []byte, fname string) (mod *Module, err error) {
+
+	defer func() {
+		if e := recover(); e != nil {
+			switch v := e.(type) {
+			case string:
+				err = errors.New(v)
+			case error:
+				err = v
+			default:
+				panic(e)
+			}
+		}
+	}()
+
+	p := newCompiler()
+	err = p.compile(code, fname)
+	if err != nil {
+		return
+	}
+	if err = p.checkVars(); err != nil {
+		return
+	}
+	return &Module{p: p}, nil
+}
+
+// Rule returns the matching unit named `name`. It can be a rule defined by the
+// source code or a builtin type (eg. uint32be).
+//
+func (p *Module) Rule(name string) (r Ruler, ok bool) {
+
+	impl, ok := p.p.rulers[name]
+	if !ok {
+		var v *bpl.TypeVar
+		if v, ok = p.p.vars[name]; ok {
+			impl = v.Elem
+		} else if impl, ok = builtins[name]; !ok {
+			return
+		}
+	}
+	return Ruler{Impl: impl}, true
+}
+
+// Rules returns names of all rules defined by the source code, in sorted order.
+//
+func (p *Module) Rules() []string {
+
+	names := make([]string, 0, len(p.p.rulers)+len(p.p.vars))
+	for name := range p.p.rulers {
+		names = append(names, name)
+	}
+	for name := range p.p.vars {
+		if _, ok := p.p.rulers[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// -----------------------------------------------------------------------------
+
 // NewContext returns a new matching Context.
 //
 func NewContext() *bpl.Context {
@@ -303,6 +537,45 @@ func NewContext() *bpl.Context {
 	return bpl.NewContext()
 }
 
+// Limits represents resource limits of matching. See bpl.Limits.
+//
+type Limits = bpl.Limits
+
+// IsLimitError returns if matching is canceled or exceeds a limit rather than fails.
+// See bpl.LimitError.
+//
+func IsLimitError(err error) bool {
+
+	return bpl.IsLimitError(err)
+}
+
+type (
+	// ErrTruncated is returned when the input ends before a rule is matched.
+	ErrTruncated = bpl.ErrTruncated
+
+	// AssertionError is returned when an `assert <condition>` fails, or a checksum
+	// mismatches (see `checksum <alg> R == <expr>`).
+	AssertionError = bpl.AssertionError
+
+	// SpecError is returned when bpl source code misuses a rule or an expression.
+	SpecError = bpl.SpecError
+
+	// LimitError is returned when matching is canceled or exceeds a limit.
+	LimitError = bpl.LimitError
+
+	// PartialError is returned by Ruler.SafeMatch when matching fails, with the
+	// matching result before the failure.
+	PartialError = bpl.PartialError
+)
+
+// NewSession returns a new Session, which correlates responses with requests of a
+// connection. See bpl.Session.
+//
+func NewSession(wait time.Duration) *bpl.Session {
+
+	return bpl.NewSession(wait)
+}
+
 // -----------------------------------------------------------------------------
 
 // SetDumpCode sets dump code mode:
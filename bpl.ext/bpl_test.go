@@ -1,14 +1,33 @@
 package bpl
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"go/token"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"golang.org/x/net/http2/hpack"
 	"qlang.io/qlang.spec.v1"
 
+	"qiniu.com/bpl"
 	"qiniu.com/bpl/binary"
+	"qiniupkg.com/text/tpl.v1"
+	"qiniupkg.com/x/bufiox.v7"
 )
 
 // -----------------------------------------------------------------------------
@@ -249,6 +268,1468 @@ func TestDump2(t *testing.T) {
 
 // -----------------------------------------------------------------------------
 
+const codeDumpFilter = `
+
+record = {
+	op   uint8
+	n    uint8
+	body [n]char
+	dump
+}
+
+doc = *record
+`
+
+func TestDumpFilter(t *testing.T) {
+
+	r, err := NewFromString(codeDumpFilter, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+
+	_, err = NewFilter("op ==", "")
+	if err == nil {
+		t.Fatal("NewFilter: syntax error is not reported")
+	}
+	err = SetDumpFilter("op == 2 && len(body) > 1 && noSuchField", "")
+	if err != nil {
+		t.Fatal("SetDumpFilter failed:", err)
+	}
+	err = SetDumpFilter("op == 2 && len(body) > 1", "op, body")
+	if err != nil {
+		t.Fatal("SetDumpFilter failed:", err)
+	}
+	defer SetDumpFilter("", "")
+
+	var b bytes.Buffer
+	old := Dumper
+	SetDumper(&b)
+	defer func() {
+		Dumper = old
+	}()
+
+	buf := []byte{
+		1, 3, 'a', 'a', 'a',
+		2, 1, 'b',
+		2, 2, 'c', 'c',
+		3, 2, 'd', 'd',
+	}
+	_, err = r.MatchBuffer(buf)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	if b.String() != "[INFO]\n{\n  body: \"cc\"\n  op: 2\n}\n" {
+		t.Fatalf("dump: %q", b.String())
+	}
+
+	err = SetDumpFilter("op == 2 && noSuchField", "")
+	if err != nil {
+		t.Fatal("SetDumpFilter failed:", err)
+	}
+	b.Reset()
+	_, err = r.MatchBuffer(buf)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	if !strings.HasPrefix(b.String(), "[WARN]filter `op == 2 && noSuchField` fails to evaluate") ||
+		strings.Count(b.String(), "[WARN]") != 1 || strings.Contains(b.String(), "[INFO]") {
+		t.Fatalf("dump: %q", b.String())
+	}
+}
+
+func TestHTMLReport(t *testing.T) {
+
+	r, err := NewFromString(codeDumpFilter, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+
+	var b bytes.Buffer
+	old := Dumper
+	SetDumper(&b)
+	defer func() {
+		Dumper = old
+	}()
+
+	buf := []byte{
+		1, 3, 'a', 'a', 'a',
+		2, 1, 'b',
+	}
+	report := NewHTMLReport("<test>")
+	ctx := NewContext()
+	report.AddStream(ctx, "conn", "REQ", bytes.NewReader(buf))
+	_, err = r.SafeMatch(ctx.NewReader(bytes.NewReader(buf)), ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	if len(report.records) != 2 {
+		t.Fatal("records:", len(report.records))
+	}
+	rec := report.records[1]
+	if rec.Offset != 5 || rec.Size != 3 || string(rec.Data) != "\x02\x01b" || len(rec.Root.Children) != 3 {
+		t.Fatalf("record: %#v", rec)
+	}
+	if body := rec.Root.Children[2]; body.Name != "body" || body.Offset != 7 || body.End != 8 || body.Value != `"b"` {
+		t.Fatalf("body: %#v", body)
+	}
+
+	b.Reset()
+	_, err = report.WriteTo(&b)
+	if err != nil {
+		t.Fatal("WriteTo failed:", err)
+	}
+	s := b.String()
+	if !strings.Contains(s, "<title>&lt;test&gt;</title>") || !strings.Contains(s, `"streams":[{"conn":"conn","dir":"REQ"}]`) {
+		t.Fatal("WriteTo:", s)
+	}
+	if strings.Contains(s, "http://") || strings.Contains(s, "https://") {
+		t.Fatal("WriteTo: external assets are referenced")
+	}
+	if report.Changed() {
+		t.Fatal("Changed: report is written")
+	}
+
+	for i := 0; i < htmlMaxRecords; i++ {
+		report.add(&htmlRecord{Stream: 0, Offset: int64(i)})
+	}
+	if !report.Changed() || len(report.records) != htmlMaxRecords || report.dropped != 2 || report.records[0].Offset != 0 {
+		t.Fatal("records:", len(report.records), report.dropped)
+	}
+}
+
+// releaseReader is a bytes.Reader that records bytes released by HTMLReport.
+//
+type releaseReader struct {
+	*bytes.Reader
+	released []int64
+}
+
+func (p *releaseReader) Release(off int64) {
+
+	p.released = append(p.released, off)
+}
+
+func TestHTMLReportStream(t *testing.T) {
+
+	defer discardDumper()()
+	defer SetDumpFilter("", "")
+
+	buf := []byte{1, 3, 'a', 'a', 'a', 2, 1, 'b'}
+	cases := []struct {
+		code     string
+		where    string
+		records  int
+		children int // of the record if there is only one
+		released []int64
+	}{
+		{codeDumpFilter, "", 2, 0, []int64{5, 8}},
+		{codeDumpFilter, "op == 3", 0, 0, nil},                                 // dumped records are filtered out
+		{strings.Replace(codeDumpFilter, "dump", "", 1), "", 1, 0, []int64{8}}, // no dump: bytes matched
+		{strings.NewReplacer("dump", "", "*record", "{records *record}").Replace(codeDumpFilter), "", 1, 1, []int64{8}},
+	}
+	for i, c := range cases {
+		r, err := NewFromString(c.code, "")
+		if err != nil {
+			t.Fatal("New failed:", err)
+		}
+		if err = SetDumpFilter(c.where, ""); err != nil {
+			t.Fatal("SetDumpFilter failed:", err)
+		}
+		report := NewHTMLReport("test")
+		src := &releaseReader{Reader: bytes.NewReader(buf)}
+		ctx := NewContext()
+		report.AddStream(ctx, "", "", src)
+		in := ctx.NewReader(bytes.NewReader(buf))
+		if _, err = r.SafeMatch(in, ctx); err != nil {
+			t.Fatal("Match failed:", err)
+		}
+		report.EndStream(in, ctx)
+		if len(report.records) != c.records || !reflect.DeepEqual(src.released, c.released) {
+			t.Fatal("records:", i, len(report.records), src.released)
+		}
+		if c.records == 1 && (report.records[0].Size != 8 || len(report.records[0].Root.Children) != c.children) {
+			t.Fatalf("record: %d %#v", i, report.records[0])
+		}
+	}
+}
+
+func TestFilterSelect(t *testing.T) {
+
+	f, err := NewFilter("", "a.b.1,a.c,x")
+	if err != nil {
+		t.Fatal("NewFilter failed:", err)
+	}
+	dom := map[string]interface{}{
+		"a": map[string]interface{}{
+			"b": []interface{}{1, 2, 3},
+			"c": "hello",
+		},
+		"y": 1,
+	}
+	ret, err := json.Marshal(f.Select(dom))
+	if err != nil {
+		t.Fatal("json.Marshal failed:", err)
+	}
+	if string(ret) != `{"a.b.1":2,"a.c":"hello"}` {
+		t.Fatal("ret:", string(ret))
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codeTrace = `
+
+header = {
+	magic uint16be
+	n     uint8
+}
+
+item = {
+	a uint8
+}
+
+doc = {
+	hdr header
+	read hdr.n do {
+		items *item
+	}
+	tail uint16
+}
+`
+
+func TestTrace(t *testing.T) {
+
+	r, err := NewFromString(codeTrace, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+
+	var b bytes.Buffer
+	ctx := NewContext()
+	ctx.SetTracer(NewTracer(&b))
+	in := ctx.NewReader(bytes.NewReader([]byte{0xab, 0xcd, 2, 1, 2, 0}))
+	_, err = r.SafeMatch(in, ctx)
+	if err == nil {
+		t.Fatal("Match: EOF is not reported")
+	}
+	var e *bpl.ErrTruncated
+	if !errors.As(err, &e) || e.Path != "doc > tail" || e.Offset != 6 || e.Needed != 2 || e.Available != 1 {
+		t.Fatalf("Match failed: %#v", err)
+	}
+
+	trace := `doc > hdr > header > magic [offset 0, 2 bytes]
+doc > hdr > header > n [offset 2, 1 bytes]
+doc > hdr > header [offset 0, 3 bytes]
+doc > hdr [offset 0, 3 bytes]
+doc > items > item > a [offset 3, 1 bytes]
+doc > items > item [offset 3, 1 bytes]
+doc > items > item > a [offset 4, 1 bytes]
+doc > items > item [offset 4, 1 bytes]
+doc > items [offset 3, 2 bytes]
+doc > tail [offset 5, 1 bytes] failed
+doc [offset 0, 6 bytes] failed
+`
+	if b.String() != trace {
+		t.Fatal("trace:", b.String())
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codeCompileExpr = `
+
+const (
+	N = 2
+)
+
+item = {
+	a uint8
+	b uint16be
+	let sum = a + b*N - 1
+	let bits = (a << 4 | b >> 2) & 0xff ^ 0x0f &^ 3
+	let cmp = [a < b, a > b, a <= b, a >= b, a == 1, a != 1, -a, ^a]
+	let ok = a < b && b < 100 || a == b
+	let _names = {1: "one", 2: "two"}
+	let name = _names[int(a)]
+	let tag = "tag" + strconv.itoa(a + 0x41)
+	let _m = {"x": {"y": a}}
+	let y = _m.x.y % 3
+	let s = strings.toUpper("abc")[1:]
+	let n = len(tag) / 2
+	if a == 1 {
+		c uint8
+	}
+}
+
+doc = {
+	items [N]item
+	let last = items[N-1].sum
+}
+`
+
+func TestCompileExpr(t *testing.T) {
+
+	buf := []byte{1, 0, 2, 9, 3, 0, 7}
+	var results []string
+	for _, compile := range []bool{false, true} {
+		CompileExpr = compile
+		r, err := NewFromString(codeCompileExpr, "")
+		CompileExpr = true
+		if err != nil {
+			t.Fatal("New failed:", err)
+		}
+		v, err := r.MatchBuffer(buf)
+		if err != nil {
+			t.Fatal("Match failed:", err)
+		}
+		ret, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal("json.Marshal failed:", err)
+		}
+		results = append(results, string(ret))
+	}
+	if results[0] != results[1] {
+		t.Fatal("compiled:", results[1], "\ninterpreted:", results[0])
+	}
+
+	for expr, compiled := range map[string]bool{
+		"a + 1 < len(b)":    true,
+		"x.y[2] == \"abc\"": true,
+		"-1":                true,
+		"unset(x)":          false,
+	} {
+		e, err := NewExpr(expr)
+		if err != nil {
+			t.Fatal("NewExpr failed:", err)
+		}
+		if (e.e.fn != nil) != compiled {
+			t.Fatal("compiled:", expr, e.e.fn != nil)
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codeEmit = `
+
+header = {
+	magic uint16be
+	n     uint8
+}
+
+item = {
+	a uint8
+	let _b = a * 2
+}
+
+length = {
+	_n uint8
+	return _n
+}
+
+record = {
+	hdr   header
+	items [hdr.n]item
+	tags  [2]uint16be
+	len   length
+}
+
+doc = emit *record
+`
+
+type eventRecorder struct {
+	b bytes.Buffer
+}
+
+func (p *eventRecorder) BeginStruct(name string, offset int64) {
+
+	fmt.Fprintf(&p.b, "BeginStruct %s %d\n", name, offset)
+}
+
+func (p *eventRecorder) EndStruct(name string, v interface{}, offset int64) {
+
+	if _, ok := v.(map[string]interface{}); ok {
+		fmt.Fprintf(&p.b, "EndStruct %s %d\n", name, offset)
+	} else {
+		fmt.Fprintf(&p.b, "EndStruct %s %v %d\n", name, v, offset)
+	}
+}
+
+func (p *eventRecorder) BeginArray(name string, offset int64) {
+
+	fmt.Fprintf(&p.b, "BeginArray %s %d\n", name, offset)
+}
+
+func (p *eventRecorder) EndArray(name string, offset int64) {
+
+	fmt.Fprintf(&p.b, "EndArray %s %d\n", name, offset)
+}
+
+func (p *eventRecorder) Field(name string, v interface{}, offset int64) {
+
+	fmt.Fprintf(&p.b, "Field %s %v %d\n", name, v, offset)
+}
+
+func TestEmit(t *testing.T) {
+
+	r, err := NewFromString(codeEmit, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+
+	var vis eventRecorder
+	ctx := NewContext()
+	ctx.SetVisitor(&vis)
+	in := ctx.NewReader(bytes.NewReader([]byte{
+		0xab, 0xcd, 1, 7, 0, 1, 0, 2, 3,
+		0xab, 0xcd, 0, 0, 3, 0, 4, 5,
+	}))
+	v, err := r.SafeMatch(in, ctx)
+	if err != nil || v != nil {
+		t.Fatal("Match failed:", v, err)
+	}
+
+	events := `BeginStruct record 0
+BeginStruct hdr 0
+Field magic 43981 0
+Field n 1 2
+EndStruct hdr 3
+BeginArray items 3
+BeginStruct item 3
+Field a 7 3
+Field _b 14 -1
+EndStruct item 4
+EndArray items 4
+BeginArray tags 4
+Field  1 4
+Field  2 6
+EndArray tags 8
+BeginStruct len 8
+Field _n 3 8
+EndStruct len 3 9
+EndStruct record 9
+BeginStruct record 9
+BeginStruct hdr 9
+Field magic 43981 9
+Field n 0 11
+EndStruct hdr 12
+Field items <nil> 12
+BeginArray tags 12
+Field  3 12
+Field  4 14
+EndArray tags 16
+BeginStruct len 16
+Field _n 5 16
+EndStruct len 5 17
+EndStruct record 17
+`
+	if vis.b.String() != events {
+		t.Fatal("events:", vis.b.String())
+	}
+
+	v, err = r.MatchBuffer([]byte{0xab, 0xcd, 0, 0, 1, 0, 2, 3})
+	if err != nil || v != nil {
+		t.Fatal("MatchBuffer failed:", v, err)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codeChecksum = `
+
+chunk = {
+	length uint32be
+	checksum sum = crc32 {
+		typ  [4]char
+		data [length]byte
+	}
+	crc uint32be
+	let ok = crc == sum
+}
+
+doc = {
+	hcrc uint16be
+	checksum crc16 {
+		magic uint16be
+	} == hcrc
+	chunks *chunk
+}
+`
+
+// codePNGChunk verifies CRC of a PNG chunk, which is peeked before the chunk is
+// matched.
+//
+const codePNGChunk = `
+
+chunk = {
+	length uint32be
+	let _b, _ = BPL_IN.peek(length + 8)
+	let _crc = _b[length+4] << 24 | _b[length+5] << 16 | _b[length+6] << 8 | _b[length+7]
+	checksum crc32 {
+		type [4]char
+		data [length]byte
+	} == _crc
+	crc uint32be
+}
+
+doc = {
+	signature [8]byte
+	chunks    *chunk
+}
+`
+
+func TestChecksumPNG(t *testing.T) {
+
+	r, err := NewFromString(codePNGChunk, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+
+	ihdr := []byte{0, 0, 0, 1, 0, 0, 0, 1, 8, 6, 0, 0, 0}
+	png := append([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"), ihdr...)
+	crc := crc32.ChecksumIEEE(png[12:])
+	png = append(png, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+	if _, err = r.MatchBuffer(png); err != nil {
+		t.Fatal("Match failed:", err)
+	}
+
+	png[len(png)-1] ^= 1 // corrupted CRC
+	_, err = r.MatchBuffer(png)
+	var assertion *bpl.AssertionError
+	if !errors.As(err, &assertion) || assertion.Path != "doc > chunks > chunk" || assertion.Values["checksum"] != fmt.Sprintf("%#x", crc) {
+		t.Fatalf("Match: %#v", err)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+
+	r, err := NewFromString(codeChecksum, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+
+	var b bytes.Buffer
+	uint32be := func(v uint32) {
+		b.Write([]byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)})
+	}
+	b.Write([]byte{0x77, 0x0d, 0x12, 0x34}) // crc16 of 0x12 0x34
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	crc := crc32.ChecksumIEEE(append([]byte("IDAT"), data...))
+	uint32be(uint32(len(data)))
+	b.WriteString("IDAT")
+	b.Write(data)
+	uint32be(crc)
+	uint32be(1)
+	b.WriteString("IEND!")
+	uint32be(0)
+
+	ctx := NewContext()
+	v, err := r.SafeMatch(ctx.NewReader(bytes.NewReader(b.Bytes())), ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	chunks := v.(map[string]interface{})["chunks"].([]interface{})
+	if len(chunks) != 2 {
+		t.Fatal("chunks:", len(chunks))
+	}
+	c0, c1 := chunks[0].(map[string]interface{}), chunks[1].(map[string]interface{})
+	if c0["sum"] != crc || c0["ok"] != true || c1["ok"] != false {
+		t.Fatalf("chunks: %#x %v, %#x %v", c0["sum"], c0["ok"], c1["sum"], c1["ok"])
+	}
+
+	ctx = NewContext()
+	_, err = r.SafeMatch(ctx.NewReader(bytes.NewReader([]byte{0x77, 0x0e, 0x12, 0x34})), ctx)
+	var assertion *bpl.AssertionError
+	if !errors.As(err, &assertion) || assertion.Expr != "checksum crc16 == hcrc" || assertion.Path != "doc" ||
+		assertion.Values["checksum"] != "0x770d" || assertion.Values["expected"] != "0x770e" {
+		t.Fatal("Match: mismatch is not reported -", err)
+	}
+
+	_, err = NewFromString("doc = { checksum crc99 { a uint8 } }", "")
+	if err == nil || !strings.Contains(err.Error(), "unknown checksum algorithm `crc99`") {
+		t.Fatal("New:", err)
+	}
+
+	r, err = NewFromString("doc = { checksum sum = crc32 { a uint32be } }", "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	pr, pw := io.Pipe()
+	go pw.Write([]byte{0, 0, 0, 1}) // the pipe isn't closed, eg. a network connection
+	done := make(chan error, 1)
+	go func() {
+		ctx := NewContext()
+		_, err := r.SafeMatch(ctx.NewReader(pr), ctx)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal("Match failed:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Match: checksum waits for bytes beyond the rule")
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codeDecode = `
+
+doc = {
+	n uint8
+	read n do zlib {
+		items *cstring
+	}
+	gunzip {
+		msg [5]char
+	}
+	base64 {
+		a uint16be
+		b [3]char
+	}
+	read 8 do snappy {
+		s [6]char
+	}
+	tail uint8
+}
+`
+
+func TestDecode(t *testing.T) {
+
+	r, err := NewFromString(codeDecode, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write([]byte("foo\x00bar\x00"))
+	zw.Close()
+
+	var b bytes.Buffer
+	b.WriteByte(byte(z.Len()))
+	b.Write(z.Bytes())
+	gw := gzip.NewWriter(&b)
+	gw.Write([]byte(strings.Repeat("hello", 1000)))
+	gw.Close()
+	b.WriteString("AAFhYmM=")
+	b.Write([]byte{6, 5 << 2, 's', 'n', 'a', 'p', 'p', 'y'})
+	b.WriteByte('!')
+
+	ctx := NewContext()
+	v, err := r.SafeMatch(ctx.NewReader(bytes.NewReader(b.Bytes())), ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	ret, _ := json.Marshal(v)
+	if string(ret) != `{"a":1,"b":"abc","items":["foo","bar"],"msg":"hello","n":21,"s":"snappy","tail":33}` {
+		t.Fatal("Match:", string(ret))
+	}
+
+	ctx = NewContext()
+	ctx.SetLimits(bpl.Limits{MaxDecodedBytes: 4000})
+	_, err = r.SafeMatch(ctx.NewReader(bytes.NewReader(b.Bytes())), ctx)
+	var e *bpl.LimitError
+	if !errors.As(err, &e) || e.Err != bpl.ErrMaxDecodedBytes {
+		t.Fatal("Match: decode limit isn't applied -", err)
+	}
+}
+
+const codeBase64 = `
+
+doc = {
+	base64 {
+		a [3]char
+	}
+	crlf [2]char
+	base64mime {
+		b [6]char
+	}
+	tail [3]char
+}
+`
+
+func TestBase64(t *testing.T) {
+
+	r, err := NewFromString(codeBase64, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	v, err := r.MatchBuffer([]byte("Zm9v\r\nYmFy\r\nYmF6\r\n!foo"))
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	ret, _ := json.Marshal(v)
+	if string(ret) != `{"a":"foo","b":"barbaz","crlf":"\r\n","tail":"!fo"}` {
+		t.Fatal("Match:", string(ret))
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codeEncoding = `
+
+hdr = {/C
+	uint16 id
+	zchar[6] name
+}
+
+doc = {
+	h    hdr
+	len  uvarint
+	s    zigzag
+	q    quicvarint
+	ber  berlen
+	rl   mqttlen
+	p    pstring16be
+	w    utf16le
+	tail [len]utf16be
+}
+`
+
+func TestEncoding(t *testing.T) {
+
+	r, err := NewFromString(codeEncoding, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+
+	b := []byte{1, 0, 'b', 'p', 'l', 0, 0, 0, 2, 3, 0x40, 0x25, 0x81, 0x80, 0xc1, 0x02, 0, 2, 'h', 'i', 'o', 0, 'k', 0, 0, 0, 0, 'o', 0, 'k'}
+	ctx := NewContext()
+	v, err := r.SafeMatch(ctx.NewReader(bytes.NewReader(b)), ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	ret, _ := json.Marshal(v)
+	if string(ret) != `{"ber":128,"h":{"id":1,"name":"bpl"},"len":2,"p":"hi","q":37,"rl":321,"s":-2,"tail":"ok","w":"ok"}` {
+		t.Fatal("Match:", string(ret))
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codeProtobuf = `
+
+doc = {
+	n    uint8
+	read n do {
+		msg protobuf
+	}
+	m    uint8
+	data [m]byte
+	let raw, err = protobuf.decodeRaw(data)
+	assert err == nil
+	let name = raw["1"]
+}
+`
+
+func TestProtobuf(t *testing.T) {
+
+	r, err := NewFromString(codeProtobuf, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+
+	b := []byte{9, 0x08, 0x96, 0x01, 0x12, 0x04, 0x08, 0x01, 0x10, 0x02, 5, 0x0a, 0x03, 'b', 'p', 'l'}
+	ctx := NewContext()
+	v, err := r.SafeMatch(ctx.NewReader(bytes.NewReader(b)), ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	dom := v.(map[string]interface{})
+	ret, _ := json.Marshal(map[string]interface{}{"msg": dom["msg"], "m": dom["m"], "name": dom["name"]})
+	if string(ret) != `{"m":5,"msg":{"1":150,"2":{"1":1,"2":2}},"name":"bpl"}` {
+		t.Fatal("Match:", string(ret))
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codeReadEmpty = `
+
+doc = {
+	n    uint8
+	read n do {
+		items *uint16
+	}
+	tail uint8
+}
+`
+
+func TestReadEmpty(t *testing.T) {
+
+	r, err := NewFromString(codeReadEmpty, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+
+	ctx := NewContext()
+	v, err := r.SafeMatch(ctx.NewReader(bytes.NewReader([]byte{0, 7})), ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	ret, _ := json.Marshal(v)
+	if string(ret) != `{"items":[],"n":0,"tail":7}` {
+		t.Fatal("Match:", string(ret))
+	}
+
+	// an empty buffer is at the offset where it's read, and has no bytes
+	code := strings.Replace(codeReadEmpty, "\ttail uint8", "\t_b [n]byte\n\teval _b do {\n\t\tmore *uint16\n\t}\n\ttail uint8", 1)
+	r, err = NewFromString(code, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	ctx = NewContext()
+	var trace bytes.Buffer
+	ctx.SetTracer(NewTracer(&trace))
+	_, err = r.SafeMatch(ctx.NewReader(bytes.NewReader([]byte{0, 7})), ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	if !strings.Contains(trace.String(), "doc > items [offset 1, 0 bytes]\n") ||
+		!strings.Contains(trace.String(), "doc > more [offset 0, 0 bytes]\n") {
+		t.Fatal("trace:", trace.String())
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codeZeroCopy = `
+
+body = {
+	_skip [1]byte
+	data  *byte
+}
+
+record = {
+	n    uint8
+	head [2]byte
+	_pad [1]byte
+	_n   uint8
+	read _n do body
+}
+
+item = {
+	_len uint8
+	read _len do record
+}
+
+doc = {
+	records *item
+}
+`
+
+func TestZeroCopy(t *testing.T) {
+
+	r, err := NewFromString(codeZeroCopy, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+
+	var buf []byte
+	for i := 0; i < 3; i++ {
+		rec := []byte{byte(i), 'h', byte('0' + i), 0xff, 2, 'b', byte('0' + i)}
+		buf = append(append(buf, byte(len(rec))), rec...)
+	}
+
+	var results []string
+	for _, mode := range []string{"stream", "buffer", "zerocopy"} {
+		ctx := NewContext()
+		ctx.SetLazyBytes(true)
+		in := ctx.NewReader(bytes.NewReader(buf))
+		if mode != "stream" {
+			in = bufiox.NewReaderBuffer(buf)
+			ctx.SetZeroCopy(mode == "zerocopy")
+		}
+		v, err := r.SafeMatch(in, ctx)
+		if err != nil {
+			t.Fatal("Match failed:", mode, err)
+		}
+		records := v.(map[string]interface{})["records"].([]interface{})
+		rec := records[1].(map[string]interface{})
+		if rec["_pad"] != nil || rec["_skip"] != nil || rec["_n"] == nil {
+			t.Fatal("hidden byte fields aren't lazy:", mode, rec)
+		}
+		if head := rec["head"].([]byte); (&head[0] == &buf[10]) != (mode == "zerocopy") {
+			t.Fatal("zero-copy:", mode, &head[0] == &buf[10])
+		}
+		ret, _ := json.Marshal(v)
+		results = append(results, string(ret))
+	}
+	if results[0] != results[1] || results[0] != results[2] {
+		t.Fatal("results:", results)
+	}
+	if !strings.Contains(results[0], `"_skip":null,"data":"Mg==","head":"aDI=","n":2}`) {
+		t.Fatal("Match:", results[0])
+	}
+
+	v, err := r.SafeMatch(bufiox.NewReaderBuffer(buf), NewContext())
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	rec := v.(map[string]interface{})["records"].([]interface{})[1].(map[string]interface{})
+	if pad, ok := rec["_pad"].([]byte); !ok || len(pad) != 1 || pad[0] != 0xff {
+		t.Fatal("hidden byte fields are lazy without lazy mode:", rec)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codeLimits = `
+
+record = {
+	n    uint8
+	vals [n]uint16be
+	end  uint8
+}
+
+doc = *record
+`
+
+// slowReader returns one byte per Read after a delay.
+//
+type slowReader struct {
+	b     []byte
+	delay time.Duration
+}
+
+func (p *slowReader) Read(b []byte) (n int, err error) {
+
+	if len(p.b) == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(p.delay)
+	b[0], p.b = p.b[0], p.b[1:]
+	return 1, nil
+}
+
+func TestLimits(t *testing.T) {
+
+	r, err := NewFromString(codeLimits, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+
+	var buf []byte
+	for i := 0; i < 10; i++ {
+		buf = append(buf, 3, 0, 1, 0, 2, 0, 3, 0xff) // 8 bytes, 6 nodes
+	}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	cases := []struct {
+		lim    bpl.Limits
+		c      context.Context
+		slow   bool
+		expect error
+	}{
+		{bpl.Limits{MaxBytes: 80, MaxNodes: 6, MaxRecordTime: time.Minute}, context.Background(), false, nil},
+		{bpl.Limits{MaxBytes: 30}, context.Background(), false, bpl.ErrMaxBytes},
+		{bpl.Limits{MaxNodes: 5}, context.Background(), false, bpl.ErrMaxNodes},
+		{bpl.Limits{MaxRecordTime: 10 * time.Millisecond}, context.Background(), true, bpl.ErrMaxRecordTime},
+		{bpl.Limits{}, canceled, false, context.Canceled},
+	}
+	for i, c := range cases {
+		ctx := NewContext()
+		ctx.SetLimits(c.lim)
+		var in *bufio.Reader
+		if c.slow {
+			in = ctx.NewReader(&slowReader{b: buf[:16], delay: 5 * time.Millisecond})
+		} else {
+			in = ctx.NewReader(bytes.NewReader(buf))
+		}
+		_, err := r.SafeMatchContext(c.c, in, ctx)
+		if c.expect == nil {
+			if err != nil {
+				t.Fatal("Match failed:", i, err)
+			}
+			continue
+		}
+		if !bpl.IsLimitError(err) || !errors.Is(err, c.expect) {
+			t.Fatal("Match:", i, err)
+		}
+	}
+
+	ctx := NewContext()
+	ctx.SetLimits(bpl.Limits{MaxBytes: 80})
+	_, err = r.SafeMatch(ctx.NewReader(bytes.NewReader(buf[:12])), ctx)
+	if err == nil || bpl.IsLimitError(err) {
+		t.Fatal("Match truncated input:", err)
+	}
+}
+
+func TestRecords(t *testing.T) {
+
+	var buf []byte
+	for i := 0; i < 10; i++ {
+		buf = append(buf, 3, 0, 1, 0, 2, 0, 3, 0xff)
+	}
+
+	for _, code := range []string{codeLimits, strings.Replace(codeLimits, "doc = *record", "doc = {records *record}", 1)} {
+		r, err := NewFromString(code, "")
+		if err != nil {
+			t.Fatal("New failed:", err)
+		}
+
+		ctx := NewContext()
+		_, err = r.SafeMatch(ctx.NewReader(bytes.NewReader(buf)), ctx)
+		if err != nil || ctx.Stats() != (bpl.Stats{Records: 10, Ended: true}) {
+			t.Fatal("Match:", err, ctx.Stats())
+		}
+
+		ctx = NewContext()
+		_, err = r.SafeMatch(ctx.NewReader(bytes.NewReader(buf[:12])), ctx)
+		var e *bpl.ErrTruncated
+		if !errors.As(err, &e) || e.Record != 2 || e.Offset != 11 || ctx.Stats() != (bpl.Stats{Records: 1}) {
+			t.Fatalf("Match: %#v %v", err, ctx.Stats())
+		}
+		if ret, _ := json.Marshal(e.Partial); string(ret) != `{"n":3,"vals":[1]}` {
+			t.Fatal("Partial:", string(ret))
+		}
+	}
+
+	// repetitions inside a read window aren't records of the input stream
+	r, err := NewFromString("item = {a uint8; b uint8}\ndoc = {read 4 do {hdr *item}; msgs *item}", "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	data := []byte{1, 2, 3, 4, 5, 6, 7}
+	ctx := NewContext()
+	_, err = r.SafeMatch(ctx.NewReader(bytes.NewReader(data[:6])), ctx)
+	if err != nil || ctx.Stats() != (bpl.Stats{Records: 1, Ended: true}) {
+		t.Fatal("Match:", err, ctx.Stats())
+	}
+	ctx = NewContext()
+	_, err = r.SafeMatch(ctx.NewReader(bytes.NewReader(data)), ctx)
+	var e *bpl.ErrTruncated
+	if !errors.As(err, &e) || e.Record != 2 || ctx.Stats() != (bpl.Stats{Records: 1}) {
+		t.Fatalf("Match: %#v %v", err, ctx.Stats())
+	}
+}
+
+func TestPartial(t *testing.T) {
+
+	var buf []byte
+	for i := 0; i < 2; i++ {
+		buf = append(buf, 3, 0, 1, 0, 2, 0, 3, 0xff)
+	}
+
+	cases := []struct {
+		code   string
+		result string
+	}{
+		{codeLimits, `null`},
+		{strings.Replace(codeLimits, "doc = *record", "doc = {records *record}", 1),
+			`{"records":[{"end":255,"n":3,"vals":[1,2,3]},{"n":3,"vals":[1]}]}`},
+	}
+	for _, c := range cases {
+		r, err := NewFromString(c.code, "")
+		if err != nil {
+			t.Fatal("New failed:", err)
+		}
+		ctx := NewContext()
+		_, err = r.SafeMatch(ctx.NewReader(bytes.NewReader(buf[:12])), ctx)
+		var e *bpl.PartialError
+		if !errors.As(err, &e) || e.Record != 2 || e.Offset != 11 || !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("Match: %#v", err)
+		}
+		if ret, _ := json.Marshal(e.PartialResult); string(ret) != c.result {
+			t.Fatal("PartialResult:", string(ret))
+		}
+		if ret, _ := json.Marshal(e.RecordResult); string(ret) != `{"n":3,"vals":[1]}` {
+			t.Fatal("RecordResult:", string(ret))
+		}
+	}
+
+	r, err := NewFromString(codeErrors, "errors.bpl")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	_, err = r.MatchBuffer([]byte{0xab, 0xcd, 9})
+	var e *bpl.PartialError
+	if !errors.As(err, &e) || e.Path != "doc > hdr > header" || e.Offset != 3 || e.Record != 0 {
+		t.Fatalf("MatchBuffer: %#v", err)
+	}
+	if ret, _ := json.Marshal(e.PartialResult); string(ret) != `{"hdr":{"magic":43981,"n":9}}` {
+		t.Fatal("PartialResult:", string(ret))
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codeNodes = `
+
+record = {
+	n    uint8
+	vals [n]uint16be
+	end  uint8
+}
+
+doc = {
+	hdr   record
+	_body [4]byte
+	eval _body do {
+		a uint16be
+		b uint16be
+	}
+}
+`
+
+func dumpNode(b *bytes.Buffer, node *bpl.Node) {
+
+	fmt.Fprintf(b, "%s[%d,%d)", node.Name, node.Offset, node.End)
+	if len(node.Children) > 0 {
+		b.WriteByte('{')
+		for i, child := range node.Children {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			dumpNode(b, child)
+		}
+		b.WriteByte('}')
+	}
+}
+
+func TestNodes(t *testing.T) {
+
+	r, err := NewFromString(codeNodes, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+
+	data := []byte{2, 0, 1, 0, 2, 0xff, 0, 3, 0, 4}
+	ctx := NewContext()
+	ctx.TrackOffsets()
+	_, err = r.SafeMatch(ctx.NewReader(bytes.NewReader(data)), ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+
+	var b bytes.Buffer
+	dumpNode(&b, ctx.Node())
+	expected := "[0,10){hdr[0,6){n[0,1) vals[1,5){[1,3) [3,5)} end[5,6)} _body[6,10) a[6,8) b[8,10)}"
+	if b.String() != expected {
+		t.Fatal("Node:", b.String())
+	}
+
+	b.Reset()
+	view := &HexView{Src: bytes.NewReader(data)}
+	view.Dump(&b, ctx.Node(), int64(len(data)))
+	for _, line := range []string{
+		"00000001  00 01 ",
+		"|..              |      [0] = 1\n",
+		"|..              |  a = 3\n",
+	} {
+		if !strings.Contains(b.String(), line) {
+			t.Fatalf("HexView: %q not found in\n%s", line, b.String())
+		}
+	}
+	if strings.Contains(b.String(), "_body") {
+		t.Fatal("HexView: _body is matched again, but it's shown:\n", b.String())
+	}
+
+	ctx = NewContext()
+	_, err = r.SafeMatch(ctx.NewReader(bytes.NewReader(data)), ctx)
+	if err != nil || ctx.Node() != nil {
+		t.Fatal("Match without tracking offsets:", err, ctx.Node())
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codeErrors = `
+
+header = {
+	magic uint16be
+	n     uint8
+	assert magic == 0xabcd && n < 8
+}
+
+doc = {
+	hdr  header
+	data [hdr.n]byte
+	read "x" do {
+		rest *byte
+	}
+}
+`
+
+const codeNestedErrors = `
+
+doc = {
+	n uint8
+	read n do {
+		a uint8
+		assert a == 1
+	}
+	_b [2]byte
+	eval _b do {
+		c uint8
+		assert c == 1
+	}
+}
+`
+
+func TestNestedErrors(t *testing.T) {
+
+	r, err := NewFromString(codeNestedErrors, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+
+	_, err = r.MatchBuffer([]byte{1, 2})
+	var e *bpl.AssertionError
+	if !errors.As(err, &e) || e.Offset != 2 || e.Nested {
+		t.Fatalf("Match: %#v", err)
+	}
+
+	_, err = r.MatchBuffer([]byte{1, 1, 5, 6})
+	if !errors.As(err, &e) || e.Offset != 1 || !e.Nested || !strings.Contains(e.Pos.String(), "in nested stream") {
+		t.Fatalf("Match: %#v", err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+
+	r, err := NewFromString(codeErrors, "errors.bpl")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+
+	_, err = r.MatchBuffer([]byte{0xab, 0xce, 2})
+	var assertion *bpl.AssertionError
+	if !errors.As(err, &assertion) || assertion.Path != "doc > hdr > header" || assertion.Offset != 3 ||
+		assertion.Expr != "magic == 0xabcd && n < 8" || len(assertion.Values) != 2 || assertion.Values["n"] != uint8(2) {
+		t.Fatalf("Match: %#v", err)
+	}
+
+	_, err = r.MatchBuffer([]byte{0xab, 0xcd, 5, 1, 2})
+	var truncated *bpl.ErrTruncated
+	if !errors.As(err, &truncated) || truncated.Path != "doc > data" || truncated.Offset != 5 ||
+		truncated.Needed != 5 || truncated.Available != 2 || truncated.File != "errors.bpl" || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Match: %#v", err)
+	}
+
+	_, err = r.MatchBuffer([]byte{0xab, 0xcd, 1, 1})
+	var spec *bpl.SpecError
+	if !errors.As(err, &spec) || spec.Path != "doc" || spec.Err.Error() != "read bytes isn't an integer expression" {
+		t.Fatalf("Match: %#v", err)
+	}
+
+	// a buffer can't be filled, so bufio.ErrBufferFull means truncated input
+	r, err = NewFromString("doc = {a uint8; b uint32be}", "buffer.bpl")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	_, err = r.MatchBuffer([]byte{1, 2})
+	if !errors.As(err, &truncated) || truncated.Path != "doc > b" || truncated.Offset != 1 ||
+		truncated.Needed != 4 || truncated.Available != 1 || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Match: %#v", err)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codeHttp2 = `
+
+init = {
+	global _hpack = http2.hpackDecoder()
+	global _grpc = http2.reassembler(5, 1, 4)
+}
+
+Message = {
+	compressed uint8
+	length     uint32be
+	data       [length]char
+}
+
+Frame = {
+	length uint24be
+	type   uint8
+	flags  uint8
+	id     uint32be
+	read length do case type {
+		0: {
+			_data [length]byte
+			let _msgs, _err = _grpc.feed(id, _data)
+			assert _err == nil
+			eval _msgs do {
+				messages *Message
+			}
+		}
+		1: {
+			_block [length]byte
+			let headers, _err = _hpack.decode(_block, flags & 0x04 != 0)
+			assert _err == nil
+		}
+	}
+}
+
+doc = init {
+	frames *Frame
+}
+`
+
+func http2Frame(typ, flags byte, id int, payload []byte) []byte {
+
+	n := len(payload)
+	b := []byte{byte(n >> 16), byte(n >> 8), byte(n), typ, flags, 0, 0, 0, byte(id)}
+	return append(b, payload...)
+}
+
+func TestHttp2(t *testing.T) {
+
+	r, err := NewFromString(codeHttp2, "")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+
+	var hdrs bytes.Buffer
+	enc := hpack.NewEncoder(&hdrs)
+	enc.WriteField(hpack.HeaderField{Name: ":path", Value: "/test.Svc/Get"})
+	b1 := append([]byte(nil), hdrs.Bytes()...)
+	hdrs.Reset()
+	enc.WriteField(hpack.HeaderField{Name: ":path", Value: "/test.Svc/Get"}) // indexed in the dynamic table
+	b2 := hdrs.Bytes()
+
+	msg := []byte{0, 0, 0, 0, 3, 'b', 'p', 'l'}
+	var b []byte
+	b = append(b, http2Frame(1, 0x04, 1, b1)...)
+	b = append(b, http2Frame(1, 0x00, 3, b2[:0])...)
+	b = append(b, http2Frame(1, 0x04, 3, b2)...)
+	b = append(b, http2Frame(0, 0x00, 1, msg[:6])...)
+	b = append(b, http2Frame(0, 0x01, 1, msg[6:])...)
+
+	ctx := NewContext()
+	v, err := r.SafeMatch(ctx.NewReader(bytes.NewReader(b)), ctx)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	var frames []interface{}
+	for _, f := range v.(map[string]interface{})["frames"].([]interface{}) {
+		frame := f.(map[string]interface{})
+		frames = append(frames, []interface{}{frame["id"], frame["headers"], frame["messages"]})
+	}
+	ret, _ := json.Marshal(frames)
+	if string(ret) != `[[1,{":path":"/test.Svc/Get"},null],[3,null,null],[3,{":path":"/test.Svc/Get"},null],`+
+		`[1,null,[]],[1,null,[{"compressed":0,"data":"bpl","length":3}]]]` {
+		t.Fatal("Match:", string(ret))
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const codeCompileError = `hdr = {
+	magic uint32bee
+	n     uint8
+}
+
+doc = {
+	h hdr
+	y hrd
+}
+`
+
+func TestCompileError(t *testing.T) {
+
+	_, err := NewFromString(codeCompileError, "test.bpl")
+	errs, ok := err.(ErrorList)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("New: %#v", err)
+	}
+	if e := errs[0]; e.Line != 2 || e.Column != 8 || len(e.Suggestions) != 1 || e.Suggestions[0] != "uint32be" {
+		t.Fatalf("errs[0]: %#v", e)
+	}
+	msg := "test.bpl:8:4: rule `hrd` is not defined, did you mean `hdr`?\n\ty hrd\n\t  ^"
+	if errs[1].Error() != msg {
+		t.Fatal("errs[1]:", errs[1].Error())
+	}
+
+	_, err = NewFromString("doc = {\n\ta uint8\n\tb @ char\n}\n", "")
+	errs, ok = err.(ErrorList)
+	if !ok || len(errs) != 1 || errs[0].Line != 3 || errs[0].Column != 2 {
+		t.Fatalf("New: %#v", err)
+	}
+
+	_, err = NewFromString("a = {\n\tx @ uint8\n}\n\nb = {\n\ty uint8\n}\n\ndoc = {\n\tz ] a\n}\n", "")
+	errs, ok = err.(ErrorList)
+	if !ok || len(errs) != 2 || errs[0].Line != 2 || errs[1].Line != 10 || errs[1].Column != 2 {
+		t.Fatalf("New: %#v", err)
+	}
+}
+
+func TestPositionOf(t *testing.T) {
+
+	src := []byte("doc = uint8")
+	f := token.NewFileSet().AddFile("test.bpl", -1, len(src))
+	var s tpl.Scanner
+	s.Init(f, src, nil, 0)
+	tokens := []tpl.Token{s.Scan(), s.Scan(), s.Scan()}
+
+	if pos := positionOf(&s, tokens, 2); pos.Column != 7 {
+		t.Fatal("positionOf:", pos)
+	}
+	if pos := positionOf(&s, tokens[:1], 1); pos.Column != 4 { // the end of `doc`, not `=`
+		t.Fatal("positionOf beyond tokens:", pos)
+	}
+	if pos := positionOf(&s, tokens[:0], 0); pos.Column != 12 {
+		t.Fatal("positionOf without tokens:", pos)
+	}
+}
+
+const codeIncludeBase = `
+const (
+	N = 2
+)
+
+hdr = {
+	tag  uint8
+	body body
+}
+
+body = {
+	data [N]byte
+}
+
+doc = *hdr
+`
+
+func TestInclude(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bpl")
+	if err != nil {
+		t.Fatal("TempDir failed:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "base.bpl"), []byte(codeIncludeBase), 0666)
+	if err != nil {
+		t.Fatal("WriteFile failed:", err)
+	}
+	code := "const (\n\tN = 1\n)\n\nbody = {\n\tn uint8\n}\n\ninclude \"base.bpl\"\n\ndoc = {\n\ta hdr\n\tb [N]byte\n}\n"
+	r, err := NewFromString(code, filepath.Join(dir, "main.bpl"))
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	v, err := r.MatchBuffer([]byte{1, 2, 3})
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	ret, _ := json.Marshal(v)
+	if string(ret) != `{"a":{"body":{"n":2},"tag":1},"b":"Aw=="}` {
+		t.Fatal("Match:", string(ret))
+	}
+
+	_, err = NewFromString("include \"none.bpl\"\n\ndoc = uint8\n", filepath.Join(dir, "main.bpl"))
+	errs, ok := err.(ErrorList)
+	if !ok || len(errs) != 1 || errs[0].Line != 1 || !strings.Contains(errs[0].Msg, "none.bpl") {
+		t.Fatalf("New: %#v", err)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
 const codeRtmp1 = `
 
 AMF0_NULL = {
@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"encoding/binary"
 	"encoding/json"
-	"io"
 	"reflect"
 
 	"gopkg.in/mgo.v2/bson"
@@ -58,6 +57,35 @@ func (p *Document) Vars() (vars map[string]interface{}, err error) {
 	return p.cache, nil
 }
 
+// Command returns name of the first element of this document, which is the command
+// name if this document is a command (eg. `{find: "users", ...}`), and value of the
+// element if it is a string (eg. the collection name).
+//
+func (p *Document) Command() (name, value string) {
+
+	var d bson.RawD
+	if err := bson.Unmarshal(p.data, &d); err != nil || len(d) == 0 {
+		return
+	}
+	name = d[0].Name
+	if d[0].Value.Kind == 0x02 {
+		d[0].Value.Unmarshal(&value)
+	}
+	return
+}
+
+// Get returns value of the element `name` of this document, or nil if it doesn't
+// exist.
+//
+func (p *Document) Get(name string) interface{} {
+
+	vars, err := p.Vars()
+	if err != nil {
+		return nil
+	}
+	return vars[name]
+}
+
 // -----------------------------------------------------------------------------
 
 type typeImpl int
@@ -70,8 +98,7 @@ func (p typeImpl) Match(in *bufio.Reader, ctx *bpl.Context) (v interface{}, err
 	if err != nil {
 		return
 	}
-	data := make([]byte, n)
-	_, err = io.ReadFull(in, data)
+	data, err := ctx.ReadBytes(in, int(n))
 	if err != nil {
 		return
 	}
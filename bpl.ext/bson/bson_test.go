@@ -34,4 +34,27 @@ func TestBson(t *testing.T) {
 	}
 }
 
+func TestCommand(t *testing.T) {
+
+	b, err := bson.Marshal(bson.D{{Name: "find", Value: "users"}, {Name: "filter", Value: M{"a": 1}}, {Name: "$db", Value: "test"}})
+	if err != nil {
+		t.Fatal("bson.Marshal failed:", err)
+	}
+	doc := &Document{data: b}
+	if name, value := doc.Command(); name != "find" || value != "users" {
+		t.Fatal("Command:", name, value)
+	}
+	if db := doc.Get("$db"); db != "test" {
+		t.Fatal("Get:", db)
+	}
+	if v := doc.Get("limit"); v != nil {
+		t.Fatal("Get:", v)
+	}
+
+	b, _ = bson.Marshal(bson.D{{Name: "ping", Value: 1}})
+	if name, value := (&Document{data: b}).Command(); name != "ping" || value != "" {
+		t.Fatal("Command:", name, value)
+	}
+}
+
 // -----------------------------------------------------------------------------
@@ -2,15 +2,16 @@ package bpl
 
 import (
 	"errors"
-	"fmt"
+	"go/token"
 
 	"qiniu.com/bpl"
 	"qiniu.com/bpl/bpl.ext/bson"
+	"qiniu.com/bpl/bpl.ext/protobuf"
 	"qiniupkg.com/text/tpl.v1/interpreter.util"
 	"qlang.io/exec.v2"
 )
 
-const grammar = `
+const grammarBase = `
 
 expr = +factor/And
 
@@ -54,13 +55,19 @@ assertexpr = ("assert"/istart! iexpr /iend) /assert
 
 fatalexpr = ("fatal"/istart! iexpr /iend) /fatal
 
-gblexpr = "global"! IDENT/var '='/istart! iexpr /iend /global
+gblexpr = "global"! IDENT/gvar '='/istart! iexpr /iend /global
 
 retexpr = "return"/istart! iexpr /iend /return
 
 dumpexpr = "dump"/dump
 
-dynexpr = caseexpr | readexpr | skipexpr | evalexpr | assertexpr | ifexpr | letexpr | doexpr | retexpr | gblexpr | fatalexpr | dumpexpr
+emitexpr = "emit"! factor/emit
+
+checksumexpr = "checksum"! IDENT/source ?('=' IDENT/source)/ARITY factor ?("=="/istart! iexpr/source /iend)/ARITY /checksum
+
+decodeexpr = (("inflate" | "zlib" | "gunzip" | "lz4" | "snappy" | "zstd" | "base64mime" | "base64")! factor)/decode
+
+dynexpr = caseexpr | readexpr | skipexpr | evalexpr | assertexpr | ifexpr | letexpr | doexpr | retexpr | gblexpr | fatalexpr | dumpexpr | emitexpr | checksumexpr | decodeexpr
 
 basetype =
 	IDENT/ident |
@@ -90,7 +97,8 @@ factor =
 	'[' +factor/Seq ']' |
 	dynexpr
 
-imember = IDENT | "assert" | "fatal" | "read" | "skip" | "eval" | "let" | "sizeof" | "C" | "global" | "do" | "dump"
+imember = IDENT | "assert" | "fatal" | "read" | "skip" | "eval" | "let" | "sizeof" | "C" | "global" | "do" | "dump" | "emit" | "checksum" |
+	"inflate" | "zlib" | "gunzip" | "lz4" | "snappy" | "zstd" | "base64" | "base64mime"
 
 atom =
 	'('! qexpr %= ','/ARITY ?"..."/ARITY ?',' ')'/call |
@@ -111,12 +119,34 @@ ifactor =
 cexpr = INT/cpushi
 
 const = (IDENT '=' cexpr ';')/const
+`
 
+const grammar = grammarBase + `
 doc = +(
 	(IDENT '=' expr/xline ';')/assign |
-	"const" '(' *const ')' ';')
+	"const" '(' *const ')' ';' |
+	("include"! STRING)/include ';')
 `
 
+const exprGrammar = grammarBase + `
+doc = qexpr ?';'
+`
+
+// keywords are the words reserved by grammar, in sorted order.
+var keywords = []string{
+	"assert", "base64", "base64mime", "case", "checksum", "const", "default", "do", "dump", "elif", "else", "emit",
+	"eval", "fatal", "global", "gunzip", "if", "include", "inflate", "let", "lz4", "read", "return", "sizeof", "skip",
+	"snappy", "zlib", "zstd",
+}
+
+// Keywords returns all keywords of bpl source code, in sorted order. They can't be used
+// as names of rules, constants or variables.
+//
+func Keywords() []string {
+
+	return append([]string(nil), keywords...)
+}
+
 var (
 	// ErrNoDoc is returned when `doc` is undefined.
 	ErrNoDoc = errors.New("no doc")
@@ -135,6 +165,23 @@ type Compiler struct {
 	gstk     exec.Stack
 	ipt      interpreter.Engine
 	idxStart int
+	fns      []exprFn // closures of the expression being compiled
+	fnEnd    int      // code position after the last closure, or -1
+	names    []string // variables referenced by the expression being compiled
+	grammar  string
+	src      []byte
+	refs     map[string]token.Position // where undefined rules are referenced
+	files    map[string][]byte         // source code of compiled files
+	includes []includeFile             // files to be included, see include
+	included bool                      // compiling an included file
+	used     map[string]bool           // names referenced by expressions
+	hidden   []*bpl.Member             // members whose names start with `_`
+	syms     []Symbol
+}
+
+type includeFile struct {
+	name string
+	pos  token.Position // where the file is included
 }
 
 func newCompiler() (p *Compiler) {
@@ -142,7 +189,12 @@ func newCompiler() (p *Compiler) {
 	rulers := make(map[string]bpl.Ruler)
 	vars := make(map[string]*bpl.TypeVar)
 	consts := make(map[string]interface{})
-	return &Compiler{rulers: rulers, vars: vars, consts: consts}
+	refs := make(map[string]token.Position)
+	used := make(map[string]bool)
+	files := make(map[string][]byte)
+	return &Compiler{
+		rulers: rulers, vars: vars, consts: consts, refs: refs, used: used, files: files, grammar: grammar,
+	}
 }
 
 // Ret returns compiling result.
@@ -157,12 +209,10 @@ func (p *Compiler) Ret() (r Ruler, err error) {
 			return Ruler{}, ErrNoDoc
 		}
 	}
-	for name, v := range p.vars {
-		if v.Elem == nil {
-			err = fmt.Errorf("variable `%s` is not assigned", name)
-			return
-		}
+	if err = p.checkVars(); err != nil {
+		return
 	}
+	p.lazyMembers()
 	return Ruler{Impl: root}, nil
 }
 
@@ -170,7 +220,7 @@ func (p *Compiler) Ret() (r Ruler, err error) {
 //
 func (p *Compiler) Grammar() string {
 
-	return grammar
+	return p.grammar
 }
 
 // Stack returns nil (no stack). It is required by tpl.Interpreter engine.
@@ -192,6 +242,7 @@ var exports = map[string]interface{}{
 	"$array0":   (*Compiler).array0,
 	"$array01":  (*Compiler).repeat01,
 	"$var":      (*Compiler).variable,
+	"$gvar":     (*Compiler).gvar,
 	"$ident":    (*Compiler).ident,
 	"$assign":   (*Compiler).assign,
 	"$repeat0":  (*Compiler).repeat0,
@@ -225,6 +276,7 @@ var exports = map[string]interface{}{
 	"$assert": (*Compiler).fnAssert,
 	"$fatal":  (*Compiler).fnFatal,
 	"$dump":   (*Compiler).fnDump,
+	"$emit":   (*Compiler).emit,
 	"$const":  (*Compiler).fnConst,
 	"$casei":  (*Compiler).casei,
 	"$cases":  (*Compiler).cases,
@@ -234,41 +286,65 @@ var exports = map[string]interface{}{
 	"$qline":  (*Compiler).codeLine,
 	"$xline":  (*Compiler).xline,
 
+	"$checksum": (*Compiler).fnChecksum,
+	"$decode":   (*Compiler).fnDecode,
+	"$include":  (*Compiler).include,
+
 	"exit": exit,
 }
 
 var builtins = map[string]bpl.Ruler{
-	"int8":      bpl.Int8,
-	"int16":     bpl.Int16,
-	"int32":     bpl.Int32,
-	"int64":     bpl.Int64,
-	"uint8":     bpl.Uint8,
-	"byte":      bpl.Uint8,
-	"char":      bpl.Char,
-	"uint16":    bpl.Uint16,
-	"uint24":    bpl.Uint24,
-	"uint32":    bpl.Uint32,
-	"uint64":    bpl.Uint64,
-	"uint16be":  bpl.Uintbe(2),
-	"uint24be":  bpl.Uintbe(3),
-	"uint32be":  bpl.Uintbe(4),
-	"uint64be":  bpl.Uintbe(8),
-	"uint16le":  bpl.Uint16,
-	"uint24le":  bpl.Uint24,
-	"uint32le":  bpl.Uint32,
-	"uint64le":  bpl.Uint64,
-	"float32":   bpl.Float32,
-	"float64":   bpl.Float64,
-	"float32le": bpl.Float32,
-	"float64le": bpl.Float64,
-	"float32be": bpl.Float32be,
-	"float64be": bpl.Float64be,
-	"cstring":   bpl.CString,
-	"nil":       bpl.Nil,
-	"eof":       bpl.EOF,
-	"done":      bpl.Done,
-	"bson":      bson.Type,
-	"dump":      dump(0),
+	"int8":        bpl.Int8,
+	"int16":       bpl.Int16,
+	"int32":       bpl.Int32,
+	"int64":       bpl.Int64,
+	"uint8":       bpl.Uint8,
+	"byte":        bpl.Uint8,
+	"char":        bpl.Char,
+	"uint16":      bpl.Uint16,
+	"uint24":      bpl.Uint24,
+	"uint32":      bpl.Uint32,
+	"uint64":      bpl.Uint64,
+	"uint16be":    bpl.Uintbe(2),
+	"uint24be":    bpl.Uintbe(3),
+	"uint32be":    bpl.Uintbe(4),
+	"uint64be":    bpl.Uintbe(8),
+	"uint16le":    bpl.Uint16,
+	"uint24le":    bpl.Uint24,
+	"uint32le":    bpl.Uint32,
+	"uint64le":    bpl.Uint64,
+	"float32":     bpl.Float32,
+	"float64":     bpl.Float64,
+	"float32le":   bpl.Float32,
+	"float64le":   bpl.Float64,
+	"float32be":   bpl.Float32be,
+	"float64be":   bpl.Float64be,
+	"cstring":     bpl.CString,
+	"zchar":       bpl.ZChar,
+	"uleb128":     bpl.Uleb128,
+	"uvarint":     bpl.Uleb128,
+	"sleb128":     bpl.Sleb128,
+	"zigzag":      bpl.Zigzag,
+	"quicvarint":  bpl.QuicVarint,
+	"berlen":      bpl.BerLength,
+	"mqttlen":     bpl.MqttLength,
+	"pstring8":    bpl.PString(1, false),
+	"pstring16":   bpl.PString(2, false),
+	"pstring32":   bpl.PString(4, false),
+	"pstring16le": bpl.PString(2, false),
+	"pstring32le": bpl.PString(4, false),
+	"pstring16be": bpl.PString(2, true),
+	"pstring32be": bpl.PString(4, true),
+	"utf16le":     bpl.UTF16le,
+	"utf16be":     bpl.UTF16be,
+	"line":        bpl.Line,
+	"crlf":        bpl.CRLF,
+	"nil":         bpl.Nil,
+	"eof":         bpl.EOF,
+	"done":        bpl.Done,
+	"bson":        bson.Type,
+	"protobuf":    protobuf.Type,
+	"dump":        dump(0),
 }
 
 // -----------------------------------------------------------------------------
@@ -1,29 +1,46 @@
 package bpl
 
 import (
+	"bytes"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"reflect"
 	"strconv"
 	"strings"
 
 	"qiniu.com/bpl"
+	"qiniu.com/bpl/checksum"
 	"qiniupkg.com/text/tpl.v1/interpreter.util"
 	"qlang.io/exec.v2"
 )
 
 // -----------------------------------------------------------------------------
 
-func (p *Compiler) eval(ctx *bpl.Context, start, end int) interface{} {
+// An exprBlock is a compiled qlang expression. Like all rulers generated by Compiler,
+// it is immutable after bpl source code is compiled, and state of its evaluation lives
+// in bpl.Context, so it can be evaluated by multiple goroutines concurrently.
+//
+type exprBlock struct {
+	code  *exec.Code
+	start int
+	end   int
+	fn    exprFn // compiled expression, or nil
+}
+
+// interpret executes code of the expression.
+//
+func (e *exprBlock) interpret(ctx *bpl.Context) interface{} {
 
 	vars, hasDom := ctx.Dom().(map[string]interface{})
 	if vars == nil {
 		vars = make(map[string]interface{})
 	}
-	code := &p.code
 	stk := ctx.Stack
 	parent := exec.NewSimpleContext(ctx.Globals.Impl, nil, nil, nil)
-	ectx := exec.NewSimpleContext(vars, stk, code, parent)
-	code.Exec(start, end, stk, ectx)
+	ectx := exec.NewSimpleContext(vars, stk, e.code, parent)
+	e.code.Exec(e.start, e.end, stk, ectx)
 	if !hasDom && len(vars) > 0 { // update dom
 		ctx.SetDom(vars)
 	}
@@ -31,22 +48,18 @@ func (p *Compiler) eval(ctx *bpl.Context, start, end int) interface{} {
 	return v
 }
 
-// -----------------------------------------------------------------------------
-
-type exprBlock struct {
-	start int
-	end   int
-}
-
 func (p *Compiler) istart() {
 
 	p.idxStart = p.code.Len()
+	p.fns = p.fns[:0]
+	p.names = p.names[:0]
+	p.fnEnd = p.idxStart
 }
 
 func (p *Compiler) iend() {
 
 	end := p.code.Len()
-	p.gstk.Push(&exprBlock{start: p.idxStart, end: end})
+	p.gstk.Push(p.newExpr(p.idxStart, end))
 }
 
 func (p *Compiler) popExpr() *exprBlock {
@@ -65,7 +78,7 @@ func (p *Compiler) array() {
 	stk := p.stk
 	i := len(stk) - 1
 	n := func(ctx *bpl.Context) int {
-		v := p.eval(ctx.Parent, e.start, e.end)
+		v := e.eval(ctx.Parent)
 		return toInt(v, "index isn't an integer expression")
 	}
 	stk[i] = bpl.Dynarray(stk[i].(bpl.Ruler), n)
@@ -147,15 +160,20 @@ func (p *Compiler) fnCase(engine interpreter.Engine) {
 	caseExprAndSources := p.gstk.PopNArgs(arity << 1)
 	e := p.popExpr()
 	srcSw, _ := p.gstk.Pop()
+
+	// get sources when compiling, so that the engine isn't used by concurrent matching.
+	key := sourceOf(engine, srcSw)
+	vals := make([]string, arity)
+	for i := range vals {
+		vals[i] = sourceOf(engine, caseExprAndSources[i<<1+1])
+	}
 	r := func(ctx *bpl.Context) (bpl.Ruler, error) {
-		v := p.eval(ctx, e.start, e.end)
+		v := e.eval(ctx)
 		for i := 0; i < len(caseExprAndSources); i += 2 {
 			expr := caseExprAndSources[i]
 			if eq(v, expr) {
 				if SetCaseType {
-					key := sourceOf(engine, srcSw)
-					val := sourceOf(engine, caseExprAndSources[i+1])
-					ctx.SetVar(key+".kind", val)
+					ctx.SetVar(key+".kind", vals[i>>1])
 				}
 				return caseRs[i>>1], nil
 			}
@@ -163,7 +181,7 @@ func (p *Compiler) fnCase(engine interpreter.Engine) {
 		if defaultR != nil {
 			return defaultR, nil
 		}
-		return nil, fmt.Errorf("case `%s(=%v)` is not found", sourceOf(engine, srcSw), v)
+		return nil, fmt.Errorf("case `%s(=%v)` is not found", key, v)
 	}
 	stk[n-arity] = bpl.Dyntype(r)
 	p.stk = stk[:n-arity+1]
@@ -212,7 +230,7 @@ func (p *Compiler) fnIf() {
 		r := func(ctx *bpl.Context) (bpl.Ruler, error) {
 			for i := 0; i < arityOptimized; i++ {
 				e := condExprs[i].(*exprBlock)
-				v := p.eval(ctx, e.start, e.end)
+				v := e.eval(ctx)
 				if toBool(v, "condition isn't a boolean expression") {
 					return bodyRs[i], nil
 				}
@@ -233,7 +251,7 @@ func (p *Compiler) fnEval() {
 	stk := p.stk
 	i := len(stk) - 1
 	expr := func(ctx *bpl.Context) interface{} {
-		return p.eval(ctx, e.start, e.end)
+		return e.eval(ctx)
 	}
 	stk[i] = bpl.Eval(expr, stk[i].(bpl.Ruler))
 }
@@ -244,7 +262,7 @@ func (p *Compiler) fnDo() {
 
 	e := p.popExpr()
 	fn := func(ctx *bpl.Context) error {
-		p.eval(ctx, e.start, e.end)
+		e.eval(ctx)
 		return nil
 	}
 	p.stk = append(p.stk, bpl.Do(fn))
@@ -261,7 +279,7 @@ func (p *Compiler) fnLet() {
 	if arity == 1 {
 		name := stk[n].(string)
 		fn := func(ctx *bpl.Context) error {
-			v := p.eval(ctx, e.start, e.end)
+			v := e.eval(ctx)
 			ctx.LetVar(name, v)
 			return nil
 		}
@@ -269,7 +287,7 @@ func (p *Compiler) fnLet() {
 	} else {
 		names := cloneNames(stk[n:])
 		fn := func(ctx *bpl.Context) error {
-			v := p.eval(ctx, e.start, e.end)
+			v := e.eval(ctx)
 			multiAssignFromSlice(names, v, ctx)
 			return nil
 		}
@@ -278,17 +296,25 @@ func (p *Compiler) fnLet() {
 	}
 }
 
+// specError returns a bpl.SpecError, which reports that bpl source code misuses a rule
+// or an expression when matching.
+//
+func specError(msg string) error {
+
+	return &bpl.SpecError{Err: errors.New(msg)}
+}
+
 func multiAssignFromSlice(names []string, val interface{}, ctx *bpl.Context) {
 
 	v := reflect.ValueOf(val)
 	if v.Kind() != reflect.Slice {
-		panic("expression of multi assignment must be a slice")
+		panic(specError("expression of multi assignment must be a slice"))
 	}
 
 	n := v.Len()
 	arity := len(names)
 	if arity != n {
-		panic(fmt.Errorf("multi assignment error: require %d variables, but we got %d", n, arity))
+		panic(&bpl.SpecError{Err: fmt.Errorf("multi assignment error: require %d variables, but we got %d", n, arity)})
 	}
 
 	for i, name := range names {
@@ -305,7 +331,7 @@ func (p *Compiler) fnGlobal() {
 	i := len(stk) - 1
 	name := stk[i].(string)
 	fn := func(ctx *bpl.Context) error {
-		v := p.eval(ctx, e.start, e.end)
+		v := e.eval(ctx)
 		ctx.Globals.SetVar(name, v)
 		return nil
 	}
@@ -318,22 +344,23 @@ func (p *Compiler) fnAssert(src interface{}) {
 
 	e := p.popExpr()
 	expr := func(ctx *bpl.Context) bool {
-		v := p.eval(ctx, e.start, e.end)
+		v := e.eval(ctx)
 		return toBool(v, "assert condition isn't a boolean expression")
 	}
-	msg := sourceOf(p.ipt, src)
-	p.stk = append(p.stk, bpl.Assert(expr, msg))
+	msg := strings.TrimSpace(strings.TrimPrefix(sourceOf(p.ipt, src), "assert"))
+	names := append([]string(nil), p.names...)
+	p.stk = append(p.stk, bpl.Assert(expr, msg, names...))
 }
 
 func (p *Compiler) fnFatal(src interface{}) {
 
 	e := p.popExpr()
 	r := func(ctx *bpl.Context) (bpl.Ruler, error) {
-		val := p.eval(ctx, e.start, e.end)
+		val := e.eval(ctx)
 		if v, ok := val.(string); ok {
 			panic("fatal: " + v)
 		}
-		panic("fatal <expr> must return a string")
+		panic(specError("fatal <expr> must return a string"))
 	}
 	p.stk = append(p.stk, bpl.Dyntype(r))
 	//p.stk = append(p.stk, bpl.And(dump(0), bpl.Dyntype(r)))
@@ -352,7 +379,7 @@ func (p *Compiler) fnRead() {
 	stk := p.stk
 	i := len(stk) - 1
 	n := func(ctx *bpl.Context) int {
-		v := p.eval(ctx, e.start, e.end)
+		v := e.eval(ctx)
 		return toInt(v, "read bytes isn't an integer expression")
 	}
 	stk[i] = bpl.Read(n, stk[i].(bpl.Ruler))
@@ -362,7 +389,7 @@ func (p *Compiler) fnSkip() {
 
 	e := p.popExpr()
 	n := func(ctx *bpl.Context) int {
-		v := p.eval(ctx, e.start, e.end)
+		v := e.eval(ctx)
 		return toInt(v, "skip bytes isn't an integer expression")
 	}
 	p.stk = append(p.stk, bpl.Skip(n))
@@ -370,11 +397,70 @@ func (p *Compiler) fnSkip() {
 
 // -----------------------------------------------------------------------------
 
+func sumEqual(sum, expected interface{}) bool {
+
+	if b, ok := sum.([]byte); ok {
+		switch v := expected.(type) {
+		case []byte:
+			return bytes.Equal(b, v)
+		case string:
+			return strings.EqualFold(hex.EncodeToString(b), v)
+		}
+		return false
+	}
+	v1, ok1 := castInt(sum)
+	v2, ok2 := castInt(expected)
+	return ok1 && ok2 && v1 == v2
+}
+
+func (p *Compiler) fnChecksum() {
+
+	var e *exprBlock
+	var cond string
+	if p.popArity() != 0 {
+		e = p.popExpr()
+		src, _ := p.gstk.Pop()
+		cond = sourceOf(p.ipt, src)
+	}
+	srcs := p.gstk.PopNArgs(p.popArity() + 1)
+	alg := sourceOf(p.ipt, srcs[len(srcs)-1])
+	newHash, ok := checksum.Lookup(alg)
+	if !ok {
+		panic("unknown checksum algorithm `" + alg + "`")
+	}
+	name := ""
+	if len(srcs) == 2 {
+		name = sourceOf(p.ipt, srcs[0])
+	}
+
+	fn := func(ctx *bpl.Context, h hash.Hash) error {
+		sum := checksum.Value(h)
+		if name != "" {
+			ctx.LetVar(name, sum)
+		}
+		if e != nil {
+			expected := e.eval(ctx)
+			if !sumEqual(sum, expected) {
+				return &bpl.AssertionError{
+					Expr:   "checksum " + alg + " == " + cond,
+					Values: map[string]interface{}{"checksum": fmt.Sprintf("%#x", sum), "expected": fmt.Sprintf("%#x", expected)},
+				}
+			}
+		}
+		return nil
+	}
+	stk := p.stk
+	i := len(stk) - 1
+	stk[i] = bpl.Checksum(newHash, stk[i].(bpl.Ruler), fn)
+}
+
+// -----------------------------------------------------------------------------
+
 func (p *Compiler) fnReturn() {
 
 	e := p.popExpr()
 	fnRet := func(ctx *bpl.Context) (v interface{}, err error) {
-		v = p.eval(ctx, e.start, e.end)
+		v = e.eval(ctx)
 		return
 	}
 	p.stk = append(p.stk, bpl.Return(fnRet))
@@ -386,7 +472,24 @@ func (p *Compiler) member(name string) {
 
 	stk := p.stk
 	i := len(stk) - 1
-	stk[i] = &bpl.Member{Name: name, Type: stk[i].(bpl.Ruler)}
+	m := &bpl.Member{Name: name, Type: stk[i].(bpl.Ruler)}
+	if strings.HasPrefix(name, "_") {
+		p.hidden = append(p.hidden, m)
+	}
+	stk[i] = m
+}
+
+// lazyMembers makes byte arrays (`[n]byte`, `*byte` or `+byte`) of hidden members, whose
+// names start with `_`, lazy if they are never referenced by expressions. Such members
+// aren't dumped, so their bytes needn't be read in lazy mode (see bpl.Context.SetLazyBytes).
+//
+func (p *Compiler) lazyMembers() {
+
+	for _, m := range p.hidden {
+		if !p.used[m.Name] {
+			m.Type = bpl.LazyBytes(m.Type)
+		}
+	}
 }
 
 func (p *Compiler) gostruct() {
@@ -2,6 +2,9 @@ package bpl
 
 import (
 	"encoding/json"
+	"regexp"
+	"sort"
+	"strings"
 	"testing"
 
 	"qiniu.com/bpl/binary"
@@ -713,3 +716,23 @@ func TestUnset(t *testing.T) {
 }
 
 // -----------------------------------------------------------------------------
+
+func TestKeywords(t *testing.T) {
+
+	kws := Keywords()
+	if !sort.StringsAreSorted(kws) {
+		t.Fatal("keywords aren't sorted:", kws)
+	}
+	for _, kw := range kws {
+		if !strings.Contains(grammar, `"`+kw+`"`) {
+			t.Fatal("keyword isn't in grammar:", kw)
+		}
+	}
+	for _, kw := range regexp.MustCompile(`"([a-z][a-z0-9]*)"`).FindAllStringSubmatch(grammar, -1) {
+		if i := sort.SearchStrings(kws, kw[1]); i == len(kws) || kws[i] != kw[1] {
+			t.Fatal("keyword of grammar isn't listed:", kw[1])
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,186 @@
+package bpl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+	"qiniu.com/bpl"
+	"qiniupkg.com/x/bufiox.v7"
+)
+
+// Run these tests with `go test -race` to detect data races of compiled rulers.
+
+// -----------------------------------------------------------------------------
+
+const (
+	stressGoroutines = 16
+	stressRounds     = 8
+)
+
+func mongoMessage(w *bytes.Buffer, requestID, responseTo int, doc interface{}) {
+
+	body, err := bson.Marshal(doc)
+	if err != nil {
+		panic(err)
+	}
+	var h [21]byte
+	binary.LittleEndian.PutUint32(h[0:], uint32(len(h)+len(body)))
+	binary.LittleEndian.PutUint32(h[4:], uint32(requestID))
+	binary.LittleEndian.PutUint32(h[8:], uint32(responseTo))
+	binary.LittleEndian.PutUint32(h[12:], 2013) // OP_MSG
+	// flagBits is 0, and h[20] is the kind of the section: 0
+	w.Write(h[:])
+	w.Write(body)
+}
+
+func mongoData() (req, resp []byte) {
+
+	var w1, w2 bytes.Buffer
+	for i := 1; i <= 100; i++ {
+		mongoMessage(&w1, i, 0, bson.D{{Name: "find", Value: "users"}, {Name: "$db", Value: "test"}})
+		mongoMessage(&w2, 1000+i, i, bson.D{{Name: "ok", Value: 1.0}})
+	}
+	return w1.Bytes(), w2.Bytes()
+}
+
+func stressMatch(r Ruler, data []byte, dir string, sess *bpl.Session, zeroCopy bool) (v interface{}, err error) {
+
+	ctx := NewContext()
+	ctx.Globals.SetVar("BPL_FILTER", map[string]interface{}{})
+	ctx.Globals.SetVar("BPL_DIRECTION", dir)
+	if sess != nil {
+		ctx.Globals.SetVar("BPL_SESSION", sess)
+	}
+	ctx.SetZeroCopy(zeroCopy)
+	in := ctx.NewReader(bytes.NewReader(data))
+	if zeroCopy {
+		in = bufiox.NewReaderBuffer(data)
+	}
+	return r.SafeMatch(in, ctx)
+}
+
+// stressFormat compiles formats/<name>.bpl with its `doc` rule replaced by `doc`, so
+// that matching results are returned instead of dumped.
+//
+func stressFormat(t *testing.T, name, doc string) Ruler {
+
+	b, err := ioutil.ReadFile("../formats/" + name + ".bpl")
+	if err != nil {
+		t.Fatal("ReadFile failed:", err)
+	}
+	code := string(b)
+	code = code[:strings.LastIndex(code, "\ndoc = ")+1] + doc
+	r, err := NewFromString(code, "../formats/"+name+".bpl")
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	return r
+}
+
+func discardDumper() func() {
+
+	old := Dumper
+	SetDumper(ioutil.Discard)
+	return func() {
+		Dumper = old
+	}
+}
+
+func TestConcurrentRtmp(t *testing.T) {
+
+	defer discardDumper()()
+
+	r := stressFormat(t, "rtmp", "doc = init Handshake0 Handshake1 Handshake2 {chunks *Chunk}")
+	data := rtmpData(50)
+	v, err := stressMatch(r, data, "REQ", nil, false)
+	if err != nil {
+		t.Fatal("Match failed:", err)
+	}
+	expected, _ := json.Marshal(v)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, stressGoroutines)
+	for i := 0; i < stressGoroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < stressRounds; j++ {
+				v, err := stressMatch(r, data, "REQ", nil, (i+j)%2 == 0)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if ret, _ := json.Marshal(v); !bytes.Equal(ret, expected) {
+					errs <- fmt.Errorf("unexpected result of goroutine %d: %s", i, ret)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentMongo(t *testing.T) {
+
+	defer discardDumper()()
+
+	r := stressFormat(t, "mongo", "doc = {msgs *Message}")
+	req, resp := mongoData()
+
+	// Each connection matches its requests and responses concurrently, with a shared
+	// session to correlate them, like qbplproxy does.
+	var wg sync.WaitGroup
+	errs := make(chan error, stressGoroutines*2)
+	for i := 0; i < stressGoroutines; i++ {
+		sess := NewSession(time.Second)
+		for _, dir := range []string{"REQ", "RESP"} {
+			wg.Add(1)
+			go func(dir string) {
+				defer wg.Done()
+				data := req
+				if dir == "RESP" {
+					data = resp
+				}
+				v, err := stressMatch(r, data, dir, sess, dir == "RESP")
+				if err != nil {
+					errs <- err
+					return
+				}
+				msgs := v.(map[string]interface{})["msgs"].([]interface{})
+				if len(msgs) != 100 {
+					errs <- fmt.Errorf("%s: %d messages", dir, len(msgs))
+					return
+				}
+				if dir != "RESP" {
+					return
+				}
+				for _, msg := range msgs {
+					request := msg.(map[string]interface{})["request"]
+					if ret, _ := json.Marshal(request); string(ret) != `{"collection":"users","command":"find","db":"test"}` {
+						errs <- fmt.Errorf("request of response: %s", ret)
+						return
+					}
+				}
+			}(dir)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,112 @@
+package bpl
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"io"
+
+	"qiniu.com/bpl"
+	"qiniu.com/bpl/lz4"
+	"qiniu.com/bpl/snappy"
+	"qiniu.com/bpl/zstd"
+)
+
+// -----------------------------------------------------------------------------
+
+// base64Source reads base64 encoded text from the current stream. It stops at the
+// first byte that isn't in the base64 alphabet, or isn't a padding after '='. Line
+// breaks are skipped only in MIME mode (`base64mime R`), where lines are wrapped.
+//
+type base64Source struct {
+	in   *bufio.Reader
+	pad  bool
+	mime bool
+}
+
+func (p *base64Source) isBase64(c byte) bool {
+
+	switch {
+	case c == '\r' || c == '\n':
+		return p.mime
+	case c == '=':
+		p.pad = true
+		return true
+	case p.pad:
+		return false
+	}
+	return c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '+' || c == '/'
+}
+
+func (p *base64Source) Read(b []byte) (n int, err error) {
+
+	in := p.in
+	if in.Buffered() == 0 {
+		if _, err = in.Peek(1); err != nil {
+			return
+		}
+	}
+	size := in.Buffered()
+	if size > len(b) {
+		size = len(b)
+	}
+	buf, _ := in.Peek(size)
+	for n < len(buf) && p.isBase64(buf[n]) {
+		n++
+	}
+	copy(b, buf[:n])
+	in.Discard(n)
+	if n == 0 {
+		err = io.EOF
+	}
+	return
+}
+
+// -----------------------------------------------------------------------------
+
+var decoders = map[string]func(in *bufio.Reader, limit int64) (io.Reader, error){
+	"inflate": func(in *bufio.Reader, limit int64) (io.Reader, error) {
+		return flate.NewReader(in), nil
+	},
+	"zlib": func(in *bufio.Reader, limit int64) (io.Reader, error) {
+		return zlib.NewReader(in)
+	},
+	"gunzip": func(in *bufio.Reader, limit int64) (io.Reader, error) {
+		z, err := gzip.NewReader(in)
+		if err != nil {
+			return nil, err
+		}
+		z.Multistream(false)
+		return z, nil
+	},
+	"lz4": func(in *bufio.Reader, limit int64) (io.Reader, error) {
+		return lz4.NewReader(in)
+	},
+	"snappy": func(in *bufio.Reader, limit int64) (io.Reader, error) {
+		r, err := snappy.NewReader(in, int(limit))
+		if err == snappy.ErrTooLarge {
+			err = bpl.ErrMaxDecodedBytes
+		}
+		return r, err
+	},
+	"zstd": func(in *bufio.Reader, limit int64) (io.Reader, error) {
+		return zstd.NewFrameReader(in), nil
+	},
+	"base64": func(in *bufio.Reader, limit int64) (io.Reader, error) {
+		return base64.NewDecoder(base64.StdEncoding, &base64Source{in: in}), nil
+	},
+	"base64mime": func(in *bufio.Reader, limit int64) (io.Reader, error) {
+		return base64.NewDecoder(base64.StdEncoding, &base64Source{in: in, mime: true}), nil
+	},
+}
+
+func (p *Compiler) fnDecode(name string) {
+
+	stk := p.stk
+	i := len(stk) - 1
+	stk[i] = bpl.Decode(decoders[name], stk[i].(bpl.Ruler))
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,392 @@
+package bpl
+
+import (
+	"bytes"
+	"fmt"
+	"go/token"
+	"sort"
+	"strings"
+
+	"qiniupkg.com/text/tpl.v1"
+	"qiniupkg.com/text/tpl.v1/interpreter"
+)
+
+// -----------------------------------------------------------------------------
+
+// A CompileError represents an error in bpl source code.
+//
+type CompileError struct {
+	File        string
+	Line        int // 0 means the position is unknown
+	Column      int
+	Msg         string
+	Snippet     string   // the source line and a caret pointing at the column
+	Suggestions []string // "did you mean" candidates
+}
+
+func (p *CompileError) Error() string {
+
+	var b bytes.Buffer
+	switch {
+	case p.Line == 0:
+	case p.File == "":
+		fmt.Fprintf(&b, "line %d:%d: ", p.Line, p.Column)
+	default:
+		fmt.Fprintf(&b, "%s:%d:%d: ", p.File, p.Line, p.Column)
+	}
+	b.WriteString(p.Msg)
+	if n := len(p.Suggestions); n > 0 {
+		b.WriteString(", did you mean `")
+		b.WriteString(strings.Join(p.Suggestions, "`, `"))
+		b.WriteString("`?")
+	}
+	if p.Snippet != "" {
+		b.WriteByte('\n')
+		b.WriteString(p.Snippet)
+	}
+	return b.String()
+}
+
+// An ErrorList represents errors in bpl source code. If there are syntax errors, it
+// has the first syntax error of each top-level rule. Otherwise, it has all rules that
+// are referenced but not defined, or the error that stops compiling.
+//
+type ErrorList []*CompileError
+
+func (p ErrorList) Error() string {
+
+	msgs := make([]string, len(p))
+	for i, e := range p {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (p ErrorList) Len() int      { return len(p) }
+func (p ErrorList) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p ErrorList) Less(i, j int) bool {
+
+	if p[i].Line != p[j].Line {
+		return p[i].Line < p[j].Line
+	}
+	if p[i].Column != p[j].Column {
+		return p[i].Column < p[j].Column
+	}
+	return p[i].Msg < p[j].Msg
+}
+
+// -----------------------------------------------------------------------------
+
+func snippetOf(src []byte, line, column int) string {
+
+	if line <= 0 {
+		return ""
+	}
+	for i := 1; i < line; i++ {
+		pos := bytes.IndexByte(src, '\n')
+		if pos < 0 {
+			return ""
+		}
+		src = src[pos+1:]
+	}
+	if pos := bytes.IndexByte(src, '\n'); pos >= 0 {
+		src = src[:pos]
+	}
+	src = bytes.TrimRight(src, "\r")
+
+	var b bytes.Buffer
+	b.Write(src)
+	b.WriteByte('\n')
+	for i := 0; i < column-1 && i < len(src); i++ {
+		if src[i] == '\t' {
+			b.WriteByte('\t')
+		} else {
+			b.WriteByte(' ')
+		}
+	}
+	b.WriteByte('^')
+	return b.String()
+}
+
+func newCompileError(src []byte, pos token.Position, msg string) *CompileError {
+
+	return &CompileError{
+		File:    pos.Filename,
+		Line:    pos.Line,
+		Column:  pos.Column,
+		Msg:     msg,
+		Snippet: snippetOf(src, pos.Line, pos.Column),
+	}
+}
+
+// positionOf returns position of tokens[idx]. If idx is beyond the tokens (eg. a
+// syntax error at the end), it returns the end of the last token, or the end of the
+// file if there are no tokens.
+//
+func positionOf(t tpl.Tokener, tokens []tpl.Token, idx int) (pos token.Position) {
+
+	f := t.Source().File
+	if idx < len(tokens) {
+		return f.Position(tokens[idx].Pos)
+	}
+	if n := len(tokens); n > 0 {
+		last := tokens[n-1]
+		return f.Position(last.Pos + token.Pos(len(last.Literal)))
+	}
+	return f.Position(token.Pos(f.Base() + f.Size()))
+}
+
+func (p *Compiler) position(src interface{}) (pos token.Position) {
+
+	tokens, ok := src.([]tpl.Token)
+	if !ok || len(tokens) == 0 {
+		return
+	}
+	if eng, ok := p.ipt.(*interpreter.Engine); ok {
+		pos = positionOf(eng.Tokener(), tokens, 0)
+	}
+	return
+}
+
+func (p *Compiler) compileError(err error) error {
+
+	switch e := err.(type) {
+	case ErrorList:
+		return e
+	case *CompileError:
+		return ErrorList{e}
+	case *tpl.TokenizeError:
+		return ErrorList{newCompileError(p.src, e.Pos, e.Msg)}
+	case *tpl.MatchError:
+		tokens := e.Src
+		msg := "syntax error"
+		if e.IdxErr < len(tokens) {
+			msg = fmt.Sprintf("syntax error near `%s`", tokens[e.IdxErr].Literal)
+		}
+		if e.Err != nil {
+			msg += ": " + e.Err.Error()
+		}
+		pos := positionOf(e.Ctx.Tokener(), tokens, e.IdxErr)
+		return ErrorList{newCompileError(p.src, pos, msg)}
+	case *interpreter.RuntimeError:
+		var pos token.Position
+		if e.Ctx != nil && len(e.Src) > 0 {
+			pos = positionOf(e.Ctx.Tokener(), e.Src, 0)
+		}
+		return ErrorList{newCompileError(p.src, pos, e.Err.Error())}
+	}
+	return ErrorList{&CompileError{Msg: err.Error()}}
+}
+
+func isSyntaxError(err error) bool {
+
+	switch err.(type) {
+	case *tpl.TokenizeError, *tpl.MatchError:
+		return true
+	}
+	return false
+}
+
+// -----------------------------------------------------------------------------
+
+// topLevelLines returns lines where top-level rules (`name = R` or `const (...)`)
+// start. A top-level rule starts at the first column, and other lines of it are
+// indented or start with a closing bracket.
+//
+func topLevelLines(src []byte) (lines []int) {
+
+	for line := 1; len(src) > 0; line++ {
+		if c := src[0]; c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+			lines = append(lines, line)
+		}
+		pos := bytes.IndexByte(src, '\n')
+		if pos < 0 {
+			break
+		}
+		src = src[pos+1:]
+	}
+	return
+}
+
+// blankLines returns a copy of src, in which lines outside [from, to) are blanked
+// (newlines are kept), so positions of the remaining tokens don't change.
+//
+func blankLines(src []byte, from, to int) []byte {
+
+	ret := make([]byte, len(src))
+	line := 1
+	for i, c := range src {
+		if c == '\n' || line >= from && line < to {
+			ret[i] = c
+		} else {
+			ret[i] = ' '
+		}
+		if c == '\n' {
+			line++
+		}
+	}
+	return ret
+}
+
+// parseAlone parses src without compiling it into a matching unit, and returns the
+// syntax error, if any.
+//
+func parseAlone(src []byte, fname string) (err error) {
+
+	p := newCompiler()
+	p.src = src
+	defer func() {
+		if e := recover(); e != nil { // not a syntax error
+			err = nil
+		}
+		if !isSyntaxError(err) {
+			err = nil
+		}
+	}()
+
+	engine, err := interpreter.New(p, interpreter.InsertSemis)
+	if err != nil {
+		return
+	}
+	p.ipt = engine
+	return engine.MatchExactly(src, fname)
+}
+
+// moreSyntaxErrors parses each top-level rule after the syntax error errs[0] alone,
+// and appends their syntax errors to errs, so all syntax errors are reported at once.
+// Other errors (eg. undefined rules) are only reported if there is no syntax error.
+//
+func (p *Compiler) moreSyntaxErrors(errs ErrorList, fname string) ErrorList {
+
+	if len(errs) != 1 || errs[0].Line == 0 {
+		return errs
+	}
+	lines := topLevelLines(p.src)
+	for i, from := range lines {
+		if from <= errs[0].Line {
+			continue
+		}
+		to := 1 << 30
+		if i+1 < len(lines) {
+			to = lines[i+1]
+		}
+		if err := parseAlone(blankLines(p.src, from, to), fname); err != nil {
+			errs = append(errs, p.compileError(err).(ErrorList)...)
+		}
+	}
+	return errs
+}
+
+// -----------------------------------------------------------------------------
+
+// editDistance returns the edit distance of `a` and `b`, where a transposition of
+// two adjacent characters is counted as one edit.
+//
+func editDistance(a, b string) int {
+
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = min3(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] && d[i-2][j-2]+1 < d[i][j] {
+				d[i][j] = d[i-2][j-2] + 1
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+func min3(a, b, c int) int {
+
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+type candidate struct {
+	name string
+	dist int
+}
+
+// suggest returns at most 3 rule names most similar to `name`.
+//
+func (p *Compiler) suggest(name string) []string {
+
+	limit := len(name) / 3
+	if limit < 1 {
+		limit = 1
+	}
+	var cands []candidate
+	seen := make(map[string]bool)
+	try := func(cand string) {
+		if cand == name || seen[cand] {
+			return
+		}
+		seen[cand] = true
+		d := editDistance(strings.ToLower(name), strings.ToLower(cand))
+		if d <= limit {
+			cands = append(cands, candidate{cand, d})
+		}
+	}
+	for cand := range p.rulers {
+		try(cand)
+	}
+	for cand, v := range p.vars {
+		if v.Elem != nil {
+			try(cand)
+		}
+	}
+	for cand := range builtins {
+		try(cand)
+	}
+	sort.Slice(cands, func(i, j int) bool {
+		if cands[i].dist != cands[j].dist {
+			return cands[i].dist < cands[j].dist
+		}
+		return cands[i].name < cands[j].name
+	})
+	var ret []string
+	for _, c := range cands {
+		if c.dist != cands[0].dist || len(ret) == 3 {
+			break
+		}
+		ret = append(ret, c.name)
+	}
+	return ret
+}
+
+// checkVars reports all rules that are referenced but not defined.
+//
+func (p *Compiler) checkVars() error {
+
+	var errs ErrorList
+	for name, v := range p.vars {
+		if v.Elem == nil {
+			e := newCompileError(p.files[p.refs[name].Filename], p.refs[name], fmt.Sprintf("rule `%s` is not defined", name))
+			e.Suggestions = p.suggest(name)
+			errs = append(errs, e)
+		}
+	}
+	if errs == nil {
+		return nil
+	}
+	sort.Sort(errs)
+	return errs
+}
+
+// -----------------------------------------------------------------------------
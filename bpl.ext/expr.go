@@ -0,0 +1,317 @@
+package bpl
+
+import (
+	"errors"
+	"reflect"
+	"runtime/debug"
+
+	"qiniu.com/bpl"
+	"qlang.io/exec.v2"
+	"qlang.io/qlang.spec.v1"
+)
+
+// -----------------------------------------------------------------------------
+
+// CompileExpr specifies whether to compile qlang expressions of bpl source code to Go
+// closures. Only expressions made of constants, variables, members, indexes, operators
+// and function calls are compiled, others are interpreted. It takes effect when bpl
+// source code is compiled.
+//
+var CompileExpr = true
+
+type exprFn func(ctx *bpl.Context) interface{}
+
+type optimizable interface {
+	OptimizableGetArity() int
+}
+
+// gen generates an instruction with n operands, and replaces closures of the operands
+// with the closure returned by `build`. If any instruction is generated without
+// closures, the expression can't be compiled.
+//
+// Like exec.Code.Block, an instruction whose operands are all constants is folded into
+// a constant.
+//
+func (p *Compiler) gen(instr exec.Instr, n int, build func(args []exprFn) exprFn) {
+
+	start := p.code.Len()
+	end := p.code.Block(instr)
+	if p.fnEnd != start || len(p.fns) < n || !CompileExpr {
+		p.fnEnd = -1
+		return
+	}
+	i := len(p.fns) - n
+	var fn exprFn
+	if _, ok := instr.(optimizable); ok && end == start-n+1 {
+		stk := exec.NewStack()
+		for _, arg := range p.fns[i:] {
+			stk.Push(arg(nil))
+		}
+		instr.Exec(stk, nil)
+		v, _ := stk.Pop()
+		fn = constFn(v)
+	} else {
+		fn = build(p.fns[i:])
+	}
+	p.fns = append(p.fns[:i], fn)
+	p.fnEnd = end
+}
+
+// block generates an instruction which doesn't depend on the execution context. Its
+// closure executes the instruction with n operands.
+//
+func (p *Compiler) block(instr exec.Instr, n int) {
+
+	p.gen(instr, n, func(args []exprFn) exprFn { return instrFn(instr, args) })
+}
+
+func (p *Compiler) compiledExpr(end int) exprFn {
+
+	if p.fnEnd == end && len(p.fns) == 1 {
+		return p.fns[0]
+	}
+	return nil
+}
+
+func (p *Compiler) newExpr(start, end int) *exprBlock {
+
+	return &exprBlock{code: &p.code, start: start, end: end, fn: p.compiledExpr(end)}
+}
+
+// eval evaluates the expression, by its closure if it is compiled.
+//
+func (e *exprBlock) eval(ctx *bpl.Context) interface{} {
+
+	if e.fn == nil {
+		return e.interpret(ctx)
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			e.panicAt(v)
+		}
+	}()
+	return e.fn(ctx)
+}
+
+// panicAt reports file line of the expression like exec.Code.Exec does.
+//
+func (e *exprBlock) panicAt(v interface{}) {
+
+	if _, ok := v.(*exec.Error); ok {
+		panic(v)
+	}
+	err, ok := v.(error)
+	if !ok {
+		s, ok := v.(string)
+		if !ok {
+			panic(v)
+		}
+		err = errors.New(s)
+	}
+	file, line := e.code.Line(e.start)
+	panic(&exec.Error{Err: err, File: file, Line: line, Stack: debug.Stack()})
+}
+
+// -----------------------------------------------------------------------------
+
+func constFn(v interface{}) exprFn {
+
+	return func(ctx *bpl.Context) interface{} {
+		return v
+	}
+}
+
+func refFn(name string) exprFn {
+
+	return func(ctx *bpl.Context) interface{} {
+		if vars, ok := ctx.Dom().(map[string]interface{}); ok {
+			if v, ok := vars[name]; ok {
+				return v
+			}
+		}
+		if v, ok := ctx.Globals.Var(name); ok {
+			return v
+		}
+		if v, ok := qlang.Fntable[name]; ok {
+			return v
+		}
+		panic("symbol not found: " + name)
+	}
+}
+
+// instrFn executes an instruction which doesn't depend on the execution context, with
+// results of `args` as its operands.
+//
+func instrFn(instr exec.Instr, args []exprFn) exprFn {
+
+	args = append([]exprFn(nil), args...)
+	return func(ctx *bpl.Context) interface{} {
+		stk := ctx.Stack
+		for _, arg := range args {
+			stk.Push(arg(ctx))
+		}
+		instr.Exec(stk, nil)
+		v, _ := stk.Pop()
+		return v
+	}
+}
+
+func memberFn(name string, x exprFn) exprFn {
+
+	instr := exec.MemberRef(name)
+	slow := instrFn(instr, []exprFn{x})
+	return func(ctx *bpl.Context) interface{} {
+		if m, ok := x(ctx).(map[string]interface{}); ok {
+			if v, ok := m[name]; ok {
+				return v
+			}
+		}
+		return slow(ctx)
+	}
+}
+
+func indexFn(x, i exprFn) exprFn {
+
+	return func(ctx *bpl.Context) interface{} {
+		return qlang.Get(x(ctx), i(ctx))
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// normInt returns a as an int like arguments of qlang operators are normalized.
+//
+func normInt(a interface{}) (int, bool) {
+
+	switch a1 := a.(type) {
+	case int:
+		return a1, true
+	case uint8:
+		return int(a1), true
+	case uint16:
+		return int(a1), true
+	case uint32:
+		return int(a1), true
+	case uint64:
+		return int(a1), true
+	case int8:
+		return int(a1), true
+	case int16:
+		return int(a1), true
+	case int32:
+		return int(a1), true
+	case int64:
+		return int(a1), true
+	case uint:
+		return int(a1), true
+	}
+	return 0, false
+}
+
+var intOps2 = map[string]func(a, b int) interface{}{
+	"$add":    func(a, b int) interface{} { return a + b },
+	"$sub":    func(a, b int) interface{} { return a - b },
+	"$mul":    func(a, b int) interface{} { return a * b },
+	"$quo":    func(a, b int) interface{} { return a / b },
+	"$mod":    func(a, b int) interface{} { return a % b },
+	"$xor":    func(a, b int) interface{} { return a ^ b },
+	"$lshr":   func(a, b int) interface{} { return a << uint(b) },
+	"$rshr":   func(a, b int) interface{} { return a >> uint(b) },
+	"$bitand": func(a, b int) interface{} { return a & b },
+	"$bitor":  func(a, b int) interface{} { return a | b },
+	"$andnot": func(a, b int) interface{} { return a &^ b },
+	"$lt":     func(a, b int) interface{} { return a < b },
+	"$gt":     func(a, b int) interface{} { return a > b },
+	"$le":     func(a, b int) interface{} { return a <= b },
+	"$ge":     func(a, b int) interface{} { return a >= b },
+	"$eq":     func(a, b int) interface{} { return a == b },
+	"$ne":     func(a, b int) interface{} { return a != b },
+}
+
+var intOps1 = map[string]func(a int) interface{}{
+	"$neg":    func(a int) interface{} { return -a },
+	"$bitnot": func(a int) interface{} { return ^a },
+}
+
+func op2Fn(op func(a, b int) interface{}, fn interface{}, x, y exprFn) exprFn {
+
+	slow := exec.Call(fn)
+	return func(ctx *bpl.Context) interface{} {
+		a, b := x(ctx), y(ctx)
+		if a1, ok := normInt(a); ok {
+			if b1, ok := normInt(b); ok {
+				return op(a1, b1)
+			}
+		}
+		stk := ctx.Stack
+		stk.Push(a)
+		stk.Push(b)
+		slow.Exec(stk, nil)
+		v, _ := stk.Pop()
+		return v
+	}
+}
+
+func op1Fn(op func(a int) interface{}, fn interface{}, x exprFn) exprFn {
+
+	slow := exec.Call(fn)
+	return func(ctx *bpl.Context) interface{} {
+		a := x(ctx)
+		if a1, ok := normInt(a); ok {
+			return op(a1)
+		}
+		stk := ctx.Stack
+		stk.Push(a)
+		slow.Exec(stk, nil)
+		v, _ := stk.Pop()
+		return v
+	}
+}
+
+func boolOpFn(and bool, fn interface{}, x, y exprFn) exprFn {
+
+	slow := exec.Call(fn)
+	return func(ctx *bpl.Context) interface{} {
+		a, b := x(ctx), y(ctx)
+		if a1, ok := a.(bool); ok {
+			if b1, ok := b.(bool); ok {
+				if and {
+					return a1 && b1
+				}
+				return a1 || b1
+			}
+		}
+		stk := ctx.Stack
+		stk.Push(a)
+		stk.Push(b)
+		slow.Exec(stk, nil)
+		v, _ := stk.Pop()
+		return v
+	}
+}
+
+// callFn returns the closure of an operator or a function called by CallFn.
+//
+func callFn(fn interface{}, args []exprFn) exprFn {
+
+	vfn := reflect.ValueOf(fn)
+	for name, op := range intOps2 {
+		if f, ok := qlang.Fntable[name]; ok && reflect.ValueOf(f).Pointer() == vfn.Pointer() {
+			return op2Fn(op, fn, args[0], args[1])
+		}
+	}
+	for name, op := range intOps1 {
+		if f, ok := qlang.Fntable[name]; ok && reflect.ValueOf(f).Pointer() == vfn.Pointer() {
+			return op1Fn(op, fn, args[0])
+		}
+	}
+	switch vfn.Pointer() {
+	case reflect.ValueOf(and).Pointer():
+		return boolOpFn(true, fn, args[0], args[1])
+	case reflect.ValueOf(or).Pointer():
+		return boolOpFn(false, fn, args[0], args[1])
+	}
+	return instrFn(exec.Call(fn), args)
+}
+
+// -----------------------------------------------------------------------------
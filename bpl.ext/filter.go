@@ -0,0 +1,195 @@
+package bpl
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"qiniu.com/bpl"
+)
+
+// -----------------------------------------------------------------------------
+
+// An Expr is a compiled qlang expression that is evaluated against a dom.
+//
+type Expr struct {
+	e    *exprBlock
+	text string
+}
+
+// NewExpr compiles a qlang expression, eg. `opCode == 2013 && len(body) > 1000`.
+//
+func NewExpr(expr string) (e *Expr, err error) {
+
+	p := newCompiler()
+	p.grammar = exprGrammar
+	err = p.compile([]byte(expr), "")
+	if err != nil {
+		return
+	}
+	end := p.code.Len()
+	e = &Expr{e: p.newExpr(0, end), text: expr}
+	return
+}
+
+// Eval evaluates the expression. Variables of the expression are members of
+// ctx.Dom() and global variables of ctx.
+//
+func (p *Expr) Eval(ctx *bpl.Context) (v interface{}, err error) {
+
+	defer func() {
+		if e := recover(); e != nil {
+			switch val := e.(type) {
+			case string:
+				err = errors.New(val)
+			case error:
+				err = val
+			default:
+				err = fmt.Errorf("%v", val)
+			}
+		}
+	}()
+
+	v = p.e.eval(ctx)
+	return
+}
+
+// String returns source code of the expression.
+//
+func (p *Expr) String() string {
+
+	return p.text
+}
+
+// -----------------------------------------------------------------------------
+
+// A Filter decides which records are dumped, and which fields of them are shown.
+//
+type Filter struct {
+	where  *Expr
+	fields []string
+	failed sync.Once // the first error of evaluating `where` is reported
+}
+
+// NewFilter returns a Filter. `where` is a boolean qlang expression over the dom
+// of a record, eg. `opCode == 2013 && len(body) > 1000`. `fields` is a comma
+// separated field list, eg. `header.requestID,opCode`. Both of them can be empty.
+//
+func NewFilter(where, fields string) (f *Filter, err error) {
+
+	f = new(Filter)
+	if where = strings.TrimSpace(where); where != "" {
+		f.where, err = NewExpr(where)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter `%s`: %v", where, err)
+		}
+	}
+	for _, field := range strings.Split(fields, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			f.fields = append(f.fields, field)
+		}
+	}
+	return
+}
+
+// Match evaluates the `where` condition against ctx.Dom(). A record that the
+// condition fails to evaluate (eg. it doesn't have a field) is not matched, and the
+// first such failure is reported to Dumper, so a misspelled field doesn't silently
+// filter out all records.
+//
+func (p *Filter) Match(ctx *bpl.Context) bool {
+
+	if p.where == nil {
+		return true
+	}
+	v, err := p.where.Eval(ctx)
+	if err != nil {
+		p.failed.Do(func() {
+			Dumper.Warn(fmt.Sprintf("filter `%s` fails to evaluate, records where it fails aren't dumped: %v", p.where, err))
+		})
+		return false
+	}
+	ok, _ := v.(bool)
+	return ok
+}
+
+// Select returns the projection of dom on the selected fields. If no field is
+// selected, dom is returned.
+//
+func (p *Filter) Select(dom interface{}) interface{} {
+
+	if len(p.fields) == 0 {
+		return dom
+	}
+	ret := make(map[string]interface{}, len(p.fields))
+	for _, field := range p.fields {
+		if v, ok := fieldOf(dom, strings.Split(field, ".")); ok {
+			ret[field] = v
+		}
+	}
+	return ret
+}
+
+type varsGetter interface {
+	Vars() (vars map[string]interface{}, err error)
+}
+
+func fieldOf(dom interface{}, path []string) (v interface{}, ok bool) {
+
+	for _, name := range path {
+		if d, ok := dom.(varsGetter); ok {
+			vars, err := d.Vars()
+			if err != nil {
+				return nil, false
+			}
+			dom = vars
+		}
+		val := reflect.ValueOf(dom)
+		switch val.Kind() {
+		case reflect.Map:
+			if val.Type().Key().Kind() != reflect.String {
+				return nil, false
+			}
+			item := val.MapIndex(reflect.ValueOf(name).Convert(val.Type().Key()))
+			if !item.IsValid() {
+				return nil, false
+			}
+			dom = item.Interface()
+		case reflect.Slice, reflect.Array:
+			i, err := strconv.Atoi(name)
+			if err != nil || i < 0 || i >= val.Len() {
+				return nil, false
+			}
+			dom = val.Index(i).Interface()
+		default:
+			return nil, false
+		}
+	}
+	return dom, true
+}
+
+// -----------------------------------------------------------------------------
+
+// DumpFilter is the Filter used by `dump`. nil means all records are dumped.
+//
+var DumpFilter *Filter
+
+// SetDumpFilter sets the Filter used by `dump`. See NewFilter.
+//
+func SetDumpFilter(where, fields string) (err error) {
+
+	f, err := NewFilter(where, fields)
+	if err != nil {
+		return
+	}
+	if f.where == nil && f.fields == nil {
+		f = nil
+	}
+	DumpFilter = f
+	return
+}
+
+// -----------------------------------------------------------------------------
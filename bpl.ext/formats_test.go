@@ -0,0 +1,417 @@
+package bpl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2/hpack"
+	"qiniu.com/bpl"
+)
+
+// -----------------------------------------------------------------------------
+
+// visibleDom returns the matching result `v` without hidden members (whose names
+// start with `_`), like DumpDom.
+//
+func visibleDom(v interface{}) interface{} {
+
+	switch val := v.(type) {
+	case map[string]interface{}:
+		if val == nil {
+			return val
+		}
+		ret := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			if !strings.HasPrefix(k, "_") {
+				ret[k] = visibleDom(item)
+			}
+		}
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, len(val))
+		for i, item := range val {
+			ret[i] = visibleDom(item)
+		}
+		return ret
+	}
+	return v
+}
+
+// matchFormat matches `data` by formats/<name>.bpl with its `doc` rule replaced by
+// `doc` (see stressFormat), and returns the matching result in JSON without hidden
+// members and case types. `sess` is BPL_SESSION, or nil to use a new one.
+//
+func matchFormat(t *testing.T, name, doc string, data []byte, dir string, sess *bpl.Session) string {
+
+	defer discardDumper()()
+	SetCaseType = false
+
+	r := stressFormat(t, name, doc)
+	v, err := stressMatch(r, data, dir, sess, false)
+	if err != nil {
+		t.Fatalf("Match %s failed: %v", name, err)
+	}
+	ret, _ := json.Marshal(visibleDom(v))
+	return string(ret)
+}
+
+// -----------------------------------------------------------------------------
+
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// http2Capture returns a client's HTTP/2 stream: the preface, SETTINGS, a request of
+// gRPC method /test.Svc/Get on stream 1 whose message is split into 2 DATA frames,
+// and the same request on stream 3 whose headers are indexed in the dynamic table,
+// and sent by HEADERS and CONTINUATION.
+//
+func http2Capture() []byte {
+
+	var hdrs bytes.Buffer
+	enc := hpack.NewEncoder(&hdrs)
+	fields := []hpack.HeaderField{
+		{Name: ":method", Value: "POST"},
+		{Name: ":path", Value: "/test.Svc/Get"},
+		{Name: "content-type", Value: "application/grpc"},
+	}
+	for _, f := range fields {
+		enc.WriteField(f)
+	}
+	b1 := append([]byte(nil), hdrs.Bytes()...)
+	hdrs.Reset()
+	for _, f := range fields {
+		enc.WriteField(f)
+	}
+	b2 := hdrs.Bytes()
+
+	msg := []byte{0, 0, 0, 0, 3, 0x08, 0x96, 0x01} // {1: 150}
+	b := []byte(http2Preface)
+	b = append(b, http2Frame(4, 0x00, 0, []byte{0, 3, 0, 0, 0, 100})...)
+	b = append(b, http2Frame(1, 0x04, 1, b1)...)
+	b = append(b, http2Frame(0, 0x00, 1, msg[:6])...)
+	b = append(b, http2Frame(0, 0x01, 1, msg[6:])...)
+	b = append(b, http2Frame(1, 0x00, 3, b2[:1])...)
+	b = append(b, http2Frame(9, 0x04, 3, b2[1:])...)
+	return b
+}
+
+// summarize returns the members `names` of each element of the array member `array`
+// of a matching result in JSON.
+//
+func summarize(t *testing.T, dom, array string, names ...string) string {
+
+	var v map[string]interface{}
+	if err := json.Unmarshal([]byte(dom), &v); err != nil {
+		t.Fatal("Unmarshal failed:", err)
+	}
+	items, _ := v[array].([]interface{})
+	var ret []interface{}
+	for _, item := range items {
+		var fields []interface{}
+		for _, name := range names {
+			fields = append(fields, item.(map[string]interface{})[name])
+		}
+		ret = append(ret, fields)
+	}
+	b, _ := json.Marshal(ret)
+	return string(b)
+}
+
+func TestHttp2Format(t *testing.T) {
+
+	dom := matchFormat(t, "http2", "doc = init Preface {frames *Frame}", http2Capture(), "REQ", nil)
+	if !strings.Contains(dom, `"preface":"PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"`) {
+		t.Fatal("preface:", dom)
+	}
+	ret := summarize(t, dom, "frames", "type", "streamId", "headers", "endStream")
+	expected := `[[4,0,null,null],` +
+		`[1,1,{":method":"POST",":path":"/test.Svc/Get","content-type":"application/grpc"},false],` +
+		`[0,1,null,false],[0,1,null,true],[1,3,null,false],` +
+		`[9,3,{":method":"POST",":path":"/test.Svc/Get","content-type":"application/grpc"},null]]`
+	if ret != expected {
+		t.Fatal("frames:", ret)
+	}
+}
+
+func TestGrpcFormat(t *testing.T) {
+
+	dom := matchFormat(t, "grpc", "doc = init Preface {frames *Frame}", http2Capture(), "REQ", nil)
+	ret := summarize(t, dom, "frames", "type", "streamId", "messages", "pending")
+	expected := `[[4,0,null,null],[1,1,null,null],` +
+		`[0,1,[],6],[0,1,[{"compressed":0,"length":3,"msg":{"1":150}}],0],` +
+		`[1,3,null,null],[9,3,null,null]]`
+	if ret != expected {
+		t.Fatal("frames:", ret)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// mongoCompressed returns an OP_COMPRESSED message of `find` compressed by zstd.
+//
+func mongoCompressed(requestID int) []byte {
+
+	// zstd -q --no-check of an OP_MSG body: {find: "users", $db: "test"}
+	compressed, _ := hex.DecodeString("28b52ffd20284101000000000000230000000266696e640006000000" +
+		"757365727300022464620005000000746573740000")
+
+	var w bytes.Buffer
+	var h [25]byte
+	binary.LittleEndian.PutUint32(h[0:], uint32(len(h)+len(compressed)))
+	binary.LittleEndian.PutUint32(h[4:], uint32(requestID))
+	binary.LittleEndian.PutUint32(h[12:], 2012) // OP_COMPRESSED
+	binary.LittleEndian.PutUint32(h[16:], 2013) // originalOpcode: OP_MSG
+	binary.LittleEndian.PutUint32(h[20:], 40)   // uncompressedSize
+	h[24] = 3                                   // compressorId: zstd
+	w.Write(h[:])
+	w.Write(compressed)
+	return w.Bytes()
+}
+
+func TestMongoFormat(t *testing.T) {
+
+	dom := matchFormat(t, "mongo", "doc = {msgs *Message}", mongoCompressed(7), "REQ", nil)
+	ret := summarize(t, dom, "msgs", "originalOpcode", "compressorId", "message")
+	expected := `[[2013,3,{"checksumPresent":false,"collection":"users","command":"find","db":"test","flagBits":0,` +
+		`"moreToCome":false,"sections":[{"body":{"$db":"test","find":"users"},"kind":0}]}]]`
+	if ret != expected {
+		t.Fatal("msgs:", ret)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// -----------------------------------------------------------------------------
+
+type formatCase struct {
+	dir string
+	in  string
+	ret string // the members selected of each message, see summarize
+}
+
+func testFormat(t *testing.T, name string, cases []formatCase, req, resp []string) {
+
+	for i, c := range cases {
+		names := req
+		if c.dir == "RESP" {
+			names = resp
+		}
+		dom := matchFormat(t, name, "doc = init {msgs *Message}", []byte(c.in), c.dir, nil)
+		if ret := summarize(t, dom, "msgs", names...); ret != c.ret {
+			t.Errorf("case %d: %s", i, ret)
+		}
+	}
+}
+
+var redisCases = []formatCase{
+	{"REQ", "*2\r\n$3\r\nget\r\n$3\r\nfoo\r\n", `[["GET",["get","foo"]]]`},
+	{"REQ", "PING\r\nset k  v\r\n", `[["PING",["PING"]],["SET",["set","k","v"]]]`},
+	{"RESP", "+OK\r\n-ERR unknown\r\n:-42\r\n", `[["OK"],[{"error":"ERR unknown"}],[-42]]`},
+	{"RESP", "$5\r\nhello\r\n$0\r\n\r\n$-1\r\n*-1\r\n", `[["hello"],[""],[null],[null]]`},
+	{"RESP", "*2\r\n$1\r\na\r\n*1\r\n:1\r\n", `[[["a",[1]]]]`},
+	{"RESP", "*3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n", `[[["message","ch","hi"]]]`},
+	{"RESP", "_\r\n#t\r\n#f\r\n,1.5\r\n(3492890328409238509324850943850943825024385\r\n",
+		`[[null],[true],[false],[1.5],["3492890328409238509324850943850943825024385"]]`},
+	{"RESP", "!10\r\nSYNTAX bad\r\n=7\r\ntxt:abc\r\n", `[[{"error":"SYNTAX bad"}],["abc"]]`},
+	{"RESP", "%2\r\n+a\r\n:1\r\n+b\r\n:2\r\n~2\r\n+x\r\n+y\r\n", `[[[{"a":1},{"b":2}]],[["x","y"]]]`},
+	{"RESP", "|1\r\n+ttl\r\n:3\r\n+v\r\n>2\r\n+pubsub\r\n+x\r\n", `[[{"attributes":[{"ttl":3}],"value":"v"}],[{"push":["pubsub","x"]}]]`},
+}
+
+func TestRedisFormat(t *testing.T) {
+
+	testFormat(t, "redis", redisCases, []string{"command", "args"}, []string{"reply"})
+
+	// replies are paired with pipelined commands in order, except push data
+	sess := NewSession(0)
+	matchFormat(t, "redis", "doc = init {msgs *Message}", []byte("GET a\r\nGET b\r\n"), "REQ", sess)
+	dom := matchFormat(t, "redis", "doc = init {msgs *Message}", []byte(">2\r\n+pubsub\r\n+x\r\n$1\r\n1\r\n$1\r\n2\r\n"), "RESP", sess)
+	if ret := summarize(t, dom, "msgs", "reply", "request"); ret != `[[{"push":["pubsub","x"]},null],["1",["GET","a"]],["2",["GET","b"]]]` {
+		t.Fatal("msgs:", ret)
+	}
+}
+
+var memcachedCases = []formatCase{
+	{"REQ", "get foo bar\r\nset foo 0 0 3\r\nabc\r\ndelete foo noreply\r\n",
+		`[["get",["get","foo","bar"],null,null,null],["set",["set","foo","0","0","3"],"abc",null,null],` +
+			`["delete",["delete","foo","noreply"],null,null,null]]`},
+	{"REQ", "ms foo 2 T90\r\nhi\r\nmg foo v\r\n",
+		`[["ms",["ms","foo","2","T90"],"hi",null,null],["mg",["mg","foo","v"],null,null,null]]`},
+	{"RESP", "VALUE foo 0 3\r\nabc\r\nVALUE bar 1 2 9\r\nhi\r\nEND\r\nSTORED\r\n",
+		`[["END",[{"data":"abc","flags":"0","key":"foo"},{"cas":"9","data":"hi","flags":"1","key":"bar"}],null,null],` +
+			`["STORED",null,null,null]]`},
+	{"RESP", "STAT pid 1\r\nSTAT version 1.6.21\r\nEND\r\nVA 2 t90\r\nhi\r\nHD\r\n",
+		`[["END",null,{"pid":"1","version":"1.6.21"},null],["VA",[{"data":"hi","flags":["t90"]}],null,null],` +
+			`["HD",null,null,null]]`},
+	{"REQ", memcachedBinary(0x80, 0x01, 0, "key", "value", 8), `[["Set",null,null,"key","value"]]`},
+	{"RESP", memcachedBinary(0x81, 0x00, 1, "", "", 0), `[["Key not found",null,null,"Get"]]`},
+}
+
+// memcachedBinary returns a message of the binary protocol.
+//
+func memcachedBinary(magic, opcode byte, status uint16, key, value string, extLen int) string {
+
+	h := make([]byte, 24)
+	h[0], h[1] = magic, opcode
+	binary.BigEndian.PutUint16(h[2:], uint16(len(key)))
+	h[4] = byte(extLen)
+	binary.BigEndian.PutUint16(h[6:], status)
+	binary.BigEndian.PutUint32(h[8:], uint32(extLen+len(key)+len(value)))
+	binary.BigEndian.PutUint32(h[12:], 0x1234)
+	return string(h) + string(make([]byte, extLen)) + key + value
+}
+
+func TestMemcachedFormat(t *testing.T) {
+
+	testFormat(t, "memcached", memcachedCases, []string{"command", "args", "data", "key", "value"},
+		[]string{"status", "values", "stats", "command"})
+
+	// text replies are paired with commands in order (except `noreply`), and binary
+	// responses by opaque
+	sess := NewSession(0)
+	req := "delete a noreply\r\nget b\r\n" + memcachedBinary(0x80, 0x00, 0, "c", "", 0)
+	matchFormat(t, "memcached", "doc = init {msgs *Message}", []byte(req), "REQ", sess)
+	resp := "END\r\n" + memcachedBinary(0x81, 0x00, 1, "", "", 0)
+	dom := matchFormat(t, "memcached", "doc = init {msgs *Message}", []byte(resp), "RESP", sess)
+	if ret := summarize(t, dom, "msgs", "status", "request"); ret != `[["END",["get","b"]],["Key not found",{"command":"Get","key":"c"}]]` {
+		t.Fatal("msgs:", ret)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// mysqlPacket writes a packet of sequence number `seq` whose payload is the concatenation
+// of `payload`.
+//
+func mysqlPacket(w *bytes.Buffer, seq byte, payload ...string) {
+
+	n := 0
+	for _, p := range payload {
+		n += len(p)
+	}
+	w.Write([]byte{byte(n), byte(n >> 8), byte(n >> 16), seq})
+	for _, p := range payload {
+		w.WriteString(p)
+	}
+}
+
+// mysqlCapture returns a connection of MySQL: the client logs in with
+// mysql_native_password and sends `select 1`, and the server answers with a resultset
+// of one column. The server supports CLIENT_DEPRECATE_EOF, but the client doesn't, so
+// the column definitions and rows end with EOF.
+//
+func mysqlCapture() (req, resp []byte) {
+
+	var w bytes.Buffer
+	caps := "\x08\x82\x08\x00" // CONNECT_WITH_DB, PROTOCOL_41, SECURE_CONNECTION, PLUGIN_AUTH
+	mysqlPacket(&w, 1, caps, "\x00\x00\x00\x01", "\xff", string(make([]byte, 23)),
+		"root\x00", "\x14", strings.Repeat("a", 20), "test\x00", "mysql_native_password\x00")
+	mysqlPacket(&w, 0, "\x03", "select 1")
+	req = append(req, w.Bytes()...)
+
+	w.Reset()
+	mysqlPacket(&w, 0, "\x0a", "8.0.36\x00", "\x07\x00\x00\x00", "12345678", "\x00",
+		"\x08\x82", "\xff", "\x02\x00", "\x08\x01", "\x15", string(make([]byte, 10)),
+		"123456789012\x00", "mysql_native_password\x00")
+	mysqlPacket(&w, 2, "\x00\x00\x00\x02\x00\x00\x00")
+	mysqlPacket(&w, 1, "\x01")
+	mysqlPacket(&w, 2, "\x03def", "\x00", "\x00", "\x00", "\x011", "\x00",
+		"\x0c", "\x3f\x00", "\x01\x00\x00\x00", "\x08", "\x81\x00", "\x00", "\x00\x00")
+	mysqlPacket(&w, 3, "\xfe\x00\x00\x02\x00")
+	mysqlPacket(&w, 4, "\x011")
+	mysqlPacket(&w, 5, "\xfe\x00\x00\x02\x00")
+	resp = w.Bytes()
+	return
+}
+
+func TestMysqlFormat(t *testing.T) {
+
+	req, resp := mysqlCapture()
+	sess := NewSession(0)
+	dom := matchFormat(t, "mysql", "doc = init {msgs *Packet}", req, "REQ", sess)
+	ret := summarize(t, dom, "msgs", "username", "database", "authPluginName", "command", "query")
+	if ret != `[["root","test","mysql_native_password",null,null],[null,null,null,"COM_QUERY","select 1"]]` {
+		t.Fatal("requests:", ret)
+	}
+
+	dom = matchFormat(t, "mysql", "doc = init {msgs *Packet}", resp, "RESP", sess)
+	ret = summarize(t, dom, "msgs", "serverVersion", "capabilities", "auth", "request", "columnCount", "column", "eof", "row")
+	want := `[["8.0.36",17334792,null,null,null,null,null,null],` +
+		`[null,null,{"ok":{"affectedRows":0,"header":0,"info":"","lastInsertId":0,"statusFlags":2,"warnings":0}},null,null,null,null,null],` +
+		`[null,null,null,{"command":"COM_QUERY","query":"select 1"},1,null,null,null],` +
+		`[null,null,null,null,null,{"catalog":"def","characterSet":63,"columnLength":1,"decimals":0,"flags":129,` +
+		`"name":"1","orgName":"","orgTable":"","schema":"","table":"","type":8},null,null],` +
+		`[null,null,null,null,null,null,{"header":254,"statusFlags":2,"warnings":0},null],` +
+		`[null,null,null,null,null,null,null,["1"]],` +
+		`[null,null,null,null,null,null,{"header":254,"statusFlags":2,"warnings":0},null]]`
+	if ret != want {
+		t.Fatal("responses:", ret)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// postgresCapture returns a connection of PostgreSQL: the server rejects SSLRequest,
+// the client logs in with MD5 password and sends `select 1 as n`, and the server answers
+// with a row.
+//
+func postgresCapture() (req, resp []byte) {
+
+	var w bytes.Buffer
+	w.Write([]byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f}) // SSLRequest
+	params := "user\x00alice\x00database\x00test\x00\x00"
+	var n [8]byte
+	binary.BigEndian.PutUint32(n[:], uint32(8+len(params)))
+	binary.BigEndian.PutUint32(n[4:], 3<<16)
+	w.Write(n[:])
+	w.WriteString(params)
+	postgresMessage(&w, 'p', []byte("md5abc\x00"))
+	postgresMessage(&w, 'Q', []byte("select 1 as n\x00"))
+	req = append(req, w.Bytes()...)
+
+	w.Reset()
+	w.WriteByte('N')
+	postgresMessage(&w, 'R', []byte{0, 0, 0, 5, 1, 2, 3, 4})
+	postgresMessage(&w, 'R', []byte{0, 0, 0, 0})
+	postgresMessage(&w, 'S', []byte("server_version\x0016.2\x00"))
+	postgresMessage(&w, 'K', []byte{0, 0, 0, 7, 1, 2, 3, 4})
+	postgresMessage(&w, 'Z', []byte{'I'})
+	field := append([]byte("n\x00"), 0, 0, 0, 0, 0, 0, 0, 0, 0, 23, 0, 4, 0xff, 0xff, 0xff, 0xff, 0, 0)
+	postgresMessage(&w, 'T', append([]byte{0, 1}, field...))
+	postgresMessage(&w, 'D', []byte{0, 2, 0, 0, 0, 1, '1', 0xff, 0xff, 0xff, 0xff})
+	postgresMessage(&w, 'C', []byte("SELECT 1\x00"))
+	postgresMessage(&w, 'Z', []byte{'I'})
+	resp = w.Bytes()
+	return
+}
+
+func TestPostgresFormat(t *testing.T) {
+
+	req, resp := postgresCapture()
+	sess := NewSession(0)
+	dom := matchFormat(t, "postgres", "doc = init {msgs *Message}", req, "REQ", sess)
+	ret := summarize(t, dom, "msgs", "message", "majorVersion", "parameters", "data", "query")
+	if ret != `[["SSLRequest",null,null,null,null],["StartupMessage",3,{"database":"test","user":"alice"},null,null],`+
+		`["PasswordMessage",null,null,"md5abc\u0000",null],["Query",null,null,null,"select 1 as n"]]` {
+		t.Fatal("requests:", ret)
+	}
+
+	dom = matchFormat(t, "postgres", "doc = init {msgs *Message}", resp, "RESP", sess)
+	ret = summarize(t, dom, "msgs", "message", "response", "auth", "salt", "name", "value", "fields", "values", "tag", "request")
+	want := `[[null,"N",null,null,null,null,null,null,null,null],` +
+		`["Authentication",null,"MD5Password","AQIDBA==",null,null,null,null,null,null],` +
+		`["Authentication",null,"Ok",null,null,null,null,null,null,null],` +
+		`["ParameterStatus",null,null,null,"server_version","16.2",null,null,null,null],` +
+		`["BackendKeyData",null,null,null,null,null,null,null,null,null],` +
+		`["ReadyForQuery",null,null,null,null,null,null,null,null,null],` +
+		`["RowDescription",null,null,null,null,null,[{"column":0,"format":0,"name":"n","tableOid":0,` +
+		`"typeModifier":4294967295,"typeOid":23,"typeSize":4}],null,null,null],` +
+		`["DataRow",null,null,null,null,null,null,["1",null],null,null],` +
+		`["CommandComplete",null,null,null,null,null,null,null,"SELECT 1",null],` +
+		`["ReadyForQuery",null,null,null,null,null,null,null,null,{"query":"select 1 as n"}]]`
+	if ret != want {
+		t.Fatal("responses:", ret)
+	}
+}
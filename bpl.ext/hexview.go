@@ -0,0 +1,221 @@
+package bpl
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"qiniu.com/bpl"
+)
+
+// -----------------------------------------------------------------------------
+
+const (
+	hexViewRowBytes = 16
+	hexViewMaxRows  = 4  // rows of bytes shown for a field at most
+	hexViewMaxValue = 48 // runes of a value shown at most
+	hexViewWidth    = 10 + hexViewRowBytes*3 + 1 + hexViewRowBytes + 3
+)
+
+var hexViewColors = []string{
+	"\x1b[31m", "\x1b[32m", "\x1b[33m", "\x1b[34m", "\x1b[35m", "\x1b[36m",
+}
+
+const (
+	hexViewDim   = "\x1b[2m"
+	hexViewReset = "\x1b[0m"
+)
+
+// A HexView shows matching results as a hexdump of the input, like Wireshark. Bytes of
+// each field are shown in their own rows, annotated in a side column with name and
+// value of the field. Nested structs and arrays are shown by indentation. Offsets of
+// matching results must be tracked, see bpl.Context.TrackOffsets.
+//
+type HexView struct {
+	Src   io.ReaderAt // the input stream
+	Color bool        // bytes and names of fields are colored by ANSI escape codes
+}
+
+// Dump writes children of `node` to b. `end` is where the matching result ends, eg.
+// the offset where `dump` is matched (see bpl.Context.Offset), so bytes after the last
+// child are also shown.
+//
+func (p *HexView) Dump(b *bytes.Buffer, node *bpl.Node, end int64) {
+
+	var leaves int
+	p.dumpChildren(b, node, end, 0, &leaves)
+}
+
+func (p *HexView) dumpChildren(b *bytes.Buffer, node *bpl.Node, end int64, lvl int, leaves *int) {
+
+	pos := node.Offset
+	for i, child := range node.Children {
+		if pos >= 0 && child.Offset > pos { // bytes skipped, eg. `_ uint8` or `skip 4`
+			p.dumpBytes(b, pos, child.Offset, lvl, "_", "", hexViewDim)
+		}
+		name := child.Name
+		if name == "" {
+			name = fmt.Sprintf("[%d]", i)
+		}
+		if strings.HasPrefix(name, "_") { // hidden by DumpDom
+			if !reparsed(child, node.Children[i+1:]) {
+				p.dumpBytes(b, child.Offset, child.End, lvl, name, "", hexViewDim)
+			}
+		} else if hasVisible(child.Children) {
+			p.dumpBytes(b, -1, -1, lvl, name, "", "")
+			p.dumpChildren(b, child, child.End, lvl+1, leaves)
+		} else {
+			color := ""
+			if p.Color {
+				color = hexViewColors[*leaves%len(hexViewColors)]
+			}
+			*leaves++
+			p.dumpBytes(b, child.Offset, child.End, lvl, name, hexViewValue(child.Value, hexViewMaxValue), color)
+		}
+		if child.End > pos {
+			pos = child.End
+		}
+	}
+	if pos >= 0 && end > pos {
+		p.dumpBytes(b, pos, end, lvl, "_", "", hexViewDim)
+	}
+}
+
+// reparsed returns if bytes of `node` are matched again by its siblings, eg. `_body`
+// of `eval _body do R`.
+//
+func reparsed(node *bpl.Node, siblings []*bpl.Node) bool {
+
+	for _, sibling := range siblings {
+		if sibling.Offset >= 0 && sibling.Offset < node.End {
+			return true
+		}
+	}
+	return false
+}
+
+func hasVisible(children []*bpl.Node) bool {
+
+	for _, child := range children {
+		if !strings.HasPrefix(child.Name, "_") {
+			return true
+		}
+	}
+	return false
+}
+
+// dumpBytes writes rows of bytes in [from, to) of the input, and annotates the first
+// row with name and value of a field. Only the annotation is written if the bytes are
+// unknown.
+//
+func (p *HexView) dumpBytes(b *bytes.Buffer, from, to int64, lvl int, name, value, color string) {
+
+	var data []byte
+	if from >= 0 && to > from && p.Src != nil {
+		n := to - from
+		if n > hexViewRowBytes*hexViewMaxRows {
+			n = hexViewRowBytes * hexViewMaxRows
+		}
+		data = make([]byte, n)
+		nr, _ := p.Src.ReadAt(data, from)
+		data = data[:nr]
+	}
+	if color != "" && !p.Color {
+		color = ""
+	}
+
+	rows := (len(data) + hexViewRowBytes - 1) / hexViewRowBytes
+	if rows == 0 {
+		rows = 1
+	}
+	for i := 0; i < rows; i++ {
+		row := data[i*hexViewRowBytes:]
+		if len(row) > hexViewRowBytes {
+			row = row[:hexViewRowBytes]
+		}
+		if len(row) > 0 {
+			fmt.Fprintf(b, "%08x  ", from+int64(i*hexViewRowBytes))
+			b.WriteString(color)
+			for j := 0; j < hexViewRowBytes; j++ {
+				if j == 8 {
+					b.WriteByte(' ')
+				}
+				if j < len(row) {
+					fmt.Fprintf(b, "%02x ", row[j])
+				} else {
+					b.WriteString("   ")
+				}
+			}
+			b.WriteString(" |")
+			for _, c := range row {
+				if c < 32 || c > 126 {
+					c = '.'
+				}
+				b.WriteByte(c)
+			}
+			b.WriteString(strings.Repeat(" ", hexViewRowBytes-len(row)))
+			b.WriteByte('|')
+			if color != "" {
+				b.WriteString(hexViewReset)
+			}
+		} else {
+			b.WriteString(strings.Repeat(" ", hexViewWidth))
+		}
+		if i == 0 {
+			b.WriteString("  ")
+			writePrefix(b, lvl)
+			b.WriteString(color)
+			b.WriteString(name)
+			if color != "" {
+				b.WriteString(hexViewReset)
+			}
+			if value != "" {
+				b.WriteString(" = ")
+				b.WriteString(value)
+			}
+		}
+		b.WriteByte('\n')
+	}
+	if more := to - from - int64(len(data)); from >= 0 && len(data) > 0 && more > 0 {
+		fmt.Fprintf(b, "          ... %d more bytes\n", more)
+	}
+}
+
+// hexViewValue returns the value of a field shown in the side column, which has `max`
+// runes at most. Bytes aren't shown, as they are in the hexdump.
+//
+func hexViewValue(v interface{}, max int) string {
+
+	if b, ok := v.([]byte); ok {
+		return fmt.Sprintf("(%d bytes)", len(b))
+	}
+	ret, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	s := string(ret)
+	if utf8.RuneCountInString(s) > max {
+		s = string([]rune(s)[:max]) + "..."
+	}
+	return s
+}
+
+// -----------------------------------------------------------------------------
+
+// DumpHexView is the HexView used by `dump`. nil means matching results are dumped by
+// DumpDom.
+//
+var DumpHexView *HexView
+
+// SetDumpHexView sets `dump` to show matching results by a HexView of input `src`. Offsets
+// of matching results must be tracked, see bpl.Context.TrackOffsets.
+//
+func SetDumpHexView(src io.ReaderAt, color bool) {
+
+	DumpHexView = &HexView{Src: src, Color: color}
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,448 @@
+package bpl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"html"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"qiniu.com/bpl"
+)
+
+// -----------------------------------------------------------------------------
+
+const (
+	htmlMaxBytes   = 64 * 1024 // bytes of a record included in the report at most
+	htmlMaxValue   = 256       // runes of a value included in the report at most
+	htmlMaxRecords = 10000     // records kept in the report at most, older ones are dropped
+	htmlStream     = "BPL_HTML_STREAM"
+)
+
+// An HTMLReport collects records dumped by `dump` with positions of their fields, and
+// writes them as a self-contained HTML file. The report shows records of each stream
+// (eg. a direction of a connection) in a timeline, a collapsible tree of the selected
+// record, and a hex pane synchronized to the selected field. It needs no external
+// assets or network. Only the last htmlMaxRecords records are kept.
+//
+type HTMLReport struct {
+	title   string
+	start   time.Time
+	mutex   sync.Mutex
+	fmutex  sync.Mutex // serializes WriteFile
+	streams []*htmlStreamInfo
+	records []*htmlRecord
+	dropped int // records dropped as there are too many
+	version int // incremented when a stream or a record is added
+	written int // version written by WriteTo
+}
+
+type htmlStreamInfo struct {
+	Conn string `json:"conn"`
+	Dir  string `json:"dir"`
+}
+
+type htmlRecord struct {
+	Stream int       `json:"s"`
+	Time   int64     `json:"t"` // milliseconds since the report starts
+	Offset int64     `json:"o"` // offset of Data in the stream
+	Size   int64     `json:"n"` // bytes of the record, which may be more than len(Data)
+	Data   []byte    `json:"d"`
+	Root   *htmlNode `json:"r"`
+}
+
+type htmlNode struct {
+	Name     string      `json:"n"`
+	Value    string      `json:"v,omitempty"`
+	Offset   int64       `json:"o"`
+	End      int64       `json:"e"`
+	Children []*htmlNode `json:"c,omitempty"`
+}
+
+type htmlStreamRef struct {
+	report *HTMLReport
+	index  int
+	src    io.ReaderAt
+	dumped bool // `dump` is matched, even if the record is filtered out
+}
+
+// A htmlReleaser is a source of stream bytes (see AddStream), which can free bytes
+// before offset `off`.
+//
+type htmlReleaser interface {
+	Release(off int64)
+}
+
+// NewHTMLReport returns a new HTMLReport.
+//
+func NewHTMLReport(title string) *HTMLReport {
+
+	return &HTMLReport{title: title, start: time.Now()}
+}
+
+// AddStream adds records dumped when matching with `ctx` to the report. `conn` and `dir`
+// identify the stream, eg. a connection and its direction (REQ or RESP), and `src` is
+// bytes of the stream. If `src` also has a method `Release(off int64)`, it's called
+// with the end of each record added, as bytes before it aren't read any more. It
+// enables offset tracking of `ctx` (see Context.TrackOffsets).
+//
+func (p *HTMLReport) AddStream(ctx *bpl.Context, conn, dir string, src io.ReaderAt) {
+
+	p.mutex.Lock()
+	p.streams = append(p.streams, &htmlStreamInfo{Conn: conn, Dir: dir})
+	index := len(p.streams) - 1
+	p.version++
+	p.mutex.Unlock()
+
+	ctx.TrackOffsets()
+	ctx.Globals.SetVar(htmlStream, &htmlStreamRef{report: p, index: index, src: src})
+}
+
+// add adds the record being dumped by `dump`.
+//
+func (p *htmlStreamRef) add(in *bufio.Reader, ctx *bpl.Context) {
+
+	if node := ctx.Node(); node != nil {
+		p.addNode(in, ctx, node)
+	}
+}
+
+func (p *htmlStreamRef) addNode(in *bufio.Reader, ctx *bpl.Context, node *bpl.Node) {
+
+	rec := &htmlRecord{
+		Stream: p.index,
+		Time:   int64(time.Since(p.report.start) / time.Millisecond),
+		Offset: node.Offset,
+		Root:   newHTMLNode(node),
+	}
+	end := ctx.Offset(in)
+	if end < node.End { // eg. `dump` inside `eval <expr> do R`
+		end = node.End
+	}
+	if node.Offset >= 0 && end > node.Offset {
+		rec.Size = end - node.Offset
+		n := rec.Size
+		if n > htmlMaxBytes {
+			n = htmlMaxBytes
+		}
+		rec.Data = make([]byte, n)
+		nr, _ := p.src.ReadAt(rec.Data, node.Offset)
+		rec.Data = rec.Data[:nr]
+		rec.Root.End = end
+		if r, ok := p.src.(htmlReleaser); ok {
+			r.Release(end)
+		}
+	}
+	p.report.add(rec)
+}
+
+// add adds a record, and drops the oldest one if there are too many.
+//
+func (p *HTMLReport) add(rec *htmlRecord) {
+
+	p.mutex.Lock()
+	if len(p.records) >= htmlMaxRecords {
+		copy(p.records, p.records[1:])
+		p.records = p.records[:len(p.records)-1]
+		p.dropped++
+	}
+	p.records = append(p.records, rec)
+	p.version++
+	p.mutex.Unlock()
+}
+
+// EndStream is called when matching of a stream added by AddStream with `ctx` ends,
+// and `in` is its input. If `dump` is never matched, eg. formats without `dump`, the
+// whole matching result (see Context.Node) is added as a record, or bytes matched
+// only if the result has no position (eg. `doc = *record`).
+//
+func (p *HTMLReport) EndStream(in *bufio.Reader, ctx *bpl.Context) {
+
+	if s, ok := ctx.Globals.Var(htmlStream); ok {
+		if s := s.(*htmlStreamRef); !s.dumped {
+			node := ctx.Node()
+			if node == nil {
+				node = &bpl.Node{}
+			}
+			s.addNode(in, ctx, node)
+		}
+	}
+}
+
+// Changed reports whether a stream or a record is added after the report is written.
+//
+func (p *HTMLReport) Changed() bool {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.version != p.written
+}
+
+func newHTMLNode(node *bpl.Node) *htmlNode {
+
+	ret := &htmlNode{Name: node.Name, Offset: node.Offset, End: node.End}
+	if len(node.Children) == 0 || !hasVisible(node.Children) {
+		ret.Value = hexViewValue(node.Value, htmlMaxValue)
+	}
+	for _, child := range node.Children {
+		ret.Children = append(ret.Children, newHTMLNode(child))
+	}
+	return ret
+}
+
+// WriteTo writes the report as an HTML file to w.
+//
+func (p *HTMLReport) WriteTo(w io.Writer) (n int64, err error) {
+
+	p.mutex.Lock()
+	data, err := json.Marshal(map[string]interface{}{
+		"title":   p.title,
+		"streams": p.streams,
+		"records": p.records,
+		"dropped": p.dropped,
+	})
+	p.written = p.version
+	p.mutex.Unlock()
+	if err != nil {
+		return
+	}
+
+	var b bytes.Buffer
+	title := html.EscapeString(p.title)
+	b.WriteString(strings.Replace(htmlHead, "{{title}}", title, -1))
+	b.Write(data) // json.Marshal escapes <, > and &, so it's safe inside <script>
+	b.WriteString(htmlTail)
+	return b.WriteTo(w)
+}
+
+// WriteFile writes the report as an HTML file named `name`. The file is replaced at
+// once, so it can be rewritten while records are being added.
+//
+func (p *HTMLReport) WriteFile(name string) (err error) {
+
+	p.fmutex.Lock()
+	defer p.fmutex.Unlock()
+
+	var b bytes.Buffer
+	if _, err = p.WriteTo(&b); err != nil {
+		return
+	}
+	tmp := name + ".tmp"
+	if err = ioutil.WriteFile(tmp, b.Bytes(), 0644); err != nil {
+		return
+	}
+	return os.Rename(tmp, name)
+}
+
+// -----------------------------------------------------------------------------
+
+const htmlHead = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{title}}</title>
+<style>
+body { margin: 0; font: 13px monospace; color: #222; display: flex; flex-direction: column; height: 100vh; }
+header { padding: 6px 10px; background: #333; color: #eee; display: flex; align-items: center; gap: 12px; }
+header h1 { font-size: 14px; margin: 0; flex: 1; }
+header input { width: 280px; font: inherit; padding: 2px 4px; }
+main { flex: 1; display: flex; min-height: 0; }
+#timeline, #tree, #hex { overflow: auto; padding: 6px 10px; border-right: 1px solid #ccc; }
+#timeline { width: 26%; }
+#tree { width: 34%; }
+#hex { flex: 1; white-space: pre; }
+h3 { font-size: 13px; margin: 8px 0 4px; }
+.rec { cursor: pointer; padding: 1px 4px; white-space: nowrap; overflow: hidden; text-overflow: ellipsis; }
+.rec.RESP { padding-left: 24px; color: #064; }
+.rec.REQ { color: #036; }
+.rec.cur { background: #cde; }
+.rec.miss { display: none; }
+.node { cursor: pointer; white-space: nowrap; }
+.node.hidden { color: #999; }
+.node.cur { background: #cde; }
+.node.hit { background: #fe8; }
+details { margin-left: 14px; }
+.leaf { margin-left: 14px; }
+summary { list-style: none; }
+summary::before { content: "+ "; color: #888; }
+details[open] > summary::before { content: "- "; }
+.b { cursor: pointer; }
+.b.sel { background: #fc6; }
+.addr { color: #888; }
+</style>
+</head>
+<body>
+<header><h1>{{title}}</h1><input id="search" placeholder="search fields and values"></header>
+<main><div id="timeline"></div><div id="tree"></div><div id="hex"></div></main>
+<script type="application/json" id="data">`
+
+const htmlTail = `</script>
+<script>
+(function() {
+var data = JSON.parse(document.getElementById("data").textContent);
+var timeline = document.getElementById("timeline"), tree = document.getElementById("tree"), hex = document.getElementById("hex");
+var cur = null, curNode = null, query = "";
+
+function el(tag, cls, text) {
+	var e = document.createElement(tag);
+	if (cls) e.className = cls;
+	if (text != null) e.textContent = text;
+	return e;
+}
+
+function bytesOf(rec) {
+	if (!rec.d) return [];
+	var s = atob(rec.d), b = new Array(s.length);
+	for (var i = 0; i < s.length; i++) b[i] = s.charCodeAt(i);
+	return b;
+}
+
+function summary(node) {
+	var parts = [];
+	(function walk(n) {
+		if (parts.length >= 3) return;
+		if (n.v != null && n.n && n.n[0] != "_") parts.push(n.n + "=" + n.v);
+		(n.c || []).forEach(walk);
+	})(node);
+	return parts.join(" ");
+}
+
+function matches(node) {
+	if (!query) return false;
+	if ((node.n || "").toLowerCase().indexOf(query) >= 0) return true;
+	return node.v != null && node.v.toLowerCase().indexOf(query) >= 0;
+}
+
+function anyMatch(node) {
+	return matches(node) || (node.c || []).some(anyMatch);
+}
+
+function renderTimeline() {
+	var conns = [], groups = {};
+	if (data.dropped) timeline.appendChild(el("div", "addr", data.dropped + " earlier records are dropped"));
+	data.records.forEach(function(rec, i) {
+		var st = data.streams[rec.s], key = st.conn;
+		if (!groups[key]) { groups[key] = []; conns.push(key); }
+		groups[key].push(i);
+	});
+	conns.forEach(function(conn) {
+		timeline.appendChild(el("h3", "", conn ? "connection " + conn : "records"));
+		groups[conn].forEach(function(i) {
+			var rec = data.records[i], st = data.streams[rec.s];
+			var item = el("div", "rec " + st.dir, "+" + rec.t + "ms " + (st.dir || "") + " #" + (data.dropped + i + 1) + " " + summary(rec.r));
+			item.id = "rec" + i;
+			item.onclick = function() { selectRecord(i); };
+			timeline.appendChild(item);
+		});
+	});
+}
+
+function renderNode(node, parent, depth, index) {
+	var name = node.n || "[" + index + "]";
+	var label = node.v != null ? name + " = " + node.v : name;
+	var cls = "node" + (name[0] == "_" ? " hidden" : "") + (matches(node) ? " hit" : "");
+	var e = el("span", cls, label);
+	node.el = e;
+	e.onclick = function(ev) { ev.stopPropagation(); selectNode(node); };
+	if (node.c && node.c.length) {
+		var d = el("details");
+		d.open = depth < 2 || (query && anyMatch(node));
+		var s = el("summary");
+		s.appendChild(e);
+		d.appendChild(s);
+		node.c.forEach(function(child, i) { renderNode(child, d, depth + 1, i); });
+		parent.appendChild(d);
+	} else {
+		var l = el("div", "leaf");
+		l.appendChild(e);
+		parent.appendChild(l);
+	}
+}
+
+function renderHex(rec) {
+	hex.textContent = "";
+	var b = bytesOf(rec);
+	for (var i = 0; i < b.length; i += 16) {
+		hex.appendChild(el("span", "addr", ("0000000" + (rec.o + i).toString(16)).slice(-8) + "  "));
+		var ascii = "";
+		for (var j = 0; j < 16; j++) {
+			if (j == 8) hex.appendChild(document.createTextNode(" "));
+			if (i + j < b.length) {
+				var c = b[i + j], s = el("span", "b", ("0" + c.toString(16)).slice(-2));
+				s.id = "b" + (rec.o + i + j);
+				s.onclick = selectByte.bind(null, rec.o + i + j);
+				hex.appendChild(s);
+				hex.appendChild(document.createTextNode(" "));
+				ascii += c >= 32 && c < 127 ? String.fromCharCode(c) : ".";
+			} else {
+				hex.appendChild(document.createTextNode("   "));
+			}
+		}
+		hex.appendChild(document.createTextNode(" |" + ascii + "|\n"));
+	}
+	if (rec.n > b.length) hex.appendChild(el("div", "addr", "... " + (rec.n - b.length) + " more bytes"));
+}
+
+function selectRecord(i) {
+	if (cur != null) document.getElementById("rec" + cur).classList.remove("cur");
+	cur = i;
+	curNode = null;
+	document.getElementById("rec" + i).classList.add("cur");
+	var rec = data.records[i];
+	tree.textContent = "";
+	(rec.r.c || []).forEach(function(child, j) { renderNode(child, tree, 0, j); });
+	renderHex(rec);
+}
+
+function selectNode(node) {
+	if (curNode) curNode.el.classList.remove("cur");
+	curNode = node;
+	node.el.classList.add("cur");
+	for (var d = node.el.parentNode; d && d != tree; d = d.parentNode) {
+		if (d.tagName == "DETAILS") d.open = true;
+	}
+	var sel = hex.querySelectorAll(".sel");
+	for (var i = 0; i < sel.length; i++) sel[i].classList.remove("sel");
+	var first = null;
+	for (var off = node.o; off >= 0 && off < node.e; off++) {
+		var b = document.getElementById("b" + off);
+		if (!b) break;
+		b.classList.add("sel");
+		first = first || b;
+	}
+	if (first) first.scrollIntoView({block: "nearest"});
+	node.el.scrollIntoView({block: "nearest"});
+}
+
+function selectByte(off) {
+	var best = null;
+	(function walk(nodes) {
+		(nodes || []).forEach(function(n) {
+			if (n.o >= 0 && n.o <= off && off < n.e) { best = n; walk(n.c); }
+		});
+	})(data.records[cur].r.c);
+	if (best) selectNode(best);
+}
+
+document.getElementById("search").oninput = function() {
+	query = this.value.toLowerCase();
+	data.records.forEach(function(rec, i) {
+		document.getElementById("rec" + i).classList.toggle("miss", !!query && !anyMatch(rec.r));
+	});
+	if (cur != null) selectRecord(cur);
+};
+
+renderTimeline();
+if (data.records.length) selectRecord(0);
+})();
+</script>
+</body>
+</html>
+`
+
+// -----------------------------------------------------------------------------
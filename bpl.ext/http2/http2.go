@@ -0,0 +1,169 @@
+package http2
+
+import (
+	"errors"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// -----------------------------------------------------------------------------
+
+// ErrTooLarge is returned when a header block or a message being reassembled is
+// too large.
+//
+var ErrTooLarge = errors.New("http2: header block or message is too large")
+
+// MaxBufferSize is the maximum size of a header block, or a message reassembled
+// by Reassembler.
+//
+var MaxBufferSize = 16 << 20
+
+// A HpackDecoder decodes header blocks of one direction of an HTTP/2 connection.
+// The dynamic table persists across header blocks, so a HpackDecoder should be
+// kept in a global variable, eg. `global _hpack = http2.hpackDecoder()`.
+//
+type HpackDecoder struct {
+	dec    *hpack.Decoder
+	fields []hpack.HeaderField
+	size   int
+}
+
+// MaxTableSize is the upper bound of the dynamic table size that an encoder may
+// change to. It is negotiated by SETTINGS_HEADER_TABLE_SIZE, which a HpackDecoder
+// doesn't know, so it is generous.
+//
+var MaxTableSize uint32 = 1 << 20
+
+// NewHpackDecoder returns a HpackDecoder, whose dynamic table size is initially
+// 4096 bytes.
+//
+func NewHpackDecoder() *HpackDecoder {
+
+	p := new(HpackDecoder)
+	p.dec = hpack.NewDecoder(4096, func(f hpack.HeaderField) {
+		p.fields = append(p.fields, f)
+	})
+	p.dec.SetAllowedMaxDynamicTableSize(MaxTableSize)
+	return p
+}
+
+// Decode decodes a header block fragment of a HEADERS, PUSH_PROMISE or CONTINUATION
+// frame. It returns nil until the last fragment (endHeaders is true) is decoded,
+// and then returns all header fields of the block. Values of a header field that
+// occurs more than once are joined by ", " ("; " for cookie).
+//
+func (p *HpackDecoder) Decode(fragment []byte, endHeaders bool) (headers map[string]interface{}, err error) {
+
+	if p.size += len(fragment); p.size > MaxBufferSize {
+		return nil, ErrTooLarge
+	}
+	if _, err = p.dec.Write(fragment); err != nil {
+		return
+	}
+	if !endHeaders {
+		return
+	}
+	fields := p.fields
+	p.fields, p.size = nil, 0
+	if err = p.dec.Close(); err != nil {
+		return
+	}
+
+	headers = make(map[string]interface{}, len(fields))
+	for _, f := range fields {
+		if old, ok := headers[f.Name]; ok {
+			sep := ", "
+			if f.Name == "cookie" {
+				sep = "; "
+			}
+			headers[f.Name] = old.(string) + sep + f.Value
+		} else {
+			headers[f.Name] = f.Value
+		}
+	}
+	return
+}
+
+// -----------------------------------------------------------------------------
+
+// A Reassembler reassembles length-prefixed messages from DATA frames of each
+// stream. Each message has a header of `hdrSize` bytes, which contains the length
+// of the message body at `lenOff` in big endian, in `lenSize` bytes. For example,
+// gRPC messages are NewReassembler(5, 1, 4).
+//
+type Reassembler struct {
+	hdrSize int
+	lenOff  int
+	lenSize int
+	streams map[uint64][]byte
+}
+
+// NewReassembler returns a new Reassembler.
+//
+func NewReassembler(hdrSize, lenOff, lenSize int) *Reassembler {
+
+	if lenOff < 0 || lenSize < 1 || lenSize > 4 || lenOff+lenSize > hdrSize {
+		panic("http2.NewReassembler: invalid argument")
+	}
+	return &Reassembler{
+		hdrSize: hdrSize, lenOff: lenOff, lenSize: lenSize,
+		streams: make(map[uint64][]byte),
+	}
+}
+
+// Feed appends data of a DATA frame to the stream `id`, and returns all complete
+// messages of the stream (header included). Bytes of an incomplete message are
+// kept until more data is fed.
+//
+func (p *Reassembler) Feed(id uint64, data []byte) (msgs []byte, err error) {
+
+	buf := append(p.streams[id], data...)
+	n := 0
+	for len(buf)-n >= p.hdrSize {
+		size := 0
+		for _, c := range buf[n+p.lenOff : n+p.lenOff+p.lenSize] {
+			size = size<<8 | int(c)
+		}
+		if size > MaxBufferSize {
+			delete(p.streams, id)
+			return nil, ErrTooLarge
+		}
+		if len(buf)-n < p.hdrSize+size {
+			break
+		}
+		n += p.hdrSize + size
+	}
+	msgs = buf[:n:n]
+	if n == len(buf) {
+		delete(p.streams, id)
+	} else {
+		p.streams[id] = append([]byte(nil), buf[n:]...)
+	}
+	return
+}
+
+// Reset drops the incomplete message of the stream `id`, eg. when the stream is
+// reset.
+//
+func (p *Reassembler) Reset(id uint64) {
+
+	delete(p.streams, id)
+}
+
+// Pending returns size of the incomplete message of the stream `id`.
+//
+func (p *Reassembler) Pending(id uint64) int {
+
+	return len(p.streams[id])
+}
+
+// -----------------------------------------------------------------------------
+
+// Exports is the export table of the qlang module `http2`.
+//
+var Exports = map[string]interface{}{
+	"hpackDecoder": NewHpackDecoder,
+	"reassembler":  NewReassembler,
+}
+
+// -----------------------------------------------------------------------------
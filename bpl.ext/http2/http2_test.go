@@ -0,0 +1,95 @@
+package http2
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// -----------------------------------------------------------------------------
+
+func encodeHeaders(enc *hpack.Encoder, buf *bytes.Buffer, fields ...string) []byte {
+
+	buf.Reset()
+	for i := 0; i < len(fields); i += 2 {
+		enc.WriteField(hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+	return append([]byte(nil), buf.Bytes()...)
+}
+
+func TestHpackDecoder(t *testing.T) {
+
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	dec := NewHpackDecoder()
+
+	b1 := encodeHeaders(enc, &buf, ":method", "POST", ":path", "/test.Svc/Get", "x-id", "abc", "cookie", "a=1", "cookie", "b=2")
+	headers, err := dec.Decode(b1, true)
+	if err != nil {
+		t.Fatal("Decode failed:", err)
+	}
+	if headers[":path"] != "/test.Svc/Get" || headers["x-id"] != "abc" || headers["cookie"] != "a=1; b=2" || len(headers) != 4 {
+		t.Fatal("Decode:", headers)
+	}
+
+	b2 := encodeHeaders(enc, &buf, ":method", "POST", ":path", "/test.Svc/Get", "x-id", "abc", "accept", "a", "accept", "b")
+	if len(b2) >= len(b1) {
+		t.Fatal("dynamic table isn't used by the encoder:", len(b1), len(b2))
+	}
+	headers, err = dec.Decode(b2[:3], false) // fragmented by CONTINUATION frames
+	if err != nil || headers != nil {
+		t.Fatal("Decode fragment:", headers, err)
+	}
+	headers, err = dec.Decode(b2[3:], true)
+	if err != nil {
+		t.Fatal("Decode failed:", err)
+	}
+	if headers[":path"] != "/test.Svc/Get" || headers["x-id"] != "abc" || headers["accept"] != "a, b" || len(headers) != 4 {
+		t.Fatal("Decode:", headers)
+	}
+
+	if _, err = NewHpackDecoder().Decode(b2, true); err == nil {
+		t.Fatal("Decode: reference to an empty dynamic table isn't detected")
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+func TestReassembler(t *testing.T) {
+
+	p := NewReassembler(5, 1, 4)
+	msg1 := []byte{0, 0, 0, 0, 3, 'a', 'b', 'c'}
+	msg2 := []byte{0, 0, 0, 0, 0}
+	msg3 := []byte{1, 0, 0, 0, 2, 'x', 'y'}
+
+	data := append(append(append([]byte(nil), msg1...), msg2...), msg3...)
+	msgs, err := p.Feed(1, data[:3])
+	if err != nil || len(msgs) != 0 || p.Pending(1) != 3 {
+		t.Fatal("Feed:", msgs, err, p.Pending(1))
+	}
+	msgs, err = p.Feed(1, data[3:10])
+	if err != nil || !bytes.Equal(msgs, msg1) || p.Pending(1) != 2 {
+		t.Fatal("Feed:", msgs, err, p.Pending(1))
+	}
+	msgs, err = p.Feed(3, msg3) // another stream
+	if err != nil || !bytes.Equal(msgs, msg3) || p.Pending(3) != 0 {
+		t.Fatal("Feed:", msgs, err, p.Pending(3))
+	}
+	msgs, err = p.Feed(1, data[10:])
+	if err != nil || !bytes.Equal(msgs, data[8:]) || p.Pending(1) != 0 {
+		t.Fatal("Feed:", msgs, err, p.Pending(1))
+	}
+
+	p.Feed(1, msg1[:6])
+	p.Reset(1)
+	if p.Pending(1) != 0 {
+		t.Fatal("Reset:", p.Pending(1))
+	}
+
+	if _, err = p.Feed(5, []byte{0, 0xff, 0xff, 0xff, 0xff}); err != ErrTooLarge || p.Pending(5) != 0 {
+		t.Fatal("Feed: too large message -", err)
+	}
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,260 @@
+package protobuf
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+
+	"qiniu.com/bpl"
+)
+
+// -----------------------------------------------------------------------------
+
+var (
+	// ErrTruncated is returned when a message is truncated.
+	ErrTruncated = errors.New("protobuf: message is truncated")
+
+	// ErrInvalidTag is returned when a field tag is invalid.
+	ErrInvalidTag = errors.New("protobuf: invalid field tag")
+
+	// ErrVarintOverflow is returned when a varint overflows a 64-bit integer.
+	ErrVarintOverflow = errors.New("protobuf: varint overflows a 64-bit integer")
+)
+
+// Wire types of the protobuf encoding.
+//
+const (
+	WireVarint     = 0
+	WireFixed64    = 1
+	WireBytes      = 2
+	WireStartGroup = 3
+	WireEndGroup   = 4
+	WireFixed32    = 5
+)
+
+func decodeVarint(b []byte) (v uint64, n int, err error) {
+
+	for shift := uint(0); n < len(b); shift += 7 {
+		c := b[n]
+		n++
+		if shift == 63 && c > 1 {
+			return 0, n, ErrVarintOverflow
+		}
+		v |= uint64(c&0x7f) << shift
+		if c < 0x80 {
+			return
+		}
+	}
+	return 0, n, ErrTruncated
+}
+
+// A field is a field of a message in wire format. v is the value of a varint or
+// fixed field, b is the value of a length-delimited field or the content of a group.
+//
+type field struct {
+	num int
+	wt  int
+	v   uint64
+	b   []byte
+}
+
+// nextField reads the field at the beginning of b, and returns its size.
+//
+func nextField(b []byte) (f field, n int, err error) {
+
+	tag, n, err := decodeVarint(b)
+	if err != nil {
+		return
+	}
+	f.num, f.wt = int(tag>>3), int(tag&7)
+	if f.num == 0 || tag>>3 > 1<<29-1 {
+		return f, n, ErrInvalidTag
+	}
+	switch f.wt {
+	case WireVarint:
+		var m int
+		f.v, m, err = decodeVarint(b[n:])
+		n += m
+	case WireFixed64, WireFixed32:
+		size := 8
+		if f.wt == WireFixed32 {
+			size = 4
+		}
+		if len(b)-n < size {
+			return f, n, ErrTruncated
+		}
+		for i := size - 1; i >= 0; i-- {
+			f.v = f.v<<8 | uint64(b[n+i])
+		}
+		n += size
+	case WireBytes:
+		size, m, err1 := decodeVarint(b[n:])
+		if err1 != nil {
+			return f, n, err1
+		}
+		n += m
+		if uint64(len(b)-n) < size {
+			return f, n, ErrTruncated
+		}
+		f.b = b[n : n+int(size)]
+		n += int(size)
+	case WireStartGroup:
+		start := n
+		for {
+			if n >= len(b) {
+				return f, n, ErrTruncated
+			}
+			sub, m, err1 := nextField(b[n:])
+			if err1 == errEndGroup {
+				if sub.num != f.num {
+					return f, n, ErrInvalidTag
+				}
+				f.b = b[start:n]
+				n += m
+				break
+			}
+			if err1 != nil {
+				return f, n, err1
+			}
+			n += m
+		}
+	case WireEndGroup:
+		err = errEndGroup
+	default:
+		err = ErrInvalidTag
+	}
+	return
+}
+
+var errEndGroup = errors.New("protobuf: end of group")
+
+// -----------------------------------------------------------------------------
+
+func isText(b []byte) bool {
+
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, c := range string(b) {
+		if !unicode.IsPrint(c) && c != '\t' && c != '\n' && c != '\r' {
+			return false
+		}
+	}
+	return true
+}
+
+func addValue(msg map[string]interface{}, key string, v interface{}, repeated bool) {
+
+	old, ok := msg[key]
+	if !ok {
+		if repeated {
+			v = []interface{}{v}
+		}
+		msg[key] = v
+		return
+	}
+	if vals, ok := old.([]interface{}); ok {
+		msg[key] = append(vals, v)
+		return
+	}
+	msg[key] = []interface{}{old, v}
+}
+
+// rawValue guesses the value of a field without schema. A length-delimited field is
+// a string if it is printable UTF-8 text, or a nested message if it can be decoded
+// as a message, or []byte otherwise.
+//
+func rawValue(f *field) interface{} {
+
+	switch f.wt {
+	case WireBytes:
+		if isText(f.b) {
+			return string(f.b)
+		}
+		if msg, err := DecodeRaw(f.b); err == nil {
+			return msg
+		}
+		return f.b
+	case WireStartGroup:
+		if msg, err := DecodeRaw(f.b); err == nil {
+			return msg
+		}
+		return f.b
+	case WireFixed32:
+		return uint32(f.v)
+	}
+	return f.v
+}
+
+// DecodeRaw decodes a message without schema. Fields are keyed by their numbers,
+// and a field that occurs more than once becomes a []interface{}.
+//
+func DecodeRaw(b []byte) (msg map[string]interface{}, err error) {
+
+	msg = make(map[string]interface{})
+	for len(b) > 0 {
+		f, n, err := nextField(b)
+		if err != nil {
+			if err == errEndGroup {
+				err = ErrInvalidTag
+			}
+			return nil, err
+		}
+		addValue(msg, strconv.Itoa(f.num), rawValue(&f), false)
+		b = b[n:]
+	}
+	return msg, nil
+}
+
+// -----------------------------------------------------------------------------
+
+var tyMessage = reflect.TypeOf(map[string]interface{}(nil))
+
+type typeImpl struct {
+	msg *Message // nil means no schema
+}
+
+func (p *typeImpl) Match(in *bufio.Reader, ctx *bpl.Context) (v interface{}, err error) {
+
+	b, err := ioutil.ReadAll(in)
+	if err != nil {
+		return
+	}
+	if p.msg == nil {
+		return DecodeRaw(b)
+	}
+	return p.msg.Decode(b)
+}
+
+func (p *typeImpl) RetType() reflect.Type {
+
+	return tyMessage
+}
+
+func (p *typeImpl) SizeOf() int {
+
+	return -1
+}
+
+// Type is a matching unit that matches a protobuf message without schema. A message
+// isn't self-delimited, so it consumes all the remaining bytes, eg. `read n do protobuf`.
+//
+var Type bpl.Ruler = &typeImpl{}
+
+// MessageType returns a matching unit that matches the message `name` described by
+// the registered schemas. See Load.
+//
+func MessageType(name string) (r bpl.Ruler, err error) {
+
+	msg, ok := Lookup(name)
+	if !ok {
+		return nil, errors.New("protobuf: message not found - " + name)
+	}
+	return &typeImpl{msg: msg}, nil
+}
+
+// -----------------------------------------------------------------------------
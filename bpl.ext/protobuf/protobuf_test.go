@@ -0,0 +1,165 @@
+package protobuf
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+// -----------------------------------------------------------------------------
+
+type enc []byte
+
+func (p enc) uvarint(v uint64) enc {
+
+	for v >= 0x80 {
+		p = append(p, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(p, byte(v))
+}
+
+func (p enc) varint(num int, v uint64) enc {
+
+	return p.uvarint(uint64(num<<3 | WireVarint)).uvarint(v)
+}
+
+func (p enc) bytes(num int, b []byte) enc {
+
+	return append(p.uvarint(uint64(num<<3|WireBytes)).uvarint(uint64(len(b))), b...)
+}
+
+func (p enc) str(num int, s string) enc {
+
+	return p.bytes(num, []byte(s))
+}
+
+func (p enc) fixed64(num int, v uint64) enc {
+
+	p = p.uvarint(uint64(num<<3 | WireFixed64))
+	for i := 0; i < 8; i++ {
+		p = append(p, byte(v>>(uint(i)*8)))
+	}
+	return p
+}
+
+func (p enc) fixed32(num int, v uint32) enc {
+
+	p = p.uvarint(uint64(num<<3 | WireFixed32))
+	for i := 0; i < 4; i++ {
+		p = append(p, byte(v>>(uint(i)*8)))
+	}
+	return p
+}
+
+func toJSON(t *testing.T, v interface{}) string {
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal("json.Marshal failed:", err)
+	}
+	return string(b)
+}
+
+// -----------------------------------------------------------------------------
+
+func TestDecodeRaw(t *testing.T) {
+
+	inner := enc(nil).varint(1, 150)
+	b := enc(nil).varint(1, 1).str(2, "hello").bytes(3, inner).fixed32(4, 7).str(2, "world").bytes(5, []byte{0xff, 0x00})
+	msg, err := DecodeRaw(b)
+	if err != nil {
+		t.Fatal("DecodeRaw failed:", err)
+	}
+	if ret := toJSON(t, msg); ret != `{"1":1,"2":["hello","world"],"3":{"1":150},"4":7,"5":"/wA="}` {
+		t.Fatal("DecodeRaw:", ret)
+	}
+
+	if _, err = DecodeRaw(b[:len(b)-1]); err != ErrTruncated {
+		t.Fatal("DecodeRaw: truncated message -", err)
+	}
+	if _, err = DecodeRaw([]byte{0x07}); err != ErrInvalidTag {
+		t.Fatal("DecodeRaw: invalid tag -", err)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+func fieldDesc(name string, num, typ int, typeName string, repeated bool) []byte {
+
+	b := enc(nil).str(1, name).varint(3, uint64(num)).varint(5, uint64(typ))
+	if repeated {
+		b = b.varint(4, labelRepeated)
+	} else {
+		b = b.varint(4, 1)
+	}
+	if typeName != "" {
+		b = b.str(6, typeName)
+	}
+	return b
+}
+
+func testDescriptorSet() []byte {
+
+	inner := enc(nil).str(1, "Inner").bytes(2, fieldDesc("name", 1, TypeString, "", false))
+	entry := enc(nil).str(1, "MEntry").
+		bytes(2, fieldDesc("key", 1, TypeString, "", false)).
+		bytes(2, fieldDesc("value", 2, TypeInt32, "", false)).
+		bytes(7, enc(nil).varint(7, 1))
+	msg := enc(nil).str(1, "Msg").
+		bytes(2, fieldDesc("id", 1, TypeInt32, "", false)).
+		bytes(2, fieldDesc("vals", 2, TypeSint32, "", true)).
+		bytes(2, fieldDesc("inner", 3, TypeMessage, ".test.Inner", false)).
+		bytes(2, fieldDesc("color", 4, TypeEnum, ".test.Color", false)).
+		bytes(2, fieldDesc("m", 5, TypeMessage, ".test.Msg.MEntry", true)).
+		bytes(2, fieldDesc("d", 6, TypeDouble, "", false)).
+		bytes(2, fieldDesc("tags", 7, TypeString, "", true)).
+		bytes(3, entry)
+	color := enc(nil).str(1, "Color").
+		bytes(2, enc(nil).str(1, "RED").varint(2, 0)).
+		bytes(2, enc(nil).str(1, "GREEN").varint(2, 1))
+	svc := enc(nil).str(1, "Svc").bytes(2, enc(nil).str(1, "Get").str(2, ".test.Msg").str(3, ".test.Inner"))
+	file := enc(nil).str(1, "test.proto").str(2, "test").bytes(4, inner).bytes(4, msg).bytes(5, color).bytes(6, svc)
+	return enc(nil).bytes(1, file)
+}
+
+func TestSchema(t *testing.T) {
+
+	err := Register(testDescriptorSet())
+	if err != nil {
+		t.Fatal("Register failed:", err)
+	}
+
+	m, ok := LookupMethod("/test.Svc/Get")
+	if !ok || m.Input != "test.Msg" || m.Output != "test.Inner" {
+		t.Fatal("LookupMethod:", m, ok)
+	}
+
+	vals := enc(nil).uvarint(3).uvarint(4) // -2, 2
+	b := enc(nil).varint(1, uint64(1<<64-1)).
+		bytes(2, vals).
+		bytes(3, enc(nil).str(1, "foo")).
+		varint(4, 1).
+		bytes(5, enc(nil).str(1, "a").varint(2, 1)).
+		bytes(5, enc(nil).str(1, "b").varint(2, 2)).
+		fixed64(6, math.Float64bits(1.5)).
+		str(7, "x").
+		varint(99, 5)
+	msg, err := Decode(b, "test.Msg")
+	if err != nil {
+		t.Fatal("Decode failed:", err)
+	}
+	ret := toJSON(t, msg)
+	if ret != `{"99":5,"color":"GREEN","d":1.5,"id":-1,"inner":{"name":"foo"},"m":{"a":1,"b":2},"tags":["x"],"vals":[-2,2]}` {
+		t.Fatal("Decode:", ret)
+	}
+
+	if _, err = Decode(enc(nil).str(1, "x"), "test.Msg"); err == nil {
+		t.Fatal("Decode: wire type mismatch isn't detected")
+	}
+	if _, err = MessageType("test.Unknown"); err == nil {
+		t.Fatal("MessageType: unknown message type")
+	}
+}
+
+// -----------------------------------------------------------------------------
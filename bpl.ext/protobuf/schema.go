@@ -0,0 +1,545 @@
+package protobuf
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// -----------------------------------------------------------------------------
+
+// Field types of FieldDescriptorProto.
+//
+const (
+	TypeDouble   = 1
+	TypeFloat    = 2
+	TypeInt64    = 3
+	TypeUint64   = 4
+	TypeInt32    = 5
+	TypeFixed64  = 6
+	TypeFixed32  = 7
+	TypeBool     = 8
+	TypeString   = 9
+	TypeGroup    = 10
+	TypeMessage  = 11
+	TypeBytes    = 12
+	TypeUint32   = 13
+	TypeEnum     = 14
+	TypeSfixed32 = 15
+	TypeSfixed64 = 16
+	TypeSint32   = 17
+	TypeSint64   = 18
+)
+
+const labelRepeated = 3
+
+// A Field describes a field of a message.
+//
+type Field struct {
+	Name     string
+	Number   int
+	Type     int
+	TypeName string // full name of the message or enum type, without the leading '.'
+	Repeated bool
+
+	msg  *Message
+	enum *Enum
+}
+
+// A Message describes a message type.
+//
+type Message struct {
+	Name     string // full name, eg. "helloworld.HelloRequest"
+	Fields   map[int]*Field
+	MapEntry bool // it is the entry type of a map field
+}
+
+// An Enum describes an enum type.
+//
+type Enum struct {
+	Name   string
+	Values map[int32]string
+}
+
+// A Method describes a method of a service.
+//
+type Method struct {
+	Name   string // eg. "/helloworld.Greeter/SayHello", the path of gRPC
+	Input  string // full name of the input message type
+	Output string // full name of the output message type
+}
+
+var (
+	mutex    sync.RWMutex
+	messages = make(map[string]*Message)
+	enums    = make(map[string]*Enum)
+	methods  = make(map[string]*Method)
+)
+
+// Lookup returns the message type `name` of the registered schemas.
+//
+func Lookup(name string) (msg *Message, ok bool) {
+
+	mutex.RLock()
+	msg, ok = messages[strings.TrimPrefix(name, ".")]
+	mutex.RUnlock()
+	return
+}
+
+// LookupMethod returns the method of the registered schemas by its gRPC path, eg.
+// "/helloworld.Greeter/SayHello".
+//
+func LookupMethod(path string) (method *Method, ok bool) {
+
+	mutex.RLock()
+	method, ok = methods[path]
+	mutex.RUnlock()
+	return
+}
+
+// Load registers all types of a descriptor set file, which is generated by
+// `protoc --include_imports -o <file>`.
+//
+func Load(file string) error {
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return Register(b)
+}
+
+// Register registers all types of a serialized FileDescriptorSet.
+//
+func Register(set []byte) (err error) {
+
+	s := &descSet{
+		messages: make(map[string]*Message),
+		enums:    make(map[string]*Enum),
+		methods:  make(map[string]*Method),
+	}
+	err = forFields(set, func(f *field) error {
+		if f.num == 1 { // FileDescriptorProto file
+			return s.file(f.b)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for name, msg := range s.messages {
+		messages[name] = msg
+	}
+	for name, enum := range s.enums {
+		enums[name] = enum
+	}
+	for _, msg := range messages { // types not registered are decoded without schema
+		for _, f := range msg.Fields {
+			switch f.Type {
+			case TypeMessage, TypeGroup:
+				f.msg = messages[f.TypeName]
+			case TypeEnum:
+				f.enum = enums[f.TypeName]
+			}
+		}
+	}
+	for path, m := range s.methods {
+		methods[path] = m
+	}
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+
+func forFields(b []byte, fn func(f *field) error) error {
+
+	for len(b) > 0 {
+		f, n, err := nextField(b)
+		if err != nil {
+			if err == errEndGroup {
+				err = ErrInvalidTag
+			}
+			return err
+		}
+		if err = fn(&f); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+type descSet struct {
+	messages map[string]*Message
+	enums    map[string]*Enum
+	methods  map[string]*Method
+}
+
+func (p *descSet) file(b []byte) error {
+
+	var pkg string
+	var msgs, enums, services [][]byte
+	err := forFields(b, func(f *field) error {
+		switch f.num {
+		case 2:
+			pkg = string(f.b)
+		case 4:
+			msgs = append(msgs, f.b)
+		case 5:
+			enums = append(enums, f.b)
+		case 6:
+			services = append(services, f.b)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if err = p.message(pkg, msg); err != nil {
+			return err
+		}
+	}
+	for _, enum := range enums {
+		if err = p.enum(pkg, enum); err != nil {
+			return err
+		}
+	}
+	for _, svc := range services {
+		if err = p.service(pkg, svc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fullName(scope, name string) string {
+
+	if scope == "" {
+		return name
+	}
+	return scope + "." + name
+}
+
+func (p *descSet) message(scope string, b []byte) error {
+
+	msg := &Message{Fields: make(map[int]*Field)}
+	var nested, enums [][]byte
+	err := forFields(b, func(f *field) error {
+		switch f.num {
+		case 1:
+			msg.Name = fullName(scope, string(f.b))
+		case 2:
+			fld, err := newField(f.b)
+			if err != nil {
+				return err
+			}
+			msg.Fields[fld.Number] = fld
+		case 3:
+			nested = append(nested, f.b)
+		case 4:
+			enums = append(enums, f.b)
+		case 7: // MessageOptions
+			return forFields(f.b, func(f *field) error {
+				if f.num == 7 { // map_entry
+					msg.MapEntry = f.v != 0
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	p.messages[msg.Name] = msg
+	for _, b := range nested {
+		if err = p.message(msg.Name, b); err != nil {
+			return err
+		}
+	}
+	for _, b := range enums {
+		if err = p.enum(msg.Name, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newField(b []byte) (fld *Field, err error) {
+
+	fld = new(Field)
+	err = forFields(b, func(f *field) error {
+		switch f.num {
+		case 1:
+			fld.Name = string(f.b)
+		case 3:
+			fld.Number = int(f.v)
+		case 4:
+			fld.Repeated = f.v == labelRepeated
+		case 5:
+			fld.Type = int(f.v)
+		case 6:
+			fld.TypeName = strings.TrimPrefix(string(f.b), ".")
+		}
+		return nil
+	})
+	return
+}
+
+func (p *descSet) enum(scope string, b []byte) error {
+
+	enum := &Enum{Values: make(map[int32]string)}
+	err := forFields(b, func(f *field) error {
+		switch f.num {
+		case 1:
+			enum.Name = fullName(scope, string(f.b))
+		case 2: // EnumValueDescriptorProto
+			var name string
+			var num int32
+			err := forFields(f.b, func(f *field) error {
+				if f.num == 1 {
+					name = string(f.b)
+				} else if f.num == 2 {
+					num = int32(f.v)
+				}
+				return nil
+			})
+			enum.Values[num] = name
+			return err
+		}
+		return nil
+	})
+	p.enums[enum.Name] = enum
+	return err
+}
+
+func (p *descSet) service(pkg string, b []byte) error {
+
+	var name string
+	var ms []*Method
+	err := forFields(b, func(f *field) error {
+		switch f.num {
+		case 1:
+			name = fullName(pkg, string(f.b))
+		case 2: // MethodDescriptorProto
+			m := new(Method)
+			ms = append(ms, m)
+			return forFields(f.b, func(f *field) error {
+				switch f.num {
+				case 1:
+					m.Name = string(f.b)
+				case 2:
+					m.Input = strings.TrimPrefix(string(f.b), ".")
+				case 3:
+					m.Output = strings.TrimPrefix(string(f.b), ".")
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	for _, m := range ms {
+		m.Name = "/" + name + "/" + m.Name
+		p.methods[m.Name] = m
+	}
+	return err
+}
+
+// -----------------------------------------------------------------------------
+
+var errWireType = errors.New("protobuf: wire type doesn't match the field type")
+
+func zigzag(v uint64) int64 {
+
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (p *Field) scalar(wt int, v uint64) (interface{}, error) {
+
+	want := WireVarint
+	switch p.Type {
+	case TypeDouble, TypeFixed64, TypeSfixed64:
+		want = WireFixed64
+	case TypeFloat, TypeFixed32, TypeSfixed32:
+		want = WireFixed32
+	}
+	if wt != want {
+		return nil, errWireType
+	}
+
+	switch p.Type {
+	case TypeDouble:
+		return math.Float64frombits(v), nil
+	case TypeFloat:
+		return math.Float32frombits(uint32(v)), nil
+	case TypeInt64, TypeSfixed64:
+		return int64(v), nil
+	case TypeInt32, TypeSfixed32:
+		return int32(v), nil
+	case TypeUint32, TypeFixed32:
+		return uint32(v), nil
+	case TypeBool:
+		return v != 0, nil
+	case TypeEnum:
+		if p.enum != nil {
+			if name, ok := p.enum.Values[int32(v)]; ok {
+				return name, nil
+			}
+		}
+		return int32(v), nil
+	case TypeSint32:
+		return int32(zigzag(v)), nil
+	case TypeSint64:
+		return zigzag(v), nil
+	}
+	return v, nil
+}
+
+func (p *Field) value(f *field) (interface{}, error) {
+
+	switch p.Type {
+	case TypeString:
+		if f.wt == WireBytes {
+			return string(f.b), nil
+		}
+	case TypeBytes:
+		if f.wt == WireBytes {
+			return f.b, nil
+		}
+	case TypeMessage, TypeGroup:
+		if f.wt == WireBytes || f.wt == WireStartGroup {
+			if p.msg == nil {
+				return DecodeRaw(f.b)
+			}
+			return p.msg.Decode(f.b)
+		}
+	default:
+		return p.scalar(f.wt, f.v)
+	}
+	return nil, errWireType
+}
+
+// packed decodes a packed repeated field.
+//
+func (p *Field) packed(b []byte) (vals []interface{}, err error) {
+
+	for len(b) > 0 {
+		var f field
+		var n int
+		switch p.Type {
+		case TypeDouble, TypeFixed64, TypeSfixed64:
+			f.wt, n = WireFixed64, 8
+		case TypeFloat, TypeFixed32, TypeSfixed32:
+			f.wt, n = WireFixed32, 4
+		default:
+			if f.v, n, err = decodeVarint(b); err != nil {
+				return
+			}
+		}
+		if n > len(b) {
+			return nil, ErrTruncated
+		}
+		if f.wt != WireVarint {
+			for i := n - 1; i >= 0; i-- {
+				f.v = f.v<<8 | uint64(b[i])
+			}
+		}
+		v, err := p.scalar(f.wt, f.v)
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, v)
+		b = b[n:]
+	}
+	return
+}
+
+func isScalar(typ int) bool {
+
+	switch typ {
+	case TypeString, TypeBytes, TypeMessage, TypeGroup:
+		return false
+	}
+	return true
+}
+
+// Decode decodes a message of this type. Fields are keyed by their names, except
+// unknown fields, which are keyed by their numbers just like DecodeRaw. Enum values
+// are decoded as their names, and map fields as map[string]interface{}.
+//
+func (p *Message) Decode(b []byte) (msg map[string]interface{}, err error) {
+
+	msg = make(map[string]interface{})
+	err = forFields(b, func(f *field) error {
+		fld, ok := p.Fields[f.num]
+		if !ok {
+			addValue(msg, strconv.Itoa(f.num), rawValue(f), false)
+			return nil
+		}
+		if fld.Repeated && f.wt == WireBytes && isScalar(fld.Type) {
+			vals, err := fld.packed(f.b)
+			if err != nil {
+				return err
+			}
+			old, _ := msg[fld.Name].([]interface{})
+			msg[fld.Name] = append(old, vals...)
+			return nil
+		}
+		v, err := fld.value(f)
+		if err != nil {
+			return fmt.Errorf("%v: %s.%s", err, p.Name, fld.Name)
+		}
+		if fld.msg != nil && fld.msg.MapEntry {
+			entries, _ := msg[fld.Name].(map[string]interface{})
+			if entries == nil {
+				entries = make(map[string]interface{})
+				msg[fld.Name] = entries
+			}
+			entry := v.(map[string]interface{})
+			entries[fmt.Sprint(entry["key"])] = entry["value"]
+			return nil
+		}
+		addValue(msg, fld.Name, v, fld.Repeated)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Decode decodes a message of type `name`, which is registered by Load. If name is
+// empty, the message is decoded without schema, see DecodeRaw.
+//
+func Decode(b []byte, name string) (msg map[string]interface{}, err error) {
+
+	if name == "" {
+		return DecodeRaw(b)
+	}
+	m, ok := Lookup(name)
+	if !ok {
+		return nil, errors.New("protobuf: message not found - " + name)
+	}
+	return m.Decode(b)
+}
+
+// -----------------------------------------------------------------------------
+
+// Exports is the export table of the qlang module `protobuf`.
+//
+var Exports = map[string]interface{}{
+	"load":      Load,
+	"decode":    Decode,
+	"decodeRaw": DecodeRaw,
+	"method":    LookupMethod,
+}
+
+// -----------------------------------------------------------------------------
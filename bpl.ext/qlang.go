@@ -6,6 +6,9 @@ import (
 	"reflect"
 	"strconv"
 
+	"qiniu.com/bpl/bpl.ext/http2"
+	"qiniu.com/bpl/bpl.ext/protobuf"
+	"qiniupkg.com/text/tpl.v1"
 	"qlang.io/exec.v2"
 	"qlang.io/qlang.spec.v1"
 	"qlang.io/qlang/bytes"
@@ -63,6 +66,8 @@ func init() {
 	qlang.Import("http", httpExports)
 	qlang.Import("strconv", qstrconv.Exports)
 	qlang.Import("strings", strings.Exports)
+	qlang.Import("protobuf", protobuf.Exports)
+	qlang.Import("http2", http2.Exports)
 }
 
 // Fntable returns the qlang compiler's function table. It is required by tpl.Interpreter engine.
@@ -106,7 +111,7 @@ func toInt(a interface{}, msg string) int {
 	if v, ok := castInt(a); ok {
 		return v
 	}
-	panic(msg)
+	panic(specError(msg))
 }
 
 func toBool(a interface{}, msg string) bool {
@@ -117,14 +122,15 @@ func toBool(a interface{}, msg string) bool {
 	if v, ok := castInt(a); ok {
 		return v != 0
 	}
-	panic(msg)
+	panic(specError(msg))
 }
 
 // CallFn generates a function call instruction. It is required by tpl.Interpreter engine.
 //
 func (p *Compiler) CallFn(fn interface{}) {
 
-	p.code.Block(exec.Call(fn))
+	n := reflect.TypeOf(fn).NumIn()
+	p.gen(exec.Call(fn), n, func(args []exprFn) exprFn { return callFn(fn, args) })
 }
 
 func eq(a, b interface{}) bool {
@@ -200,31 +206,39 @@ func (p *Compiler) call() {
 		if arity == 0 {
 			panic("what do you mean of `...`?")
 		}
-		p.code.Block(exec.CallFnv(arity))
+		p.block(exec.CallFnv(arity), arity+1)
 	} else {
-		p.code.Block(exec.CallFn(arity))
+		p.block(exec.CallFn(arity), arity+1)
 	}
 }
 
 func (p *Compiler) ref(name string) {
 
-	var instr exec.Instr
+	p.used[name] = true
 	if v, ok := p.consts[name]; ok {
-		instr = exec.Push(v)
+		p.pushConst(v)
+	} else if name != "unset" {
+		p.names = append(p.names, name)
+		p.gen(exec.Ref(name), 0, func(args []exprFn) exprFn { return refFn(name) })
 	} else {
-		instr = exec.Ref(name)
+		p.code.Block(exec.Ref(name))
 	}
-	p.code.Block(instr)
 }
 
 func (p *Compiler) mref(name string) {
 
-	p.code.Block(exec.MemberRef(name))
+	p.used[name] = true
+	p.gen(exec.MemberRef(name), 1, func(args []exprFn) exprFn { return memberFn(name, args[0]) })
 }
 
 func (p *Compiler) pushi(v int) {
 
-	p.code.Block(exec.Push(v))
+	p.pushConst(v)
+}
+
+func (p *Compiler) pushConst(v interface{}) {
+
+	p.gen(exec.Push(v), 0, func(args []exprFn) exprFn { return constFn(v) })
 }
 
 func (p *Compiler) pushs(lit string) {
@@ -233,7 +247,7 @@ func (p *Compiler) pushs(lit string) {
 	if err != nil {
 		panic("invalid string `" + lit + "`: " + err.Error())
 	}
-	p.code.Block(exec.Push(v))
+	p.pushConst(v)
 }
 
 func (p *Compiler) pushc(lit string) {
@@ -245,7 +259,7 @@ func (p *Compiler) pushc(lit string) {
 	if tail != "" || multibyte {
 		panic("invalid char: " + lit)
 	}
-	p.code.Block(exec.Push(byte(v)))
+	p.pushConst(byte(v))
 }
 
 func (p *Compiler) cpushi(v int) {
@@ -253,9 +267,15 @@ func (p *Compiler) cpushi(v int) {
 	p.gstk.Push(v)
 }
 
-func (p *Compiler) fnConst(name string) {
+func (p *Compiler) fnConst(src interface{}) {
 
-	p.consts[name] = p.popConstInt()
+	name := src.([]tpl.Token)[0].Literal
+	v := p.popConstInt()
+	if _, ok := p.consts[name]; ok && p.included {
+		return
+	}
+	p.consts[name] = v
+	p.addSymbol(name, ConstSymbol, src)
 }
 
 // -----------------------------------------------------------------------------
@@ -263,13 +283,13 @@ func (p *Compiler) fnConst(name string) {
 func (p *Compiler) fnMap() {
 
 	arity := p.popArity()
-	p.code.Block(exec.Call(qlang.MapFrom, arity*2))
+	p.block(exec.Call(qlang.MapFrom, arity*2), arity*2)
 }
 
 func (p *Compiler) fnSlice() {
 
 	arity := p.popArity()
-	p.code.Block(exec.SliceFrom(arity))
+	p.block(exec.SliceFrom(arity), arity)
 }
 
 func (p *Compiler) index() {
@@ -282,9 +302,16 @@ func (p *Compiler) index() {
 		if arity1 == 0 {
 			panic("call operator[] without index")
 		}
-		p.code.Block(exec.Get)
+		p.gen(exec.Get, 2, func(args []exprFn) exprFn { return indexFn(args[0], args[1]) })
 	} else {
-		p.code.Block(exec.Op3(qlang.SubSlice, arity1 != 0, arity2 != 0))
+		n := 1
+		if arity1 != 0 {
+			n++
+		}
+		if arity2 != 0 {
+			n++
+		}
+		p.block(exec.Op3(qlang.SubSlice, arity1 != 0, arity2 != 0), n)
 	}
 }
 
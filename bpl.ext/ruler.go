@@ -2,9 +2,11 @@ package bpl
 
 import (
 	"fmt"
+	"path/filepath"
+	"strconv"
 
 	"qiniu.com/bpl"
-	"qlang.io/exec.v2"
+	"qiniupkg.com/text/tpl.v1"
 )
 
 // -----------------------------------------------------------------------------
@@ -74,23 +76,30 @@ func (p *Compiler) sizeof(name string) {
 	if n < 0 {
 		panic(fmt.Errorf("sizeof error: type `%v` isn't a fixed size type", name))
 	}
-	p.code.Block(exec.Push(n))
+	p.pushConst(n)
 }
 
-func (p *Compiler) ident(name string) {
+func (p *Compiler) ident(src interface{}) {
 
+	name := src.([]tpl.Token)[0].Literal
 	r, ok := p.ruleOf(name)
 	if !ok {
 		v := &bpl.TypeVar{Name: name}
 		p.vars[name] = v
+		p.refs[name] = p.position(src)
 		r = v
 	}
 	p.stk = append(p.stk, r)
 }
 
-func (p *Compiler) assign(name string) {
+func (p *Compiler) assign(src interface{}) {
 
-	a := p.stk[0].(bpl.Ruler)
+	name := src.([]tpl.Token)[0].Literal
+	if p.included && p.defined(name) { // the including file overrides the rule
+		p.stk = p.stk[:0]
+		return
+	}
+	a := bpl.Named(name, p.stk[0].(bpl.Ruler))
 	if v, ok := p.vars[name]; ok {
 		if err := v.Assign(a); err != nil {
 			panic(err)
@@ -100,9 +109,38 @@ func (p *Compiler) assign(name string) {
 	} else {
 		p.rulers[name] = a
 	}
+	p.addSymbol(name, RuleSymbol, src)
 	p.stk = p.stk[:0]
 }
 
+func (p *Compiler) defined(name string) bool {
+
+	if _, ok := p.rulers[name]; ok {
+		return true
+	}
+	v, ok := p.vars[name]
+	return ok && v.Elem != nil
+}
+
+// include queues the file of an `include "file"` statement. The file name is relative
+// to the directory of the including file. Included files are compiled after the
+// including file, and their rules and constants are ignored if the including file
+// defines them, so the including file can override rules of an included file.
+//
+func (p *Compiler) include(src interface{}) {
+
+	tokens := src.([]tpl.Token)
+	name, err := strconv.Unquote(tokens[1].Literal)
+	if err != nil {
+		panic("invalid string `" + tokens[1].Literal + "`: " + err.Error())
+	}
+	pos := p.position(src)
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(filepath.Dir(pos.Filename), name)
+	}
+	p.includes = append(p.includes, includeFile{name: filepath.Clean(name), pos: pos})
+}
+
 func (p *Compiler) repeat0() {
 
 	stk := p.stk
@@ -124,6 +162,13 @@ func (p *Compiler) repeat01() {
 	stk[i] = bpl.Repeat01(stk[i].(bpl.Ruler))
 }
 
+func (p *Compiler) emit() {
+
+	stk := p.stk
+	i := len(stk) - 1
+	stk[i] = bpl.Emit(stk[i].(bpl.Ruler))
+}
+
 func (p *Compiler) xline(src interface{}) {
 
 	f := p.ipt.FileLine(src)
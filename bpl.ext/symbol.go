@@ -0,0 +1,169 @@
+package bpl
+
+import (
+	"errors"
+	"go/token"
+	"sort"
+
+	"qiniupkg.com/text/tpl.v1"
+	"qiniupkg.com/text/tpl.v1/interpreter"
+	"qlang.io/qlang.spec.v1"
+)
+
+// -----------------------------------------------------------------------------
+
+// A SymbolKind represents kind of a Symbol.
+//
+type SymbolKind int
+
+const (
+	// RuleSymbol is kind of rules, eg. `header = {...}`.
+	RuleSymbol SymbolKind = iota
+
+	// ConstSymbol is kind of constants defined in `const (...)` blocks.
+	ConstSymbol
+
+	// GlobalSymbol is kind of global variables, eg. `global msgs = {}`.
+	GlobalSymbol
+)
+
+// A Symbol represents a rule, constant or global variable defined in bpl source code.
+//
+type Symbol struct {
+	Name string
+	Kind SymbolKind
+	Pos  token.Position // where the definition starts
+	End  token.Position // where the definition ends
+}
+
+func (p *Compiler) addSymbol(name string, kind SymbolKind, src interface{}) {
+
+	tokens, ok := src.([]tpl.Token)
+	if !ok || len(tokens) == 0 || p.included { // only symbols of the compiled file
+		return
+	}
+	eng, ok := p.ipt.(*interpreter.Engine)
+	if !ok {
+		return
+	}
+	t := eng.Tokener()
+	last := len(tokens) - 1
+	end := positionOf(t, tokens, last)
+	end.Column += len(tokens[last].Literal)
+	end.Offset += len(tokens[last].Literal)
+	p.syms = append(p.syms, Symbol{
+		Name: name,
+		Kind: kind,
+		Pos:  positionOf(t, tokens, 0),
+		End:  end,
+	})
+}
+
+func (p *Compiler) gvar(src interface{}) {
+
+	name := src.([]tpl.Token)[0].Literal
+	for _, sym := range p.syms {
+		if sym.Kind == GlobalSymbol && sym.Name == name {
+			p.variable(name)
+			return
+		}
+	}
+	p.addSymbol(name, GlobalSymbol, src)
+	p.variable(name)
+}
+
+// -----------------------------------------------------------------------------
+
+// Analyze compiles bpl source code like NewModule. But it returns the module when
+// the source code can be parsed, even if there are semantic errors (eg. undefined
+// rules). It is designed for tools such as language servers.
+//
+func Analyze(code []byte, fname string) (mod *Module, err error) {
+
+	defer func() {
+		if e := recover(); e != nil {
+			switch v := e.(type) {
+			case string:
+				err = errors.New(v)
+			case error:
+				err = v
+			default:
+				panic(e)
+			}
+		}
+	}()
+
+	p := newCompiler()
+	err = p.compileFile(code, fname)
+	if err != nil {
+		return
+	}
+	mod = &Module{p: p}
+	if err = p.compileIncludes(); err != nil {
+		return
+	}
+	return mod, p.checkVars()
+}
+
+// Symbols returns all rules, constants and global variables defined in the source
+// code, in the order they are defined.
+//
+func (p *Module) Symbols() []Symbol {
+
+	return p.p.syms
+}
+
+// Const returns value of a constant defined in the source code.
+//
+func (p *Module) Const(name string) (v interface{}, ok bool) {
+
+	v, ok = p.p.consts[name]
+	return
+}
+
+// Builtins returns names of all builtin types, in sorted order.
+//
+func Builtins() []string {
+
+	names := make([]string, 0, len(builtins))
+	for name := range builtins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Modules returns names of all qlang modules that can be used in bpl source code,
+// in sorted order.
+//
+func Modules() []string {
+
+	var names []string
+	for name, v := range qlang.Fntable {
+		if _, ok := v.(map[string]interface{}); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ModuleExports returns names of all members of a qlang module, in sorted order.
+//
+func ModuleExports(mod string) []string {
+
+	table, ok := qlang.Fntable[mod].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	names := make([]string, 0, len(table))
+	for name := range table {
+		if name != "" && name[0] != '_' {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,112 @@
+package bpl
+
+import (
+	"bufio"
+	"hash"
+	"io"
+	"reflect"
+)
+
+// -----------------------------------------------------------------------------
+
+// hashReader is the source of a small bufio.Reader that reads bytes from `in`.
+// It only peeks bytes of `in` until they are known to be consumed, and then hashes
+// and discards them. So `in` is never read beyond what the rule consumes.
+//
+type hashReader struct {
+	in   *bufio.Reader
+	h    hash.Hash
+	size int // buffer size of the reader reading from hashReader
+	n    int // bytes peeked from `in` but not yet consumed
+}
+
+const hashBufferSize = 64
+
+func (p *hashReader) consume(n int) {
+
+	b, _ := p.in.Peek(n)
+	p.h.Write(b)
+	p.in.Discard(n)
+	p.n -= n
+}
+
+func (p *hashReader) Read(b []byte) (n int, err error) {
+
+	// bufio.Reader reads into the tail of its buffer, so all bytes returned
+	// except the last (size - len(b)) ones have been consumed.
+	unread := p.size - len(b)
+	if unread < 0 {
+		unread = 0
+	}
+	if p.n > unread {
+		p.consume(p.n - unread)
+	}
+
+	want := p.n + len(b)
+	if buffered := p.in.Buffered(); want > buffered { // only wait for one more byte
+		want = buffered
+		if want <= p.n {
+			want = p.n + 1
+		}
+	}
+	if size := p.in.Size(); want > size {
+		want = size
+	}
+	buf, err := p.in.Peek(want)
+	if len(buf) > p.n {
+		n = copy(b, buf[p.n:])
+		p.n += n
+		return n, nil
+	}
+	if err == nil || err == bufio.ErrBufferFull { // `in` is a buffer, and all its bytes are peeked
+		err = io.EOF
+	}
+	return
+}
+
+type checksum struct {
+	h  func() hash.Hash
+	r  Ruler
+	fn func(ctx *Context, h hash.Hash) error
+}
+
+func (p *checksum) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	hr := &hashReader{in: in, h: p.h(), size: hashBufferSize}
+	base := ctx.Tell(in)
+	cr := &countReader{r: hr, n: base}
+	hin := bufio.NewReaderSize(cr, hashBufferSize)
+	if base >= 0 {
+		ctx.st.readers[hin] = readerInfo{cr: cr, parent: in}
+		defer delete(ctx.st.readers, hin)
+	}
+
+	v, err = MatchStream(p.r, hin, ctx)
+	hr.consume(hr.n - hin.Buffered())
+	if err != nil {
+		return
+	}
+	err = p.fn(ctx, hr.h)
+	return
+}
+
+func (p *checksum) RetType() reflect.Type {
+
+	return p.r.RetType()
+}
+
+func (p *checksum) SizeOf() int {
+
+	return p.r.SizeOf()
+}
+
+// Checksum returns a matching unit that matches R, and computes the digest of the
+// bytes R consumes by h(). The bytes are hashed while they are read, without being
+// buffered. fn(ctx, hash) is called after R is matched.
+//
+func Checksum(h func() hash.Hash, r Ruler, fn func(ctx *Context, h hash.Hash) error) Ruler {
+
+	return &checksum{h: h, r: r, fn: fn}
+}
+
+// -----------------------------------------------------------------------------
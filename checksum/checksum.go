@@ -0,0 +1,117 @@
+package checksum
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+	"hash/adler32"
+	"hash/crc32"
+	"hash/crc64"
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// -----------------------------------------------------------------------------
+
+var (
+	mutex  sync.RWMutex
+	hashes = make(map[string]func() hash.Hash)
+)
+
+// Register registers a checksum (or hash) algorithm, so that it can be used by
+// `checksum <name> R` in bpl source code.
+//
+func Register(name string, newHash func() hash.Hash) {
+
+	mutex.Lock()
+	hashes[name] = newHash
+	mutex.Unlock()
+}
+
+// Lookup returns the checksum algorithm registered by `name`.
+//
+func Lookup(name string) (newHash func() hash.Hash, ok bool) {
+
+	mutex.RLock()
+	newHash, ok = hashes[name]
+	mutex.RUnlock()
+	return
+}
+
+// Names returns names of all registered checksum algorithms in sorted order.
+//
+func Names() []string {
+
+	mutex.RLock()
+	names := make([]string, 0, len(hashes))
+	for name := range hashes {
+		names = append(names, name)
+	}
+	mutex.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// Value returns the digest of h. A digest not longer than 8 bytes is returned as
+// an unsigned integer (uint8, uint16, uint32 or uint64). Otherwise it is returned
+// as a []byte.
+//
+func Value(h hash.Hash) interface{} {
+
+	n := h.Size()
+	if n > 8 {
+		return h.Sum(nil)
+	}
+	var v uint64
+	for _, c := range h.Sum(nil) {
+		v = v<<8 | uint64(c)
+	}
+	switch {
+	case n == 1:
+		return uint8(v)
+	case n == 2:
+		return uint16(v)
+	case n <= 4:
+		return uint32(v)
+	}
+	return v
+}
+
+// -----------------------------------------------------------------------------
+
+func init() {
+
+	crc32c := crc32.MakeTable(crc32.Castagnoli)
+	crc32k := crc32.MakeTable(crc32.Koopman)
+	crc64iso := crc64.MakeTable(crc64.ISO)
+	crc64ecma := crc64.MakeTable(crc64.ECMA)
+
+	Register("crc8", MakeCRC(CRC{Width: 8, Poly: 0x07}))
+	Register("crc16", MakeCRC(CRC{Width: 16, Poly: 0x8005, RefIn: true, RefOut: true}))
+	Register("crc16ccitt", MakeCRC(CRC{Width: 16, Poly: 0x1021, Init: 0xffff}))
+	Register("crc16xmodem", MakeCRC(CRC{Width: 16, Poly: 0x1021}))
+	Register("crc16kermit", MakeCRC(CRC{Width: 16, Poly: 0x1021, RefIn: true, RefOut: true}))
+	Register("crc16modbus", MakeCRC(CRC{Width: 16, Poly: 0x8005, Init: 0xffff, RefIn: true, RefOut: true}))
+	Register("crc32", func() hash.Hash { return crc32.NewIEEE() })
+	Register("crc32c", func() hash.Hash { return crc32.New(crc32c) })
+	Register("crc32k", func() hash.Hash { return crc32.New(crc32k) })
+	Register("crc32mpeg2", MakeCRC(CRC{Width: 32, Poly: 0x04c11db7, Init: 0xffffffff}))
+	Register("crc32bzip2", MakeCRC(CRC{Width: 32, Poly: 0x04c11db7, Init: 0xffffffff, XorOut: 0xffffffff}))
+	Register("crc64iso", func() hash.Hash { return crc64.New(crc64iso) })
+	Register("crc64ecma", func() hash.Hash { return crc64.New(crc64ecma) })
+	Register("adler32", func() hash.Hash { return adler32.New() })
+	Register("fnv32", func() hash.Hash { return fnv.New32() })
+	Register("fnv32a", func() hash.Hash { return fnv.New32a() })
+	Register("fnv64", func() hash.Hash { return fnv.New64() })
+	Register("fnv64a", func() hash.Hash { return fnv.New64a() })
+	Register("inet", NewInet)
+	Register("md5", md5.New)
+	Register("sha1", sha1.New)
+	Register("sha256", sha256.New)
+	Register("sha512", sha512.New)
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,52 @@
+package checksum
+
+import (
+	"testing"
+)
+
+// -----------------------------------------------------------------------------
+
+func TestCheckValues(t *testing.T) {
+
+	cases := []struct {
+		name string
+		v    interface{}
+	}{
+		{"crc8", uint8(0xf4)},
+		{"crc16", uint16(0xbb3d)},
+		{"crc16ccitt", uint16(0x29b1)},
+		{"crc16xmodem", uint16(0x31c3)},
+		{"crc16kermit", uint16(0x2189)},
+		{"crc16modbus", uint16(0x4b37)},
+		{"crc32", uint32(0xcbf43926)},
+		{"crc32c", uint32(0xe3069283)},
+		{"crc32mpeg2", uint32(0x0376e6e7)},
+		{"crc32bzip2", uint32(0xfc891918)},
+		{"crc64ecma", uint64(0x995dc9bbdf1939fa)},
+		{"adler32", uint32(0x091e01de)},
+	}
+	for _, c := range cases {
+		newHash, ok := Lookup(c.name)
+		if !ok {
+			t.Fatal("Lookup failed:", c.name)
+		}
+		h := newHash()
+		h.Write([]byte("1234"))
+		h.Write([]byte("56789"))
+		if v := Value(h); v != c.v {
+			t.Fatalf("%s: %#x, expected %#x", c.name, v, c.v)
+		}
+	}
+}
+
+func TestInet(t *testing.T) {
+
+	h := NewInet()
+	h.Write([]byte{0x00, 0x01, 0xf2})
+	h.Write([]byte{0x03, 0xf4, 0xf5, 0xf6, 0xf7})
+	if v := Value(h); v != uint16(0x220d) {
+		t.Fatalf("inet: %#x", v)
+	}
+}
+
+// -----------------------------------------------------------------------------
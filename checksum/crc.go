@@ -0,0 +1,206 @@
+package checksum
+
+import (
+	"hash"
+)
+
+// -----------------------------------------------------------------------------
+
+// A CRC is the parameters of a CRC algorithm, in the Rocksoft model (see "A
+// Painless Guide to CRC Error Detection Algorithms"). For example, CRC-32/MPEG-2 is
+// CRC{Width: 32, Poly: 0x04c11db7, Init: 0xffffffff}.
+//
+type CRC struct {
+	Width  uint   // width in bits, 1 ~ 64
+	Poly   uint64 // generator polynomial, without the top bit
+	Init   uint64 // initial value of the register
+	RefIn  bool   // input bytes are reflected (LSB first)
+	RefOut bool   // the result is reflected
+	XorOut uint64 // the value XORed to the result
+}
+
+func reflectBits(v uint64, width uint) (r uint64) {
+
+	for i := uint(0); i < width; i++ {
+		r = r<<1 | v&1
+		v >>= 1
+	}
+	return
+}
+
+type crcTable struct {
+	CRC
+	table [256]uint64
+}
+
+// MakeCRC returns a function creating hash.Hash of the CRC algorithm. Digests are
+// big endian, in (Width + 7) / 8 bytes.
+//
+func MakeCRC(params CRC) func() hash.Hash {
+
+	if params.Width == 0 || params.Width > 64 {
+		panic("checksum.MakeCRC: invalid width of CRC")
+	}
+
+	t := &crcTable{CRC: params}
+	if params.RefIn {
+		poly := reflectBits(params.Poly, params.Width)
+		for i := range t.table {
+			crc := uint64(i)
+			for j := 0; j < 8; j++ {
+				if crc&1 != 0 {
+					crc = crc>>1 ^ poly
+				} else {
+					crc >>= 1
+				}
+			}
+			t.table[i] = crc
+		}
+	} else {
+		poly := params.Poly << (64 - params.Width)
+		for i := range t.table {
+			crc := uint64(i) << 56
+			for j := 0; j < 8; j++ {
+				if crc&(1<<63) != 0 {
+					crc = crc<<1 ^ poly
+				} else {
+					crc <<= 1
+				}
+			}
+			t.table[i] = crc
+		}
+	}
+	return func() hash.Hash {
+		d := &crcDigest{t: t}
+		d.Reset()
+		return d
+	}
+}
+
+type crcDigest struct {
+	t   *crcTable
+	crc uint64 // RefIn: the reflected register; otherwise the register at the top bits
+}
+
+func (p *crcDigest) Reset() {
+
+	t := p.t
+	if t.RefIn {
+		p.crc = reflectBits(t.Init, t.Width)
+	} else {
+		p.crc = t.Init << (64 - t.Width)
+	}
+}
+
+func (p *crcDigest) Write(b []byte) (n int, err error) {
+
+	table := &p.t.table
+	crc := p.crc
+	if p.t.RefIn {
+		for _, c := range b {
+			crc = table[byte(crc)^c] ^ crc>>8
+		}
+	} else {
+		for _, c := range b {
+			crc = table[byte(crc>>56)^c] ^ crc<<8
+		}
+	}
+	p.crc = crc
+	return len(b), nil
+}
+
+func (p *crcDigest) Sum64() uint64 {
+
+	t := p.t
+	crc := p.crc
+	if !t.RefIn {
+		crc >>= 64 - t.Width
+	}
+	if t.RefIn != t.RefOut {
+		crc = reflectBits(crc, t.Width)
+	}
+	return crc ^ t.XorOut
+}
+
+func (p *crcDigest) Size() int {
+
+	return int(p.t.Width+7) >> 3
+}
+
+func (p *crcDigest) BlockSize() int {
+
+	return 1
+}
+
+func (p *crcDigest) Sum(in []byte) []byte {
+
+	return appendUint(in, p.Sum64(), p.Size())
+}
+
+func appendUint(b []byte, v uint64, size int) []byte {
+
+	for i := size - 1; i >= 0; i-- {
+		b = append(b, byte(v>>(uint(i)<<3)))
+	}
+	return b
+}
+
+// -----------------------------------------------------------------------------
+
+// inetDigest computes the Internet checksum (RFC 1071) used by IP, TCP and UDP.
+//
+type inetDigest struct {
+	sum uint64
+	odd bool // the last byte written is the high byte of a 16 bits word
+}
+
+// NewInet returns a hash.Hash computing the Internet checksum (RFC 1071).
+//
+func NewInet() hash.Hash {
+
+	return new(inetDigest)
+}
+
+func (p *inetDigest) Reset() {
+
+	p.sum, p.odd = 0, false
+}
+
+func (p *inetDigest) Write(b []byte) (n int, err error) {
+
+	for _, c := range b {
+		if p.odd {
+			p.sum += uint64(c)
+		} else {
+			p.sum += uint64(c) << 8
+		}
+		p.odd = !p.odd
+	}
+	return len(b), nil
+}
+
+func (p *inetDigest) Sum64() uint64 {
+
+	sum := p.sum
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^sum & 0xffff
+}
+
+func (p *inetDigest) Size() int {
+
+	return 2
+}
+
+func (p *inetDigest) BlockSize() int {
+
+	return 2
+}
+
+func (p *inetDigest) Sum(in []byte) []byte {
+
+	return appendUint(in, p.Sum64(), 2)
+}
+
+// -----------------------------------------------------------------------------
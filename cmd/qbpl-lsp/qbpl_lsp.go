@@ -0,0 +1,19 @@
+package main
+
+import (
+	"os"
+
+	"qiniu.com/bpl/lsp"
+	"qiniupkg.com/x/log.v7"
+)
+
+// qbpl-lsp is a language server of bpl. It talks with editors over stdin/stdout.
+//
+func main() {
+
+	log.SetOutput(os.Stderr)
+	err := lsp.NewServer().Serve(os.Stdin, os.Stdout)
+	if err != nil {
+		log.Fatalln("qbpl-lsp:", err)
+	}
+}
@@ -1,46 +1,113 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	bpl "qiniu.com/bpl/bpl.ext"
+	"qiniu.com/bpl/bpl.ext/protobuf"
+	"qiniu.com/bpl/hex"
+	"qiniu.com/bpl/repl"
 	"qiniupkg.com/x/log.v7"
+	"qlang.io/qlang.spec.v1"
 )
 
 var (
 	protocol = flag.String("p", "", "protocol file in BPL syntax. default is guessed by extension.")
 	output   = flag.String("o", "", "output log file, default is stderr.")
 	logmode  = flag.String("l", "", "log mode: short (default) or long.")
+	where    = flag.String("where", "", "only dump records matching the condition. eg. -where 'opCode == 2013 && len(body) > 1000'")
+	fields   = flag.String("select", "", "only dump the selected fields. eg. -select 'header.requestID,opCode'")
+	interact = flag.Bool("i", false, "explore <file> interactively.")
+	trace    = flag.Bool("trace", false, "print the rule stack and bytes consumed of each rule.")
+	proto    = flag.String("proto", "", "protobuf descriptor set files (protoc --include_imports -o <file>), separated by commas.")
+	dir      = flag.String("dir", "REQ", "direction of <file>: REQ or RESP. it is passed to bpl as BPL_DIRECTION.")
+	view     = flag.String("view", "", "how to dump records: dom (default), or hex (hexdump of <file> annotated with fields).")
+	html     = flag.String("html", "", "also write dumped records to a self-contained html report. eg. -html out.html")
 )
 
-// qbpl [-p <protocol>.bpl -o <output>.log -l <logmode>] <file>
+func interactive(file string, guessed bool) {
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Fatalln("Read file failed:", err)
+	}
+
+	var code []byte
+	if *protocol != "" {
+		if code, err = ioutil.ReadFile(*protocol); err != nil && !(guessed && os.IsNotExist(err)) {
+			log.Fatalln("Read protocol file failed:", err)
+		}
+	}
+
+	s, err := repl.NewSession(data, string(code), os.Stdout)
+	if err != nil {
+		log.Fatalln("repl.NewSession failed:", err)
+	}
+	err = repl.Run(s, os.Getenv("HOME")+"/.qbpl_history")
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// qbpl [-p <protocol>.bpl -o <output>.log -l <logmode> -where <cond> -select <fields> -trace -proto <descset> -dir <direction> -view <view> -html <report>.html] <file>
+// qbpl -i [-p <protocol>.bpl -proto <descset>] <file>
 //
 func main() {
 
 	flag.Parse()
 	bpl.SetDumpCode(os.Getenv("BPL_DUMPCODE"))
+	qlang.DumpStack = true
+	if err := bpl.SetDumpFilter(*where, *fields); err != nil {
+		log.Fatalln("Error: invalid -where/-select argument -", err)
+	}
+	if *proto != "" {
+		for _, file := range strings.Split(*proto, ",") {
+			if err := protobuf.Load(file); err != nil {
+				log.Fatalln("Error: load protobuf descriptor set failed -", err)
+			}
+		}
+	}
 
-	var in *bufio.Reader
+	var r io.Reader
 	args := flag.Args()
+	if *interact {
+		if len(args) == 0 {
+			fmt.Fprintln(os.Stderr, "Usage: qbpl -i [-p <protocol>.bpl -proto <descset>] <file>")
+			return
+		}
+		guessed := false
+		if *protocol == "" {
+			if ext := filepath.Ext(args[0]); ext != "" {
+				*protocol = os.Getenv("HOME") + "/.qbpl/formats/" + ext[1:] + ".bpl"
+				guessed = true
+			}
+		}
+		interactive(args[0], guessed)
+		return
+	}
 	if len(args) > 0 {
 		file := args[0]
 		f, err := os.Open(file)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "Open failed:", file)
+			log.Fatalln("Open failed:", err)
 		}
 		defer f.Close()
-		in = bufio.NewReader(f)
+		r = f
 	} else {
-		in = bufio.NewReader(os.Stdin)
+		r = os.Stdin
 	}
 
 	if *protocol == "" {
 		if len(args) == 0 {
-			fmt.Fprintln(os.Stderr, "Usage: qbpl [-p <protocol>.bpl -o <output>.log -l <logmode>] <file>")
+			fmt.Fprintln(os.Stderr, "Usage: qbpl [-p <protocol>.bpl -o <output>.log -l <logmode> -where <cond> -select <fields> -trace -proto <descset> -dir <direction> -view <view> -html <report>.html] <file>")
 			flag.PrintDefaults()
 			return
 		}
@@ -66,15 +133,139 @@ func main() {
 	}
 	log.Std = bpl.Dumper
 
+	var src io.ReaderAt // bytes of <file> shown by -view hex and -html
+	if *view == "hex" || *html != "" {
+		var ok bool
+		if src, ok = r.(io.ReaderAt); !ok || r == os.Stdin { // stdin may be a pipe
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				log.Fatalln("Read failed:", err)
+			}
+			rd := bytes.NewReader(data)
+			r, src = rd, rd
+		}
+	}
+
+	switch *view {
+	case "", "dom":
+	case "hex":
+		bpl.SetDumpHexView(src, *output == "" && isTerminal(os.Stdout))
+	default:
+		log.Fatalln("Error: unknown -view argument -", *view)
+	}
+
 	ruler, err := bpl.NewFromFile(*protocol)
 	if err != nil {
 		log.Fatalln("bpl.NewFromFile failed:", err)
 	}
 
 	ctx := bpl.NewContext()
+	ctx.Globals.SetVar("BPL_DIRECTION", *dir)
+	if bpl.DumpHexView != nil {
+		ctx.TrackOffsets()
+	}
+	if *trace {
+		ctx.SetTracer(bpl.NewTracer(os.Stderr))
+	}
+	var report *bpl.HTMLReport
+	if *html != "" {
+		title := "stdin"
+		if len(args) > 0 {
+			title = filepath.Base(args[0])
+		}
+		report = bpl.NewHTMLReport(title)
+		report.AddStream(ctx, "", *dir, src)
+	}
+	in := ctx.NewReader(r)
 	_, err = ruler.SafeMatch(in, ctx)
+	if report != nil {
+		report.EndStream(in, ctx)
+		if err := report.WriteFile(*html); err != nil {
+			log.Error("Write html report failed:", err)
+		}
+	}
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Match failed:", err)
-		return
+		fmt.Fprintln(os.Stderr, "Match failed:", dumpFailure(err, r))
+		os.Exit(exitCode(err))
+	}
+	if st := ctx.Stats(); st.Ended {
+		fmt.Fprintln(os.Stderr, "stream ended cleanly after", st.Records, "records")
+	}
+}
+
+func isTerminal(f *os.File) bool {
+
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// dumpFailure prints the matching result before the failure, and hexdump of the input
+// around the failing offset if the input is a file and the offset is of it (rather than
+// of a nested stream, eg. bytes of `eval`). It returns the error message.
+//
+func dumpFailure(err error, r io.Reader) string {
+
+	var e *bpl.PartialError
+	if !errors.As(err, &e) {
+		return err.Error()
+	}
+
+	var b bytes.Buffer
+	if e.PartialResult != nil {
+		b.WriteString("Partial result: ")
+		bpl.DumpDom(&b, e.PartialResult, 0)
+		b.WriteByte('\n')
+	}
+	if e.Record > 0 && e.RecordResult != nil {
+		fmt.Fprintf(&b, "Partial result of record %d: ", e.Record)
+		bpl.DumpDom(&b, e.RecordResult, 0)
+		b.WriteByte('\n')
+	}
+	if e.Nested {
+		fmt.Fprintf(&b, "Input isn't dumped: offset %d in nested stream\n", e.Offset)
+	} else if ra, ok := r.(io.ReaderAt); ok && e.Path != "" && e.Offset >= 0 {
+		from := e.Offset&^15 - 64
+		if from < 0 {
+			from = 0
+		}
+		buf := make([]byte, e.Offset&^15+80-from)
+		n, _ := ra.ReadAt(buf, from)
+		if n > 0 {
+			fmt.Fprintf(&b, "Input around offset %d:\n", e.Offset)
+			hex.DumpAt(&b, buf[:n], from, e.Offset, e.Path)
+		}
+	}
+	os.Stderr.Write(b.Bytes())
+	return e.Brief()
+}
+
+// Exit codes of matching failures.
+//
+const (
+	exitFailed    = 1 // other failures
+	exitTruncated = 2 // the input is truncated
+	exitAssertion = 3 // an assertion fails, that is, the input is malformed
+	exitSpec      = 4 // the bpl spec has a bug
+	exitLimit     = 5 // a resource limit is exceeded
+)
+
+func exitCode(err error) int {
+
+	var (
+		truncated *bpl.ErrTruncated
+		assertion *bpl.AssertionError
+		spec      *bpl.SpecError
+		limit     *bpl.LimitError
+	)
+	switch {
+	case errors.As(err, &truncated):
+		return exitTruncated
+	case errors.As(err, &assertion):
+		return exitAssertion
+	case errors.As(err, &spec):
+		return exitSpec
+	case errors.As(err, &limit):
+		return exitLimit
 	}
+	return exitFailed
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"qiniu.com/bpl/format"
+)
+
+var (
+	diff  = flag.Bool("d", false, "display diffs instead of rewriting files.")
+	write = flag.Bool("w", false, "write result to (source) file instead of stdout.")
+)
+
+var exitCode = 0
+
+func report(err error) {
+
+	fmt.Fprintln(os.Stderr, err)
+	exitCode = 2
+}
+
+func diffOf(b1, b2 []byte, name string) (data []byte, err error) {
+
+	f1, err := ioutil.TempFile("", "qbplfmt")
+	if err != nil {
+		return
+	}
+	defer os.Remove(f1.Name())
+	defer f1.Close()
+
+	f2, err := ioutil.TempFile("", "qbplfmt")
+	if err != nil {
+		return
+	}
+	defer os.Remove(f2.Name())
+	defer f2.Close()
+
+	f1.Write(b1)
+	f2.Write(b2)
+	data, err = exec.Command("diff", "-u", "--label", name+".orig", "--label", name, f1.Name(), f2.Name()).CombinedOutput()
+	if len(data) > 0 {
+		err = nil // diff exits with a non-zero status when the files don't match
+	}
+	return
+}
+
+func processFile(name string, src []byte, stdin bool) error {
+
+	if !stdin {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		src = b
+	}
+
+	res, err := format.Source(src)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+
+	switch {
+	case *diff:
+		if !bytes.Equal(src, res) {
+			data, err := diffOf(src, res, name)
+			if err != nil {
+				return fmt.Errorf("computing diff: %v", err)
+			}
+			os.Stdout.Write(data)
+		}
+	case *write && !stdin:
+		if !bytes.Equal(src, res) {
+			fi, err := os.Stat(name)
+			if err != nil {
+				return err
+			}
+			return ioutil.WriteFile(name, res, fi.Mode().Perm())
+		}
+	default:
+		os.Stdout.Write(res)
+	}
+	return nil
+}
+
+func walkDir(dir string) {
+
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			report(err)
+		} else if fi.Mode().IsRegular() && strings.HasSuffix(path, ".bpl") {
+			if err = processFile(path, nil, false); err != nil {
+				report(err)
+			}
+		}
+		return nil
+	})
+}
+
+// qbplfmt [-d -w] [<path> ...]
+//
+func main() {
+
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		if *write {
+			fmt.Fprintln(os.Stderr, "Error: cannot use -w with standard input")
+			os.Exit(2)
+		}
+		src, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			report(err)
+		} else if err = processFile("<standard input>", src, true); err != nil {
+			report(err)
+		}
+		os.Exit(exitCode)
+	}
+
+	for _, path := range args {
+		fi, err := os.Stat(path)
+		switch {
+		case err != nil:
+			report(err)
+		case fi.IsDir():
+			walkDir(path)
+		default:
+			if err = processFile(path, nil, false); err != nil {
+				report(err)
+			}
+		}
+	}
+	os.Exit(exitCode)
+}
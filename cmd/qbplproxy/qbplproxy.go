@@ -1,7 +1,8 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -9,11 +10,16 @@ import (
 	"net"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"reflect"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	bpl "qiniu.com/bpl/bpl.ext"
+	"qiniu.com/bpl/bpl.ext/protobuf"
 	"qlang.io/qlang.spec.v1"
 
 	"qiniupkg.com/x/log.v7"
@@ -28,6 +34,11 @@ type Env struct {
 	Dest      *net.TCPConn
 	Direction string
 	Conn      string
+	Session   interface{} // shared by both directions of the connection
+
+	// Context is canceled when the response direction ends, that is, the connection is
+	// closed by the backend, or by the client (and then by the backend).
+	Context context.Context
 }
 
 // A ReverseProxier is a reverse proxier server.
@@ -38,6 +49,10 @@ type ReverseProxier struct {
 	OnResponse func(io.Reader, *Env) (err error)
 	OnRequest  func(io.Reader, *Env) (err error)
 	Listened   chan bool
+
+	// Context stops serving when it's done, and cancels Env.Context of all connections.
+	// Default is never.
+	Context context.Context
 }
 
 // ListenAndServe listens on `Addr` and serves to proxy requests to `Backend`.
@@ -87,9 +102,22 @@ func (p *ReverseProxier) Serve(l net.Listener) (err error) {
 		onRequest = onNil
 	}
 
+	ctx := p.Context
+	if ctx == nil {
+		ctx = context.Background()
+	} else {
+		go func() {
+			<-ctx.Done()
+			l.Close()
+		}()
+	}
+
 	for {
 		c1, err1 := l.Accept()
 		if err1 != nil {
+			if ctx.Err() != nil { // stopped
+				return nil
+			}
 			return err1
 		}
 		c := c1.(*net.TCPConn)
@@ -102,15 +130,18 @@ func (p *ReverseProxier) Serve(l net.Listener) (err error) {
 			}
 
 			conn := c.RemoteAddr().String()
+			session := bpl.NewSession(0) // never wait, as forwarding waits for matching
+			cctx, cancel := context.WithCancel(ctx)
 			go func() {
 				r2 := io.TeeReader(c2, c)
-				onResponse(r2, &Env{Src: c2, Dest: c, Direction: "RESP", Conn: conn})
+				onResponse(r2, &Env{Src: c2, Dest: c, Direction: "RESP", Conn: conn, Session: session, Context: cctx})
 				c.CloseWrite()
 				c2.CloseRead()
+				cancel()
 			}()
 
 			r := io.TeeReader(c, c2)
-			err2 = onRequest(r, &Env{Src: c, Dest: c2, Direction: "REQ", Conn: conn})
+			err2 = onRequest(r, &Env{Src: c, Dest: c2, Direction: "REQ", Conn: conn, Session: session, Context: cctx})
 			if err2 != nil {
 				log.Info("qbplproxy (request):", err2, "type:", reflect.TypeOf(err2))
 			}
@@ -129,12 +160,21 @@ var (
 	protocol = flag.String("p", "", "protocol file in BPL syntax, default is guessed by <port>.")
 	output   = flag.String("o", "", "output log file, default is stderr.")
 	logmode  = flag.String("l", "", "log mode: short (default) or long.")
+	where    = flag.String("where", "", "only dump records matching the condition. eg. -where 'opCode == 2013 && len(body) > 1000'")
+	fields   = flag.String("select", "", "only dump the selected fields. eg. -select 'header.requestID,opCode'")
+	proto    = flag.String("proto", "", "protobuf descriptor set files (protoc --include_imports -o <file>), separated by commas.")
+	timeout  = flag.Duration("timeout", 0, "maximum time of matching a record, eg. -timeout 10s. default is no limit.")
+	maxbytes = flag.Int64("maxbytes", 0, "maximum bytes of a direction of a connection to match. default is no limit.")
+	maxnodes = flag.Int("maxnodes", 0, "maximum nodes (members and array elements) of a record. default is no limit.")
+	html     = flag.String("html", "", "also write dumped records to a self-contained html report, rewritten every 2 seconds. eg. -html out.html")
 )
 
 var (
 	baseDir string // $HOME/.qbpl/formats/
 )
 
+const reportInterval = 2 * time.Second // interval of writing the html report
+
 func fileExists(file string) bool {
 
 	_, err := os.Stat(file)
@@ -153,7 +193,117 @@ func guessProtocol(host string) string {
 	return ""
 }
 
-// qbplproxy -h <listenIp:port> -b <backendIp:port> [-p <protocol>.bpl -f <filter> -o <output>.log -l <logmode>]
+// A history keeps bytes read from a stream, so a HTMLReport can read bytes of records
+// dumped. Bytes after the end of the last record dumped are kept in memory until
+// matching stops.
+//
+type history struct {
+	mutex   sync.Mutex
+	data    []byte
+	base    int64 // offset of data[0] in the stream
+	stopped bool
+}
+
+func (p *history) Write(b []byte) (n int, err error) {
+
+	p.mutex.Lock()
+	if !p.stopped {
+		p.data = append(p.data, b...)
+	}
+	p.mutex.Unlock()
+	return len(b), nil
+}
+
+// Release frees bytes before offset `off`, which are never read again.
+//
+func (p *history) Release(off int64) {
+
+	p.mutex.Lock()
+	if n := off - p.base; n > 0 && n <= int64(len(p.data)) {
+		p.data = append([]byte(nil), p.data[n:]...)
+		p.base = off
+	}
+	p.mutex.Unlock()
+}
+
+// stop stops keeping bytes and frees bytes kept.
+//
+func (p *history) stop() {
+
+	p.mutex.Lock()
+	p.data, p.stopped = nil, true
+	p.mutex.Unlock()
+}
+
+func (p *history) ReadAt(b []byte, off int64) (n int, err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	off -= p.base
+	if off < 0 || off >= int64(len(p.data)) {
+		return 0, io.EOF
+	}
+	n = copy(b, p.data[off:])
+	if n < len(b) {
+		err = io.EOF
+	}
+	return
+}
+
+// logMatchError logs a matching failure of a connection. Matching stops, but proxying
+// goes on.
+//
+func logMatchError(err error) {
+
+	var (
+		truncated *bpl.ErrTruncated
+		assertion *bpl.AssertionError
+		spec      *bpl.SpecError
+	)
+	switch {
+	case errors.As(err, &truncated): // eg. the connection is closed inside a message
+		log.Info("Match truncated:", err)
+	case errors.As(err, &assertion):
+		log.Warn("Match failed:", err)
+	case errors.As(err, &spec):
+		log.Error("Match failed (bpl spec error):", err)
+	case errors.Is(err, context.Canceled): // the connection is closed
+		log.Info("Match canceled:", err)
+	case bpl.IsLimitError(err):
+		log.Warn("Match aborted:", err)
+	default:
+		log.Error("Match failed:", err)
+	}
+}
+
+// writeReport writes `report` to file `name` periodically if it's changed, and once
+// more when ctx is done, that is, qbplproxy is interrupted. It closes `done` after the
+// last writing.
+//
+func writeReport(ctx context.Context, report *bpl.HTMLReport, name string, done chan<- bool) {
+
+	defer close(done)
+	tick := time.NewTicker(reportInterval)
+	defer tick.Stop()
+	for {
+		var stop bool
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			stop = true
+		}
+		if report.Changed() {
+			if err := report.WriteFile(name); err != nil {
+				log.Error("Write html report failed:", err)
+			}
+		}
+		if stop {
+			return
+		}
+	}
+}
+
+// qbplproxy -h <listenIp:port> -b <backendIp:port> [-p <protocol>.bpl -f <filter> -where <cond> -select <fields> -o <output>.log -l <logmode> -proto <descset> -timeout <duration> -maxbytes <n> -maxnodes <n> -html <report>.html]
 //
 func main() {
 
@@ -161,12 +311,22 @@ func main() {
 	if *host == "" || *backend == "" {
 		fmt.Fprintln(
 			os.Stderr,
-			"Usage: qbplproxy -h <listenIp:port> -b <backendIp:port> [-p <protocol>.bpl -f <filter> -o <output>.log -l <logmode>]")
+			"Usage: qbplproxy -h <listenIp:port> -b <backendIp:port> [-p <protocol>.bpl -f <filter> -where <cond> -select <fields> -o <output>.log -l <logmode> -proto <descset> -timeout <duration> -maxbytes <n> -maxnodes <n> -html <report>.html]")
 		flag.PrintDefaults()
 		return
 	}
 	bpl.SetDumpCode(os.Getenv("BPL_DUMPCODE"))
 	qlang.DumpStack = true
+	if err := bpl.SetDumpFilter(*where, *fields); err != nil {
+		log.Fatalln("Error: invalid -where/-select argument -", err)
+	}
+	if *proto != "" {
+		for _, file := range strings.Split(*proto, ",") {
+			if err := protobuf.Load(file); err != nil {
+				log.Fatalln("Error: load protobuf descriptor set failed -", err)
+			}
+		}
+	}
 
 	baseDir = os.Getenv("HOME") + "/.qbpl/formats/"
 	if *protocol == "" {
@@ -194,6 +354,9 @@ func main() {
 		}
 	}
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	logflags := bpl.Ldefault
 	flong := (*logmode == "long")
 	if flong {
@@ -201,6 +364,7 @@ func main() {
 	}
 
 	onBpl := onNil
+	var reported chan bool // closed when the html report is written for the last time
 	if *protocol != "nil" {
 		if *output != "" {
 			f, err := os.Create(*output)
@@ -214,19 +378,40 @@ func main() {
 		if err != nil {
 			log.Fatalln("bpl.NewFromFile failed:", err)
 		}
+		limits := bpl.Limits{MaxBytes: *maxbytes, MaxNodes: *maxnodes, MaxRecordTime: *timeout}
+		var report *bpl.HTMLReport
+		if *html != "" {
+			report = bpl.NewHTMLReport("qbplproxy " + *host + " -> " + *backend)
+			reported = make(chan bool)
+			go writeReport(ctx, report, *html, reported)
+		}
 		onBpl = func(r io.Reader, env *Env) (err error) {
-			in := bufio.NewReader(r)
 			ctx := bpl.NewContext()
+			ctx.SetLimits(limits)
+			var hist *history
+			if report != nil {
+				hist = new(history)
+				report.AddStream(ctx, env.Conn, env.Direction, hist)
+				r = io.TeeReader(r, hist)
+			}
+			in := ctx.NewReader(r)
 			ctx.Globals.SetVar("BPL_FILTER", filterCond)
 			ctx.Globals.SetVar("BPL_DIRECTION", env.Direction)
+			ctx.Globals.SetVar("BPL_SESSION", env.Session)
 			if flong {
 				ctx.Globals.SetVar("BPL_DUMP_PREFIX", "[CONN:"+env.Conn+"]["+env.Direction+"]")
 			} else {
 				ctx.Globals.SetVar("BPL_DUMP_PREFIX", "["+env.Direction+"]")
 			}
-			_, err = ruler.SafeMatch(in, ctx)
+			_, err = ruler.SafeMatchContext(env.Context, in, ctx)
 			if err != nil {
-				log.Error("Match failed:", err)
+				logMatchError(err)
+			} else if st := ctx.Stats(); st.Ended {
+				log.Info("[CONN:"+env.Conn+"]["+env.Direction+"]", "stream ended cleanly after", st.Records, "records")
+			}
+			if report != nil {
+				report.EndStream(in, ctx)
+				hist.stop()
 			}
 			in.WriteTo(ioutil.Discard)
 			return
@@ -239,8 +424,12 @@ func main() {
 		Backend:    *backend,
 		OnRequest:  onBpl,
 		OnResponse: onBpl,
+		Context:    ctx,
 	}
 	rp.ListenAndServe()
+	if reported != nil {
+		<-reported
+	}
 }
 
 // -----------------------------------------------------------------------------
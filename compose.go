@@ -2,6 +2,7 @@ package bpl
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"io"
 	"io/ioutil"
@@ -145,8 +146,12 @@ func (p *seq) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
 
 	ret := ctx.requireVarSlice()
 	for _, r := range p.rs {
-		v, err = r.Match(in, ctx.NewSub())
+		sub := ctx.NewSub()
+		v, err = r.Match(in, sub)
 		if err != nil {
+			if v = partialOf(v, sub); v != nil {
+				ctx.dom = append(ret, v)
+			}
 			return
 		}
 		ret = append(ret, v)
@@ -241,6 +246,18 @@ func Dyntype(r func(ctx *Context) (Ruler, error)) Ruler {
 
 // -----------------------------------------------------------------------------
 
+// newReaderBuffer is the same as bufiox.NewReaderBuffer, except that it also
+// supports an empty buffer (eg. `read 0 do R`), which isn't a bufiox buffer, so its
+// offsets are told only if it's a window (see Context.window).
+//
+func newReaderBuffer(b []byte) *bufio.Reader {
+
+	if len(b) == 0 {
+		return bufio.NewReaderSize(bytes.NewReader(nil), 16)
+	}
+	return bufiox.NewReaderBuffer(b)
+}
+
 type read struct {
 	n func(ctx *Context) int
 	r Ruler
@@ -249,13 +266,18 @@ type read struct {
 func (p *read) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
 
 	n := p.n(ctx)
-	b := make([]byte, n)
-	_, err = io.ReadFull(in, b)
-	if err != nil {
-		return
+	base := ctx.Tell(in)
+	b := ctx.sliceBytes(in, n)
+	if b == nil {
+		b = make([]byte, n)
+		nr, err := io.ReadFull(in, b)
+		if err != nil {
+			return nil, truncated(err, n, nr)
+		}
 	}
-	in = bufiox.NewReaderBuffer(b)
-	return MatchStream(p.r, in, ctx)
+	sub := newReaderBuffer(b)
+	defer ctx.window(sub, in, base)()
+	return MatchStream(p.r, sub, ctx)
 }
 
 func (p *read) RetType() reflect.Type {
@@ -350,12 +372,14 @@ func (p *eval) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error)
 	val := p.expr(ctx)
 	switch v := val.(type) {
 	case []byte:
-		in = bufiox.NewReaderBuffer(v)
+		in = newReaderBuffer(v)
+		defer ctx.buffer(in, 0)()
+		defer ctx.track(in, nil, ctx.bytesOffset(v))()
 	case io.Reader:
 		in = bufio.NewReader(v)
 		fclose = true
 	default:
-		panic("eval <expr> must return []byte or io.Reader")
+		panic(specError("eval <expr> must return []byte or io.Reader"))
 	}
 	v, err = MatchStream(p.r, in, ctx)
 	if fclose {
@@ -385,9 +409,82 @@ func Eval(expr func(ctx *Context) interface{}, r Ruler) Ruler {
 
 // -----------------------------------------------------------------------------
 
+type limitedReader struct {
+	r   io.Reader
+	n   int64
+	in  *bufio.Reader // the encoded stream
+	ctx *Context
+}
+
+func (p *limitedReader) Read(b []byte) (n int, err error) {
+
+	if int64(len(b))-1 > p.n {
+		b = b[:p.n+1]
+	}
+	n, err = p.r.Read(b)
+	if int64(n) > p.n {
+		n, p.n = int(p.n), 0
+		return n, p.ctx.limitError(p.in, ErrMaxDecodedBytes)
+	}
+	p.n -= int64(n)
+	return
+}
+
+type decode struct {
+	dec func(in *bufio.Reader, limit int64) (io.Reader, error)
+	r   Ruler
+}
+
+func (p *decode) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	limit := ctx.maxDecodedBytes()
+	dr, err := p.dec(in, limit)
+	if err != nil {
+		if err == ErrMaxDecodedBytes {
+			err = ctx.limitError(in, err)
+		}
+		return
+	}
+	if c, ok := dr.(io.Closer); ok {
+		defer c.Close()
+	}
+	din := ctx.NewReader(&limitedReader{r: dr, n: limit, in: in, ctx: ctx})
+	defer delete(ctx.st.readers, din)
+	v, err = MatchStream(p.r, din, ctx)
+	if err != nil {
+		return
+	}
+	_, err = din.WriteTo(ioutil.Discard) // consume the rest of encoded data
+	return
+}
+
+func (p *decode) RetType() reflect.Type {
+
+	return p.r.RetType()
+}
+
+func (p *decode) SizeOf() int {
+
+	return -1
+}
+
+// Decode returns a matching unit that decodes the current stream by dec(in, limit), and
+// matches R over the decoded bytes. The decoder should not read beyond the end of
+// encoded data. Decoded bytes that R doesn't consume are discarded. If more than
+// `limit` bytes are decoded (see Limits.MaxDecodedBytes), matching fails with a
+// LimitError. The decoder can also return ErrMaxDecodedBytes to fail early.
+//
+func Decode(dec func(in *bufio.Reader, limit int64) (io.Reader, error), r Ruler) Ruler {
+
+	return &decode{r: r, dec: dec}
+}
+
+// -----------------------------------------------------------------------------
+
 type assert struct {
-	expr func(ctx *Context) bool
-	msg  string
+	expr  func(ctx *Context) bool
+	msg   string
+	names []string
 }
 
 func (p *assert) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
@@ -395,7 +492,16 @@ func (p *assert) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error
 	if p.expr(ctx) {
 		return
 	}
-	panic(p.msg)
+	vals := make(map[string]interface{}, len(p.names))
+	vars, _ := ctx.dom.(map[string]interface{})
+	for _, name := range p.names {
+		if v, ok := vars[name]; ok {
+			vals[name] = v
+		} else if v, ok := ctx.Globals.Var(name); ok {
+			vals[name] = v
+		}
+	}
+	return nil, &AssertionError{Expr: p.msg, Values: vals}
 }
 
 func (p *assert) RetType() reflect.Type {
@@ -408,16 +514,18 @@ func (p *assert) SizeOf() int {
 	return -1
 }
 
-// Assert returns a matching unit that assert expr(ctx).
+// Assert returns a matching unit that assert expr(ctx). If it fails, an AssertionError
+// reports `msg` and values of variables `names`.
 //
-func Assert(expr func(ctx *Context) bool, msg string) Ruler {
+func Assert(expr func(ctx *Context) bool, msg string, names ...string) Ruler {
 
-	return &assert{msg: msg, expr: expr}
+	return &assert{msg: msg, expr: expr, names: names}
 }
 
 // -----------------------------------------------------------------------------
 
-// A TypeVar is typeinfo of a `Struct` member.
+// A TypeVar is typeinfo of a `Struct` member. Elem is assigned once before matching
+// (eg. when bpl source code is compiled), and it's read-only when matching.
 //
 type TypeVar struct {
 	Name string
@@ -441,7 +549,7 @@ func (p *TypeVar) Match(in *bufio.Reader, ctx *Context) (v interface{}, err erro
 
 	r := p.Elem
 	if r == nil {
-		return 0, ErrVarNotAssigned
+		return 0, &SpecError{Err: ErrVarNotAssigned}
 	}
 	return r.Match(in, ctx)
 }
@@ -7,7 +7,6 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
-	"runtime/debug"
 
 	"qiniupkg.com/x/bufiox.v7"
 	"qlang.io/exec.v2"
@@ -63,22 +62,28 @@ type Context struct {
 	Stack   *exec.Stack
 	Parent  *Context
 	Globals Globals
+	st      *matchState
+	node    *Node  // nil: offsets aren't tracked, or nothing is matched
+	member  string // name of the struct member being matched
+	visited bool   // events of the matching result are sent to the Visitor
 }
 
-// NewContext returns a new matching Context.
+// NewContext returns a new matching Context. Its global variable `BPL_SESSION` is
+// a new Session, which can be replaced by a Session shared with other contexts.
 //
 func NewContext() *Context {
 
 	gbl := NewGlobals()
+	gbl.SetVar("BPL_SESSION", NewSession(0))
 	stk := exec.NewStack()
-	return &Context{Globals: gbl, Stack: stk}
+	return &Context{Globals: gbl, Stack: stk, st: newMatchState()}
 }
 
 // NewSub returns a new sub Context.
 //
 func (p *Context) NewSub() *Context {
 
-	return &Context{Parent: p, Globals: p.Globals, Stack: p.Stack}
+	return &Context{Parent: p, Globals: p.Globals, Stack: p.Stack, st: p.st}
 }
 
 func (p *Context) requireVarSlice() []interface{} {
@@ -89,7 +94,7 @@ func (p *Context) requireVarSlice() []interface{} {
 	} else if domv, ok := p.dom.([]interface{}); ok {
 		vars = domv
 	} else {
-		panic("dom type isn't []interface{}")
+		panic(specError("dom type isn't []interface{}"))
 	}
 	return vars
 }
@@ -99,7 +104,7 @@ func (p *Context) requireVarSlice() []interface{} {
 func (p *Context) SetVar(name string, v interface{}) {
 
 	if _, ok := p.Globals.Var(name); ok {
-		panic(fmt.Errorf("variable `%s` exists globally", name))
+		panic(&SpecError{Err: fmt.Errorf("variable `%s` exists globally", name)})
 	}
 
 	var vars map[string]interface{}
@@ -108,11 +113,11 @@ func (p *Context) SetVar(name string, v interface{}) {
 		p.dom = vars
 	} else if domv, ok := p.dom.(map[string]interface{}); ok {
 		if _, ok = domv[name]; ok {
-			panic(fmt.Errorf("variable `%s` exists in dom", name))
+			panic(&SpecError{Err: fmt.Errorf("variable `%s` exists in dom", name)})
 		}
 		vars = domv
 	} else {
-		panic("dom type isn't map[string]interface{}")
+		panic(specError("dom type isn't map[string]interface{}"))
 	}
 	vars[name] = v
 }
@@ -133,9 +138,12 @@ func (p *Context) LetVar(name string, v interface{}) {
 	} else if domv, ok := p.dom.(map[string]interface{}); ok {
 		vars = domv
 	} else {
-		panic("dom type isn't map[string]interface{}")
+		panic(specError("dom type isn't map[string]interface{}"))
 	}
 	vars[name] = v
+	if vis := p.visitor(); vis != nil {
+		vis.Field(name, v, -1)
+	}
 }
 
 // Var gets a variable from matching context.
@@ -146,7 +154,7 @@ func (p *Context) Var(name string) (v interface{}, ok bool) {
 	if ok {
 		v, ok = vars[name]
 	} else {
-		panic("dom type isn't map[string]interface{}")
+		panic(specError("dom type isn't map[string]interface{}"))
 	}
 	return
 }
@@ -158,7 +166,7 @@ func (p *Context) SetDom(v interface{}) {
 	if p.dom == nil {
 		p.dom = v
 	} else {
-		panic("dom was assigned already")
+		panic(specError("dom was assigned already"))
 	}
 }
 
@@ -171,7 +179,9 @@ func (p *Context) Dom() interface{} {
 
 // -----------------------------------------------------------------------------
 
-// A Ruler interface is required to a matching unit.
+// A Ruler interface is required to a matching unit. A Ruler should be immutable when
+// matching, and keep all state of matching in Context, so that it's safe to match by
+// multiple goroutines concurrently, each with its own Context.
 //
 type Ruler interface {
 	// Match matches input stream `in`, and returns matching result.
@@ -188,6 +198,7 @@ type Ruler interface {
 //
 func MatchStream(r Ruler, in *bufio.Reader, ctx *Context) (v interface{}, err error) {
 
+	ctx.top(in)
 	glbs := ctx.Globals
 	old, ok := glbs.GetAndSetVar("BPL_IN", in)
 	v, err = r.Match(in, ctx)
@@ -201,6 +212,7 @@ func MatchStream(r Ruler, in *bufio.Reader, ctx *Context) (v interface{}, err er
 
 type fileLine struct {
 	r    Ruler
+	name string
 	file string
 	line int
 }
@@ -225,15 +237,36 @@ func (p *errorAt) Error() string {
 
 func (p *fileLine) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
 
+	if p.name != "" {
+		ctx.enter(p.name, in)
+		defer func() {
+			ctx.exit(in, v, err)
+		}()
+	}
+
+	if err = ctx.check(in); err != nil {
+		return
+	}
+	start := ctx.Tell(in)
 	v, err = doMatch(p.r, in, ctx)
 	if err != nil {
-		if _, ok := err.(*exec.Error); !ok {
-			err = &exec.Error{
-				Err:   &errorAt{Err: err, Buf: bufiox.Buffer(in)},
-				File:  p.file,
-				Line:  p.line,
-				Stack: debug.Stack(),
+		if te := p.typedError(err, in, ctx, start); te != nil {
+			return v, te
+		}
+		e, ok := err.(*exec.Error)
+		if !ok {
+			e = &exec.Error{
+				Err:  &errorAt{Err: err, Buf: bufiox.Buffer(in)},
+				File: p.file,
+				Line: p.line,
 			}
+			err = e
+		}
+		if ctx.st.errAt != err { // replace Go stack with bpl rule stack
+			pos := ctx.position(in)
+			pos.File, pos.Line = e.File, e.Line
+			e.Stack = []byte(fmt.Sprintf("bpl stack: %s (offset %d)", pos.Path, pos.Offset))
+			ctx.st.errAt, ctx.st.errPos = err, pos
 		}
 	}
 	return
@@ -274,7 +307,24 @@ func FileLine(file string, line int, R Ruler) Ruler {
 	if _, ok := R.(*fileLine); ok {
 		return R
 	}
-	return &fileLine{r: R, file: file, line: line}
+	var name string
+	if m, ok := R.(*Member); ok {
+		name = m.Name
+	}
+	return &fileLine{r: R, name: name, file: file, line: line}
+}
+
+// Named returns a matching rule named `name`. Named rules are traced (see Tracer)
+// and reported in the rule stack when error occurs.
+//
+func Named(name string, R Ruler) Ruler {
+
+	if f, ok := R.(*fileLine); ok {
+		named := *f
+		named.name = name
+		return &named
+	}
+	return &fileLine{r: R, name: name}
 }
 
 // -----------------------------------------------------------------------------
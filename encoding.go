@@ -0,0 +1,580 @@
+package bpl
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"unicode/utf16"
+)
+
+var (
+	// ErrVarintOverflow is returned when a variable-length integer overflows.
+	ErrVarintOverflow = errors.New("varint overflows a 64-bit integer")
+
+	// ErrInvalidLength is returned when a length field is invalid.
+	ErrInvalidLength = errors.New("invalid length field")
+
+	// ErrNotCRLF is returned when `crlf` doesn't match "\r\n".
+	ErrNotCRLF = errors.New("expected CRLF")
+
+	// ErrLineTooLong is returned when a line is longer than MaxLineSize.
+	ErrLineTooLong = errors.New("line is too long")
+
+	// MaxLineSize is the maximum size of a line matched by `line`.
+	MaxLineSize = 1 << 20
+)
+
+// readMore reads a byte that isn't the first one of a value, so io.EOF means the
+// value is truncated.
+//
+func readMore(in *bufio.Reader) (c byte, err error) {
+
+	c, err = in.ReadByte()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+func readFull(in *bufio.Reader, b []byte) (err error) {
+
+	_, err = io.ReadFull(in, b)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// readChunks reads `n` bytes, where n is read from the input, eg. a length prefix.
+// The bytes are read in chunks, so garbage input can't allocate a huge buffer before
+// it ends.
+//
+func readChunks(in *bufio.Reader, n uint64) (b []byte, err error) {
+
+	const chunk = 64 * 1024
+	for uint64(len(b)) < n {
+		m := n - uint64(len(b))
+		if m > chunk {
+			m = chunk
+		}
+		start := len(b)
+		b = append(b, make([]byte, m)...)
+		if err = readFull(in, b[start:]); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+func readUleb128(in *bufio.Reader) (v uint64, err error) {
+
+	c, err := in.ReadByte()
+	for shift := uint(0); err == nil; shift += 7 {
+		if shift == 63 && c > 1 {
+			return 0, ErrVarintOverflow
+		}
+		v |= uint64(c&0x7f) << shift
+		if c < 0x80 {
+			return
+		}
+		c, err = readMore(in)
+	}
+	return
+}
+
+// -----------------------------------------------------------------------------
+
+type uleb128 int
+
+func (p uleb128) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	return readUleb128(in)
+}
+
+func (p uleb128) RetType() reflect.Type {
+
+	return tyUint64
+}
+
+func (p uleb128) SizeOf() int {
+
+	return -1
+}
+
+// Uleb128 is a matching unit that matches an unsigned LEB128 integer (also known
+// as the varint of protobuf).
+//
+var Uleb128 Ruler = uleb128(0)
+
+// -----------------------------------------------------------------------------
+
+type sleb128 int
+
+func (p sleb128) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	var val int64
+	var shift uint
+	c, err := in.ReadByte()
+	for ; err == nil; c, err = readMore(in) {
+		if shift == 63 && c != 0 && c != 0x7f {
+			return nil, ErrVarintOverflow
+		}
+		val |= int64(c&0x7f) << shift
+		shift += 7
+		if c < 0x80 {
+			if shift < 64 && c&0x40 != 0 { // sign extend
+				val |= -1 << shift
+			}
+			return val, nil
+		}
+	}
+	return
+}
+
+func (p sleb128) RetType() reflect.Type {
+
+	return tyInt64
+}
+
+func (p sleb128) SizeOf() int {
+
+	return -1
+}
+
+// Sleb128 is a matching unit that matches a signed LEB128 integer.
+//
+var Sleb128 Ruler = sleb128(0)
+
+// -----------------------------------------------------------------------------
+
+type zigzag int
+
+func (p zigzag) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	u, err := readUleb128(in)
+	if err != nil {
+		return
+	}
+	return int64(u>>1) ^ -int64(u&1), nil
+}
+
+func (p zigzag) RetType() reflect.Type {
+
+	return tyInt64
+}
+
+func (p zigzag) SizeOf() int {
+
+	return -1
+}
+
+// Zigzag is a matching unit that matches a zigzag encoded LEB128 integer (the
+// sint32/sint64 of protobuf).
+//
+var Zigzag Ruler = zigzag(0)
+
+// -----------------------------------------------------------------------------
+
+type quicVarint int
+
+func (p quicVarint) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	c, err := in.ReadByte()
+	if err != nil {
+		return
+	}
+	val := uint64(c & 0x3f)
+	for n := 1<<(c>>6) - 1; n > 0; n-- {
+		if c, err = readMore(in); err != nil {
+			return
+		}
+		val = val<<8 | uint64(c)
+	}
+	return val, nil
+}
+
+func (p quicVarint) RetType() reflect.Type {
+
+	return tyUint64
+}
+
+func (p quicVarint) SizeOf() int {
+
+	return -1
+}
+
+// QuicVarint is a matching unit that matches a variable-length integer of QUIC
+// (RFC 9000), whose length is given by the two most significant bits.
+//
+var QuicVarint Ruler = quicVarint(0)
+
+// -----------------------------------------------------------------------------
+
+type berLength int
+
+func (p berLength) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	c, err := in.ReadByte()
+	if err != nil {
+		return
+	}
+	if c < 0x80 {
+		return int(c), nil
+	}
+	n := int(c & 0x7f)
+	if n == 0 { // indefinite form
+		return -1, nil
+	}
+	if n > 7 || c == 0xff {
+		return nil, ErrInvalidLength
+	}
+	var val int
+	for ; n > 0; n-- {
+		if c, err = readMore(in); err != nil {
+			return
+		}
+		val = val<<8 | int(c)
+	}
+	return val, nil
+}
+
+func (p berLength) RetType() reflect.Type {
+
+	return tyInt
+}
+
+func (p berLength) SizeOf() int {
+
+	return -1
+}
+
+// BerLength is a matching unit that matches a length field of ASN.1 BER. It
+// returns -1 for the indefinite form.
+//
+var BerLength Ruler = berLength(0)
+
+// -----------------------------------------------------------------------------
+
+type mqttLength int
+
+func (p mqttLength) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	var val int
+	c, err := in.ReadByte()
+	for shift := uint(0); err == nil; shift += 7 {
+		val |= int(c&0x7f) << shift
+		if c < 0x80 {
+			return val, nil
+		}
+		if shift == 21 {
+			return nil, ErrInvalidLength
+		}
+		c, err = readMore(in)
+	}
+	return
+}
+
+func (p mqttLength) RetType() reflect.Type {
+
+	return tyInt
+}
+
+func (p mqttLength) SizeOf() int {
+
+	return -1
+}
+
+// MqttLength is a matching unit that matches the remaining length of MQTT, a
+// LEB128 integer of at most 4 bytes.
+//
+var MqttLength Ruler = mqttLength(0)
+
+// -----------------------------------------------------------------------------
+
+type pstring struct {
+	size int // size of the length prefix
+	be   bool
+}
+
+func (p *pstring) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	t, err := in.Peek(p.size)
+	if err != nil {
+		if err == io.EOF && len(t) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	var n uint64
+	switch {
+	case p.size == 1:
+		n = uint64(t[0])
+	case p.size == 2 && p.be:
+		n = uint64(binary.BigEndian.Uint16(t))
+	case p.size == 2:
+		n = uint64(binary.LittleEndian.Uint16(t))
+	case p.be:
+		n = uint64(binary.BigEndian.Uint32(t))
+	default:
+		n = uint64(binary.LittleEndian.Uint32(t))
+	}
+	in.Discard(p.size)
+	b, err := readChunks(in, n)
+	if err != nil {
+		return
+	}
+	return string(b), nil
+}
+
+func (p *pstring) RetType() reflect.Type {
+
+	return tyString
+}
+
+func (p *pstring) SizeOf() int {
+
+	return -1
+}
+
+// PString returns a matching unit that matches a Pascal style string, which is
+// prefixed by its length in bytes. The length prefix is an unsigned integer of
+// `size` (1, 2 or 4) bytes, in big endian if `be` is true.
+//
+func PString(size int, be bool) Ruler {
+
+	if size != 1 && size != 2 && size != 4 {
+		panic("PString: invalid argument (size == 1 || size == 2 || size == 4)")
+	}
+	return &pstring{size: size, be: be}
+}
+
+// -----------------------------------------------------------------------------
+
+func decodeUTF16(b []byte, be bool) string {
+
+	s := make([]uint16, len(b)>>1)
+	for i := range s {
+		if be {
+			s[i] = binary.BigEndian.Uint16(b[i<<1:])
+		} else {
+			s[i] = binary.LittleEndian.Uint16(b[i<<1:])
+		}
+		if s[i] == 0 {
+			s = s[:i]
+			break
+		}
+	}
+	return string(utf16.Decode(s))
+}
+
+type utf16String bool
+
+func (p utf16String) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	if _, err = in.Peek(1); err != nil {
+		return
+	}
+	var b []byte
+	var t [2]byte
+	for {
+		if err = readFull(in, t[:]); err != nil {
+			return
+		}
+		if t[0] == 0 && t[1] == 0 {
+			return decodeUTF16(b, bool(p)), nil
+		}
+		b = append(b, t[0], t[1])
+	}
+}
+
+func (p utf16String) RetType() reflect.Type {
+
+	return tyString
+}
+
+func (p utf16String) SizeOf() int {
+
+	return -1
+}
+
+var (
+	// UTF16le is a matching unit that matches a NUL terminated UTF-16LE string.
+	UTF16le Ruler = utf16String(false)
+
+	// UTF16be is a matching unit that matches a NUL terminated UTF-16BE string.
+	UTF16be Ruler = utf16String(true)
+)
+
+// -----------------------------------------------------------------------------
+
+type zcharType int
+
+func (p zcharType) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	return in.ReadByte()
+}
+
+func (p zcharType) RetType() reflect.Type {
+
+	return tyUint8
+}
+
+func (p zcharType) SizeOf() int {
+
+	return 1
+}
+
+// ZChar is a matching unit that matches a character, just like Char. But `[n]zchar`
+// matches a fixed-length NUL padded string: the result is truncated at the first
+// NUL character.
+//
+var ZChar Ruler = zcharType(0)
+
+// -----------------------------------------------------------------------------
+
+// A strArray matches `[n]zchar`, `[n]utf16le` or `[n]utf16be`.
+//
+type strArray struct {
+	r    Ruler
+	n    func(ctx *Context) int
+	size int // -1 if n is not a constant
+}
+
+func (p *strArray) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	n := p.n(ctx)
+	if n < 0 {
+		return nil, ErrInvalidLength
+	}
+	if u, ok := p.r.(utf16String); ok {
+		b := make([]byte, n<<1)
+		if err = readFull(in, b); err != nil {
+			return
+		}
+		return decodeUTF16(b, bool(u)), nil
+	}
+
+	b := make([]byte, n)
+	if err = readFull(in, b); err != nil {
+		return
+	}
+	for i, c := range b {
+		if c == 0 {
+			b = b[:i]
+			break
+		}
+	}
+	return string(b), nil
+}
+
+func (p *strArray) RetType() reflect.Type {
+
+	return tyString
+}
+
+func (p *strArray) SizeOf() int {
+
+	return p.size
+}
+
+func isStrElem(r Ruler) bool {
+
+	switch r.(type) {
+	case zcharType, utf16String:
+		return true
+	}
+	return false
+}
+
+func newStrArray(r Ruler, n int) Ruler {
+
+	size := n
+	if _, ok := r.(utf16String); ok {
+		size <<= 1
+	}
+	return &strArray{r: r, n: func(ctx *Context) int { return n }, size: size}
+}
+
+// -----------------------------------------------------------------------------
+
+type lineType int
+
+func (p lineType) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	var b []byte
+	for {
+		t, err := in.ReadSlice('\n')
+		b = append(b, t...)
+		if len(b) > MaxLineSize+1 {
+			return nil, ErrLineTooLong
+		}
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			if err == io.EOF && len(b) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	n := len(b) - 1
+	if n > 0 && b[n-1] == '\r' {
+		n--
+	}
+	return string(b[:n]), nil
+}
+
+func (p lineType) RetType() reflect.Type {
+
+	return tyString
+}
+
+func (p lineType) SizeOf() int {
+
+	return -1
+}
+
+// Line is a matching unit that matches a line of text terminated by "\r\n" or "\n".
+// The result doesn't include the line terminator.
+//
+var Line Ruler = lineType(0)
+
+// -----------------------------------------------------------------------------
+
+type crlfType int
+
+func (p crlfType) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	b, err := in.Peek(2)
+	if err != nil {
+		if err == io.EOF && len(b) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	if b[0] != '\r' || b[1] != '\n' {
+		return nil, ErrNotCRLF
+	}
+	in.Discard(2)
+	return nil, nil
+}
+
+func (p crlfType) RetType() reflect.Type {
+
+	return TyInterface
+}
+
+func (p crlfType) SizeOf() int {
+
+	return 2
+}
+
+// CRLF is a matching unit that matches "\r\n", eg. the terminator of a bulk string
+// of redis.
+//
+var CRLF Ruler = crlfType(0)
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,120 @@
+package bpl_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"runtime"
+	"testing"
+
+	"qiniu.com/bpl"
+)
+
+type encodingCase struct {
+	r   bpl.Ruler
+	in  []byte
+	v   interface{}
+	err error
+}
+
+var encodingCases = []encodingCase{
+	{bpl.Uleb128, []byte{0xe5, 0x8e, 0x26}, uint64(624485), nil},
+	{bpl.Uleb128, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, ^uint64(0), nil},
+	{bpl.Uleb128, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02}, nil, bpl.ErrVarintOverflow},
+	{bpl.Uleb128, []byte{0xe5, 0x8e}, nil, io.ErrUnexpectedEOF},
+	{bpl.Uleb128, nil, nil, io.EOF},
+	{bpl.Sleb128, []byte{0xc0, 0xbb, 0x78}, int64(-123456), nil},
+	{bpl.Sleb128, []byte{0x3f}, int64(63), nil},
+	{bpl.Sleb128, []byte{0x40}, int64(-64), nil},
+	{bpl.Zigzag, []byte{0x03}, int64(-2), nil},
+	{bpl.Zigzag, []byte{0x04}, int64(2), nil},
+	{bpl.QuicVarint, []byte{0xc2, 0x19, 0x7c, 0x5e, 0xff, 0x14, 0xe8, 0x8c}, uint64(151288809941952652), nil},
+	{bpl.QuicVarint, []byte{0x9d, 0x7f, 0x3e, 0x7d}, uint64(494878333), nil},
+	{bpl.QuicVarint, []byte{0x7b, 0xbd}, uint64(15293), nil},
+	{bpl.QuicVarint, []byte{0x25}, uint64(37), nil},
+	{bpl.QuicVarint, []byte{0x7b}, nil, io.ErrUnexpectedEOF},
+	{bpl.BerLength, []byte{0x26}, 38, nil},
+	{bpl.BerLength, []byte{0x82, 0x01, 0xb3}, 435, nil},
+	{bpl.BerLength, []byte{0x80}, -1, nil},
+	{bpl.BerLength, []byte{0xff}, nil, bpl.ErrInvalidLength},
+	{bpl.MqttLength, []byte{0xc1, 0x02}, 321, nil},
+	{bpl.MqttLength, []byte{0xff, 0xff, 0xff, 0x7f}, 268435455, nil},
+	{bpl.MqttLength, []byte{0xff, 0xff, 0xff, 0xff, 0x01}, nil, bpl.ErrInvalidLength},
+	{bpl.PString(1, false), []byte{3, 'a', 'b', 'c'}, "abc", nil},
+	{bpl.PString(2, true), []byte{0, 2, 'h', 'i'}, "hi", nil},
+	{bpl.PString(4, false), []byte{2, 0, 0, 0, 'h', 'i'}, "hi", nil},
+	{bpl.PString(4, false), []byte{3, 0, 0, 0, 'h', 'i'}, nil, io.ErrUnexpectedEOF},
+	{bpl.PString(2, false), []byte{3}, nil, io.ErrUnexpectedEOF},
+	{bpl.PString(4, true), []byte{0xff, 0xff, 0xff, 0xff, 'h', 'i'}, nil, io.ErrUnexpectedEOF},
+	{bpl.UTF16le, []byte{'h', 0, 'i', 0, 0x3d, 0xd8, 0x00, 0xde, 0, 0}, "hi\U0001f600", nil},
+	{bpl.UTF16be, []byte{0, 'h', 0, 'i', 0, 0}, "hi", nil},
+	{bpl.UTF16be, []byte{0, 'h', 0}, nil, io.ErrUnexpectedEOF},
+	{bpl.UTF16be, nil, nil, io.EOF},
+	{bpl.Array(bpl.ZChar, 6), []byte{'a', 'b', 0, 0, 0, 0}, "ab", nil},
+	{bpl.Array(bpl.UTF16le, 3), []byte{'a', 0, 'b', 0, 0, 0}, "ab", nil},
+	{bpl.Array(bpl.ZChar, 6), []byte{'a', 'b'}, nil, io.ErrUnexpectedEOF},
+	{bpl.Line, []byte("+OK\r\n"), "+OK", nil},
+	{bpl.Line, []byte("get foo\nbar"), "get foo", nil},
+	{bpl.Line, []byte("\r\n"), "", nil},
+	{bpl.Line, []byte("abc"), nil, io.ErrUnexpectedEOF},
+	{bpl.Line, nil, nil, io.EOF},
+	{bpl.CRLF, []byte("\r\n"), nil, nil},
+	{bpl.CRLF, []byte("\n\r"), nil, bpl.ErrNotCRLF},
+	{bpl.CRLF, []byte("\r"), nil, io.ErrUnexpectedEOF},
+}
+
+func TestEncoding(t *testing.T) {
+
+	for i, c := range encodingCases {
+		in := bufio.NewReader(bytes.NewReader(c.in))
+		v, err := c.r.Match(in, nil)
+		if err != c.err || v != c.v && err == nil {
+			t.Fatal("case", i, "Match:", v, err)
+		}
+	}
+}
+
+func TestLongLine(t *testing.T) {
+
+	b := append(bytes.Repeat([]byte{'x'}, 10000), '\r', '\n')
+	v, err := bpl.Line.Match(bufio.NewReaderSize(bytes.NewReader(b), 16), nil)
+	if err != nil || v != string(b[:10000]) {
+		t.Fatal("Line.Match:", err)
+	}
+
+	old := bpl.MaxLineSize
+	bpl.MaxLineSize = 1000
+	defer func() { bpl.MaxLineSize = old }()
+	_, err = bpl.Line.Match(bufio.NewReaderSize(bytes.NewReader(b), 16), nil)
+	if err != bpl.ErrLineTooLong {
+		t.Fatal("Line.Match:", err)
+	}
+}
+
+func TestLongPString(t *testing.T) {
+
+	b := append([]byte{0xa0, 0x86, 0x01, 0}, bytes.Repeat([]byte{'x'}, 100000)...)
+	v, err := bpl.PString(4, false).Match(bufio.NewReader(bytes.NewReader(b)), nil)
+	if err != nil || v != string(b[4:]) {
+		t.Fatal("PString.Match:", err)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	b = []byte{0xff, 0xff, 0xff, 0xff, 'h', 'i'}
+	_, err = bpl.PString(4, true).Match(bufio.NewReader(bytes.NewReader(b)), nil)
+	runtime.ReadMemStats(&after)
+	if err != io.ErrUnexpectedEOF || after.TotalAlloc-before.TotalAlloc > 1<<20 {
+		t.Fatal("PString.Match:", err, after.TotalAlloc-before.TotalAlloc)
+	}
+}
+
+func TestEncodingSizeOf(t *testing.T) {
+
+	if bpl.Uleb128.SizeOf() != -1 || bpl.PString(1, false).SizeOf() != -1 || bpl.UTF16le.SizeOf() != -1 {
+		t.Fatal("SizeOf of a variable length type != -1")
+	}
+	if bpl.Array(bpl.ZChar, 6).SizeOf() != 6 || bpl.Array(bpl.UTF16be, 3).SizeOf() != 6 {
+		t.Fatal("SizeOf of a fixed length string is invalid")
+	}
+}
@@ -0,0 +1,310 @@
+package bpl
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+
+	"qiniupkg.com/x/bufiox.v7"
+	"qlang.io/exec.v2"
+)
+
+// -----------------------------------------------------------------------------
+
+// A Pos is the position where a matching error occurs.
+//
+type Pos struct {
+	Path   string // rule path, see Context.RulePath
+	Offset int64  // offset of the input stream, see Context.Tell
+	Nested bool   // Offset is of a nested stream (eg. bytes of `eval`), not the input
+	File   string // bpl source file of the rule, if known
+	Line   int
+}
+
+func (p *Pos) pos() *Pos {
+
+	return p
+}
+
+func (p *Pos) String() string {
+
+	var b bytes.Buffer
+	if p.Line != 0 {
+		if p.File != "" {
+			fmt.Fprintf(&b, "%s:%d: ", p.File, p.Line)
+		} else {
+			fmt.Fprintf(&b, "line %d: ", p.Line)
+		}
+	}
+	if p.Path != "" {
+		b.WriteString(p.Path)
+		b.WriteByte(' ')
+	}
+	if p.Nested {
+		fmt.Fprintf(&b, "(offset %d in nested stream)", p.Offset)
+	} else {
+		fmt.Fprintf(&b, "(offset %d)", p.Offset)
+	}
+	return b.String()
+}
+
+// A positioner is an error that carries the position where it occurs. Such errors
+// aren't wrapped by the rules where they occur, so they work with errors.As.
+//
+type positioner interface {
+	error
+	pos() *Pos
+}
+
+// -----------------------------------------------------------------------------
+
+// An ErrTruncated is returned when the input ends before a rule is matched.
+//
+type ErrTruncated struct {
+	Pos
+	Needed    int         // bytes needed by the rule, or -1 if it's unknown (eg. a struct)
+	Available int         // bytes available since the rule starts
+	Record    int         // 1-based index of the record where the input ends, or 0 (see Stats)
+	Partial   interface{} // partial matching result of the record
+}
+
+func (p *ErrTruncated) Error() string {
+
+	where := "truncated"
+	if p.Record > 0 {
+		where = fmt.Sprintf("truncated inside record %d", p.Record)
+	}
+	if p.Needed < 0 {
+		return fmt.Sprintf("%s: %d bytes available, more needed at %v", where, p.Available, &p.Pos)
+	}
+	return fmt.Sprintf("%s: %d bytes needed, %d available at %v", where, p.Needed, p.Available, &p.Pos)
+}
+
+// Unwrap returns io.ErrUnexpectedEOF.
+//
+func (p *ErrTruncated) Unwrap() error {
+
+	return io.ErrUnexpectedEOF
+}
+
+// truncated returns an ErrTruncated if err is io.EOF or io.ErrUnexpectedEOF, that is,
+// `needed` bytes are required but only `available` bytes are read.
+//
+func truncated(err error, needed, available int) error {
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &ErrTruncated{Needed: needed, Available: available}
+	}
+	return err
+}
+
+// -----------------------------------------------------------------------------
+
+// An AssertionError is returned when an `assert <condition>` fails, or a checksum
+// mismatches, whose Values are the checksum and the expected value.
+//
+type AssertionError struct {
+	Pos
+	Expr   string                 // source code of the condition
+	Values map[string]interface{} // values of the variables referred by the condition
+}
+
+func (p *AssertionError) Error() string {
+
+	var b bytes.Buffer
+	b.WriteString("assert failed: ")
+	b.WriteString(p.Expr)
+	if len(p.Values) > 0 {
+		names := make([]string, 0, len(p.Values))
+		for name := range p.Values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		b.WriteString(" (")
+		for i, name := range names {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			fmt.Fprintf(&b, "%s = %v", name, p.Values[name])
+		}
+		b.WriteByte(')')
+	}
+	fmt.Fprintf(&b, " at %v", &p.Pos)
+	return b.String()
+}
+
+// -----------------------------------------------------------------------------
+
+// A SpecError is returned when a rule is misused, that is, the bpl spec has a bug.
+// For example, a rule returns a value of wrong type, or a variable is redefined.
+//
+type SpecError struct {
+	Pos
+	Err error
+}
+
+func (p *SpecError) Error() string {
+
+	return fmt.Sprintf("%v at %v", p.Err, &p.Pos)
+}
+
+// Unwrap returns the underlying error.
+//
+func (p *SpecError) Unwrap() error {
+
+	return p.Err
+}
+
+func specError(msg string) *SpecError {
+
+	return &SpecError{Err: errors.New(msg)}
+}
+
+// -----------------------------------------------------------------------------
+
+// A PartialError is returned by Context.WithPartial. It carries the matching result
+// before the failure, eg. all boxes of a corrupted mp4 file matched before the bad
+// one.
+//
+type PartialError struct {
+	Pos                       // where matching fails, if known
+	Err           error       // the error of matching
+	PartialResult interface{} // matching result of the whole input before the failure
+	Record        int         // 1-based index of the failing record, or 0 (see Stats)
+	RecordResult  interface{} // partial matching result of the failing record
+}
+
+func (p *PartialError) Error() string {
+
+	return p.Err.Error()
+}
+
+// Unwrap returns the error of matching.
+//
+func (p *PartialError) Unwrap() error {
+
+	return p.Err
+}
+
+// Brief returns the error message without the bpl stack and the buffered input,
+// which are reported by Pos and PartialResult instead.
+//
+func (p *PartialError) Brief() string {
+
+	e, ok := p.Err.(*exec.Error)
+	if !ok {
+		return p.Err.Error()
+	}
+	err := e.Err
+	if at, ok := err.(*errorAt); ok {
+		err = at.Err
+	}
+	return fmt.Sprintf("%v at %v", err, &p.Pos)
+}
+
+// WithPartial returns a PartialError that wraps err, the error of matching with
+// context `p` (see MatchStream), with the matching result before the failure. Members
+// of structs and elements of arrays which fail to match are included in the result
+// with their partial matching results.
+//
+// Records (see Stats) matched by `doc = *(Message dump)` aren't kept in the matching
+// result, so only the failing one is reported by RecordResult.
+//
+func (p *Context) WithPartial(err error) error {
+
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*PartialError); ok {
+		return err
+	}
+	st := p.st
+	e := &PartialError{Err: err, PartialResult: p.dom, Record: st.failed, RecordResult: st.partial}
+	if te, ok := err.(positioner); ok {
+		e.Pos = *te.pos()
+	} else if st.errAt != nil {
+		e.Pos = st.errPos
+	}
+	return e
+}
+
+// partialOf returns partial matching result of a rule which fails to match with
+// context `sub`.
+//
+func partialOf(v interface{}, sub *Context) interface{} {
+
+	if v != nil {
+		return v
+	}
+	return sub.dom
+}
+
+// setPartial sets partial matching result of member `name`, unless the dom isn't a
+// struct or the member exists.
+//
+func (p *Context) setPartial(name string, v interface{}) {
+
+	if v == nil {
+		return
+	}
+	if _, ok := p.Globals.Var(name); ok {
+		return
+	}
+	if p.dom == nil {
+		p.dom = map[string]interface{}{name: v}
+	} else if domv, ok := p.dom.(map[string]interface{}); ok {
+		if _, ok = domv[name]; !ok {
+			domv[name] = v
+		}
+	}
+}
+
+// appendPartial appends partial matching result of the failing element to array
+// `ret`, if it's of the element type.
+//
+func appendPartial(ret reflect.Value, v interface{}) interface{} {
+
+	if v != nil && reflect.TypeOf(v).AssignableTo(ret.Type().Elem()) {
+		ret = reflect.Append(ret, reflect.ValueOf(v))
+	}
+	return ret.Interface()
+}
+
+// -----------------------------------------------------------------------------
+
+// typedError sets position of a typed error returned by rule `p`, or converts io.EOF
+// and io.ErrUnexpectedEOF to an ErrTruncated. So is bufio.ErrBufferFull of a reader
+// returned by bufiox.NewReaderBuffer (eg. input of MatchBuffer), which holds the whole
+// input. It returns nil if err isn't a typed error.
+//
+func (p *fileLine) typedError(err error, in *bufio.Reader, ctx *Context, start int64) positioner {
+
+	e, ok := err.(positioner)
+	if !ok {
+		if err == bufio.ErrBufferFull && bufiox.IsReaderBuffer(in) {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil
+		}
+		available := in.Buffered()
+		if start >= 0 {
+			available += int(ctx.Tell(in) - start)
+		}
+		e = &ErrTruncated{Needed: p.r.SizeOf(), Available: available}
+	}
+	pos := e.pos()
+	if pos.Path == "" {
+		*pos = ctx.position(in)
+	}
+	if pos.Line == 0 && p.line != 0 {
+		pos.File, pos.Line = p.file, p.line
+	}
+	return e
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,480 @@
+package format
+
+import (
+	"bytes"
+	"errors"
+	"go/token"
+	"strings"
+	"unicode/utf8"
+
+	bpl "qiniu.com/bpl/bpl.ext"
+	"qiniupkg.com/text/tpl.v1"
+)
+
+// -----------------------------------------------------------------------------
+
+var (
+	// ErrChanged is returned when formatting would change the meaning of source
+	// code. It always means a bug of the formatter.
+	ErrChanged = errors.New("format: formatted source code doesn't match the original")
+)
+
+var keywords = func() map[string]bool {
+
+	m := make(map[string]bool)
+	for _, kw := range bpl.Keywords() {
+		m[kw] = true
+	}
+	return m
+}()
+
+type tok struct {
+	kind  uint
+	text  string
+	line  int  // line of the first character
+	end   int  // line of the last character
+	col   int  // visual column, a tab counts to the next multiple of 4
+	space bool // there are spaces before the token in the same line
+	brk   bool // force a line break before the token
+	drop  bool // the token is removed, eg. `;` of a `const` group
+}
+
+func scan(src []byte) (toks []*tok, err error) {
+
+	fset := token.NewFileSet()
+	file := fset.AddFile("", -1, len(src))
+
+	var s tpl.Scanner
+	s.Init(file, src, func(pos token.Position, msg string) {
+		if err == nil {
+			err = &bpl.CompileError{Line: pos.Line, Column: pos.Column, Msg: msg}
+		}
+	}, tpl.ScanComments)
+
+	var offs []int
+	for {
+		t := s.Scan()
+		if t.Kind == tpl.EOF {
+			break
+		}
+		offs = append(offs, file.Offset(t.Pos))
+		toks = append(toks, &tok{kind: t.Kind, line: file.Position(t.Pos).Line})
+	}
+	offs = append(offs, len(src))
+	for i, t := range toks {
+		t.text = strings.TrimRight(string(src[offs[i]:offs[i+1]]), " \t\r\n")
+		t.end = t.line + strings.Count(t.text, "\n")
+		start := bytes.LastIndexByte(src[:offs[i]], '\n') + 1
+		for _, c := range string(src[start:offs[i]]) {
+			if c == '\t' {
+				t.col += 4 - t.col%4
+			} else {
+				t.col++
+			}
+		}
+		t.space = i > 0 && toks[i-1].end == t.line && offs[i] > start && offs[i-1]+len(toks[i-1].text) < offs[i]
+	}
+	return
+}
+
+// breakConsts puts every item of a `const ( ... )` group into its own line.
+//
+func breakConsts(toks []*tok) {
+
+	sameLine := func(i int) bool {
+		return i < len(toks) && toks[i].line == toks[i-1].end && toks[i].kind != tpl.COMMENT
+	}
+	for i := 0; i+1 < len(toks); i++ {
+		if toks[i].text != "const" || toks[i+1].kind != tpl.LPAREN {
+			continue
+		}
+		i += 2
+		toks[i-1].brk = false
+		if sameLine(i) && toks[i].kind != tpl.RPAREN {
+			toks[i].brk = true
+		}
+		for ; i < len(toks) && toks[i].kind != tpl.RPAREN; i++ {
+			if toks[i].kind == tpl.SEMICOLON {
+				toks[i].drop = true
+				if sameLine(i + 1) {
+					toks[i+1].brk = true
+				}
+			}
+		}
+		if i < len(toks) && toks[i-1].kind != tpl.LPAREN && sameLine(i) {
+			toks[i].brk = true
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+const (
+	otherLine = iota
+	memberLine
+	keyValueLine
+	constLine
+)
+
+const (
+	blockCtx = iota
+	cstructCtx
+	constCtx
+)
+
+type line struct {
+	toks    []*tok
+	comment *tok
+	blank   bool // there is a blank line before
+	indent  int
+	ctx     int
+	kind    int
+	cells   []string
+}
+
+func splitLines(toks []*tok) (lines []*line) {
+
+	var last *line
+	for i, t := range toks {
+		if t.drop {
+			continue
+		}
+		if last == nil || t.brk || i > 0 && t.line > toks[i-1].end {
+			last = &line{blank: i > 0 && t.line > toks[i-1].end+1}
+			lines = append(lines, last)
+		}
+		if t.kind == tpl.COMMENT && (i+1 == len(toks) || toks[i+1].line > t.end || toks[i+1].brk) {
+			last.comment = t
+		} else {
+			last.toks = append(last.toks, t)
+		}
+	}
+	return
+}
+
+func isOpen(t *tok) bool {
+
+	return t.kind == tpl.LBRACE || t.kind == tpl.LPAREN || t.kind == tpl.LBRACK
+}
+
+func isClose(t *tok) bool {
+
+	return t.kind == tpl.RBRACE || t.kind == tpl.RPAREN || t.kind == tpl.RBRACK
+}
+
+// indent computes indentation of each line. A line that leaves brackets open
+// indents the following lines by one tab, no matter how many brackets it opens.
+//
+func indent(lines []*line) {
+
+	var levels []int // brackets opened by each indented line
+	var ctxs []int   // context of each opened bracket
+	close := func() {
+		if n := len(levels); n > 0 {
+			if levels[n-1]--; levels[n-1] == 0 {
+				levels = levels[:n-1]
+			}
+		}
+		if n := len(ctxs); n > 0 {
+			ctxs = ctxs[:n-1]
+		}
+	}
+	for _, l := range lines {
+		i := 0
+		for i < len(l.toks) && isClose(l.toks[i]) {
+			close()
+			i++
+		}
+		l.indent = len(levels)
+		if n := len(ctxs); n > 0 {
+			l.ctx = ctxs[n-1]
+		}
+		open := 0
+		for ; i < len(l.toks); i++ {
+			t := l.toks[i]
+			if isOpen(t) {
+				ctx := blockCtx
+				if t.kind == tpl.LBRACE && i+2 < len(l.toks) && l.toks[i+1].kind == tpl.QUO && l.toks[i+2].text == "C" {
+					ctx = cstructCtx
+				} else if t.kind == tpl.LPAREN && i > 0 && l.toks[i-1].text == "const" {
+					ctx = constCtx
+				}
+				ctxs = append(ctxs, ctx)
+				open++
+			} else if isClose(t) {
+				if open > 0 {
+					open--
+					ctxs = ctxs[:len(ctxs)-1]
+				} else {
+					close()
+				}
+			}
+		}
+		if open > 0 {
+			levels = append(levels, open)
+			l.kind = -1
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+func isName(t *tok) bool {
+
+	return t.kind == tpl.IDENT && !keywords[t.text]
+}
+
+func join(toks []*tok) string {
+
+	var b bytes.Buffer
+	for i, t := range toks {
+		if i > 0 {
+			prev := toks[i-1]
+			switch {
+			case t.space:
+				b.WriteByte(' ')
+			case t.kind == tpl.LBRACE && prev.kind != tpl.LPAREN && prev.kind != tpl.LBRACK && prev.kind != tpl.LBRACE:
+				b.WriteByte(' ')
+			case prev.kind == tpl.RBRACE && (t.text == "elif" || t.text == "else"):
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteString(t.text)
+	}
+	return b.String()
+}
+
+// split splits a line into cells to be aligned:
+//
+//	name type          (member of a struct)
+//	type name;         (member of a C struct)
+//	key: value         (item of a case or a map)
+//	NAME = value       (item of a const group)
+//
+func split(l *line) {
+
+	toks := l.toks
+	n := len(toks)
+	if l.kind < 0 || n == 0 {
+		l.kind = otherLine
+		l.cells = []string{join(toks)}
+		return
+	}
+
+	at := 0
+	switch l.ctx {
+	case constCtx:
+		if n > 2 && isName(toks[0]) && toks[1].kind == tpl.ASSIGN {
+			l.kind, at = constLine, 1
+		}
+	case cstructCtx:
+		end := n
+		if toks[end-1].kind == tpl.SEMICOLON {
+			end--
+		}
+		if end >= 2 && isName(toks[0]) && isName(toks[end-1]) {
+			mid := toks[1 : end-1]
+			switch {
+			case len(mid) == 0:
+			case len(mid) == 1 && (mid[0].kind == tpl.MUL || mid[0].kind == tpl.QUESTION || mid[0].kind == tpl.ADD):
+			case mid[0].kind == tpl.LBRACK && mid[len(mid)-1].kind == tpl.RBRACK:
+			default:
+				end = 0
+			}
+			if end > 0 {
+				l.kind, at = memberLine, end-1
+			}
+		}
+	default:
+		switch {
+		case n > 2 && toks[1].kind == tpl.COLON &&
+			(toks[0].kind == tpl.INT || toks[0].kind == tpl.STRING || toks[0].kind == tpl.CHAR):
+			l.kind, at = keyValueLine, 2
+		case n > 1 && isName(toks[0]) &&
+			(toks[1].kind == tpl.IDENT || toks[1].kind == tpl.LBRACK || toks[1].kind == tpl.MUL ||
+				toks[1].kind == tpl.QUESTION || toks[1].kind == tpl.ADD):
+			l.kind, at = memberLine, 1
+		}
+	}
+	if at == 0 {
+		l.cells = []string{join(toks)}
+		return
+	}
+	rest := join(toks[at:])
+	if toks[at].kind == tpl.SEMICOLON {
+		l.cells = []string{join(toks)}
+		return
+	}
+	l.cells = []string{join(toks[:at]), rest}
+}
+
+func width(s string) int {
+
+	return utf8.RuneCountInString(s)
+}
+
+// align pads the cells of consecutive lines of the same kind, and trailing
+// comments of consecutive lines, to the same columns.
+//
+func align(lines []*line) {
+
+	for i := 0; i < len(lines); {
+		l := lines[i]
+		j := i + 1
+		if l.kind != otherLine {
+			for j < len(lines) {
+				m := lines[j]
+				if m.blank || m.indent != l.indent {
+					break
+				}
+				if !(m.kind == l.kind || len(m.toks) == 0) {
+					break
+				}
+				j++
+			}
+			for k := j; k > i && len(lines[k-1].toks) == 0; k-- {
+				j = k - 1
+			}
+			w := 0
+			for _, m := range lines[i:j] {
+				if len(m.cells) == 2 && width(m.cells[0]) > w {
+					w = width(m.cells[0])
+				}
+			}
+			for _, m := range lines[i:j] {
+				if len(m.cells) == 2 {
+					m.cells = []string{m.cells[0] + strings.Repeat(" ", w-width(m.cells[0])+1) + m.cells[1]}
+				}
+			}
+		}
+		i = j
+	}
+
+	for i := 0; i < len(lines); {
+		if lines[i].comment == nil || len(lines[i].toks) == 0 {
+			i++
+			continue
+		}
+		j := i + 1
+		for j < len(lines) {
+			m := lines[j]
+			if m.blank || m.comment == nil || m.indent != lines[i].indent {
+				break
+			}
+			if len(m.toks) == 0 && !(m.comment.col > lines[j-1].toks0col()) {
+				break
+			}
+			j++
+		}
+		w := 0
+		for _, m := range lines[i:j] {
+			if m.cells != nil && width(m.cells[0]) > w {
+				w = width(m.cells[0])
+			}
+		}
+		for _, m := range lines[i:j] {
+			code := ""
+			if m.cells != nil {
+				code = m.cells[0]
+			}
+			m.cells = []string{code + strings.Repeat(" ", w-width(code)+1) + m.comment.text}
+			m.comment = nil
+		}
+		i = j
+	}
+}
+
+func (l *line) toks0col() int {
+
+	if len(l.toks) == 0 {
+		if l.comment != nil {
+			return l.comment.col
+		}
+		return 0
+	}
+	return l.toks[0].col
+}
+
+// -----------------------------------------------------------------------------
+
+func same(a, b []*tok) bool {
+
+	filter := func(toks []*tok) (ret []*tok) {
+		for _, t := range toks {
+			if t.kind != tpl.SEMICOLON {
+				ret = append(ret, t)
+			}
+		}
+		return
+	}
+	a, b = filter(a), filter(b)
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].kind != b[i].kind || a[i].text != b[i].text {
+			return false
+		}
+	}
+	return true
+}
+
+// Source formats bpl source code canonically:
+//
+//   - lines are indented by tabs, one tab per level of brackets;
+//   - types of struct members, values of case items and const items, and trailing
+//     comments of consecutive lines are aligned by spaces;
+//   - each item of a `const ( ... )` group is in its own line;
+//   - `elif` and `else` follow the closing brace in the same line;
+//   - repeated blank lines are collapsed, and trailing spaces are removed.
+//
+// Comments are preserved. It returns an error if src isn't valid bpl source code.
+//
+func Source(src []byte) ([]byte, error) {
+
+	if mod, err := bpl.Analyze(src, ""); mod == nil {
+		return nil, err
+	}
+
+	toks, err := scan(src)
+	if err != nil {
+		return nil, err
+	}
+	breakConsts(toks)
+	lines := splitLines(toks)
+	indent(lines)
+	for _, l := range lines {
+		split(l)
+	}
+	align(lines)
+
+	var b bytes.Buffer
+	for i, l := range lines {
+		if l.blank && i > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(strings.Repeat("\t", l.indent))
+		if l.cells != nil {
+			b.WriteString(l.cells[0])
+		}
+		if l.comment != nil {
+			if l.cells != nil && l.cells[0] != "" {
+				b.WriteByte(' ')
+			}
+			b.WriteString(l.comment.text)
+		}
+		b.WriteByte('\n')
+	}
+	out := b.Bytes()
+
+	toks2, err := scan(out)
+	if err != nil || !same(toks, toks2) {
+		return nil, ErrChanged
+	}
+	if mod, _ := bpl.Analyze(out, ""); mod == nil {
+		return nil, ErrChanged
+	}
+	return out, nil
+}
+
+// -----------------------------------------------------------------------------
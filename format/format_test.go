@@ -0,0 +1,106 @@
+package format
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// -----------------------------------------------------------------------------
+
+const codeMessy = `const ( A = 1; BB = 2; )
+
+
+hdr = {/C
+    uint8 tag; // tag
+  uint16be  length;
+}
+
+doc = {
+  h hdr
+  if h.tag == A {
+      body [h.length]byte
+  }elif h.tag == BB{
+    let x = 1
+  }else{
+    skip h.length  // skip
+  }
+  eval h.tag do case h.tag {
+	1: uint8 // one
+	1000: uint16 // thousand
+	default: nil
+  }
+}
+`
+
+const codeFormatted = `const (
+	A  = 1
+	BB = 2
+)
+
+hdr = {/C
+	uint8    tag; // tag
+	uint16be length;
+}
+
+doc = {
+	h hdr
+	if h.tag == A {
+		body [h.length]byte
+	} elif h.tag == BB {
+		let x = 1
+	} else {
+		skip h.length // skip
+	}
+	eval h.tag do case h.tag {
+		1:    uint8  // one
+		1000: uint16 // thousand
+		default: nil
+	}
+}
+`
+
+func TestSource(t *testing.T) {
+
+	out, err := Source([]byte(codeMessy))
+	if err != nil {
+		t.Fatal("Source failed:", err)
+	}
+	if string(out) != codeFormatted {
+		t.Fatal("Source:\n" + string(out))
+	}
+
+	out, err = Source([]byte(codeFormatted))
+	if err != nil || string(out) != codeFormatted {
+		t.Fatal("Source isn't idempotent:", err, "\n"+string(out))
+	}
+
+	_, err = Source([]byte("doc = {\n\ta uint8 uint8\n}\n"))
+	if err == nil {
+		t.Fatal("Source: no syntax error")
+	}
+}
+
+func TestFormats(t *testing.T) {
+
+	files, _ := filepath.Glob("../formats/*.bpl")
+	if len(files) == 0 {
+		t.Fatal("no formats")
+	}
+	for _, file := range files {
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := Source(src)
+		if err != nil {
+			t.Fatal(file, err)
+		}
+		out2, err := Source(out)
+		if err != nil || string(out2) != string(out) {
+			t.Fatal(file, "isn't idempotent:", err)
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
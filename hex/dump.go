@@ -0,0 +1,63 @@
+package hex
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Dump writes `hexdump -C` style dump of b, which is at offset `base` of the input.
+// The result can be reverted by Undump.
+//
+func Dump(w io.Writer, b []byte, base int64) {
+
+	DumpAt(w, b, base, -1, "")
+}
+
+// DumpAt writes `hexdump -C` style dump of b, which is at offset `base` of the input,
+// and marks the byte at offset `at` with `note` in the line below it. If `at` is the
+// end of b, the position after the last byte is marked. The result can still be
+// reverted by Undump.
+//
+func DumpAt(w io.Writer, b []byte, base, at int64, note string) {
+
+	var line bytes.Buffer
+	for i := 0; i < len(b); i += 16 {
+		row := b[i:]
+		if len(row) > 16 {
+			row = row[:16]
+		}
+		line.Reset()
+		fmt.Fprintf(&line, "%08x  ", base+int64(i))
+		for j := 0; j < 16; j++ {
+			if j == 8 {
+				line.WriteByte(' ')
+			}
+			if j < len(row) {
+				fmt.Fprintf(&line, "%02x ", row[j])
+			} else {
+				line.WriteString("   ")
+			}
+		}
+		line.WriteString(" |")
+		for _, c := range row {
+			if c < 32 || c > 126 {
+				c = '.'
+			}
+			line.WriteByte(c)
+		}
+		line.WriteString("|\n")
+
+		if j := at - base - int64(i); j >= 0 && (j < int64(len(row)) || j == int64(len(row)) && at == base+int64(len(b))) {
+			col := 10 + 3*int(j)
+			if j >= 8 {
+				col++
+			}
+			line.Write(bytes.Repeat([]byte{' '}, col))
+			line.WriteString("^^ ")
+			line.WriteString(note)
+			line.WriteByte('\n')
+		}
+		w.Write(line.Bytes())
+	}
+}
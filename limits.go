@@ -0,0 +1,215 @@
+package bpl
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrMaxBytes is returned when matching consumes more bytes than Limits.MaxBytes.
+	ErrMaxBytes = errors.New("too many bytes consumed")
+
+	// ErrMaxNodes is returned when matching result has more nodes than Limits.MaxNodes.
+	ErrMaxNodes = errors.New("too many nodes of matching result")
+
+	// ErrMaxRecordTime is returned when matching a record takes longer than
+	// Limits.MaxRecordTime.
+	ErrMaxRecordTime = errors.New("matching a record takes too long")
+
+	// ErrMaxDecodedBytes is returned when a Decode rule decodes more bytes than
+	// Limits.MaxDecodedBytes.
+	ErrMaxDecodedBytes = errors.New("decoded data exceeds the limit")
+)
+
+// DefaultMaxDecodedBytes is the default of Limits.MaxDecodedBytes.
+//
+const DefaultMaxDecodedBytes = 64 << 20
+
+// -----------------------------------------------------------------------------
+
+// Limits represents resource limits of matching. Zero means no limit.
+//
+type Limits struct {
+	// MaxBytes is the maximum bytes consumed from the input stream.
+	MaxBytes int64
+
+	// MaxNodes is the maximum nodes (struct members and array elements) of matching
+	// result of a record (see Stats), or of the whole input if it has no records.
+	MaxNodes int
+
+	// MaxRecordTime is the maximum wall time of matching a record, that is, an element
+	// of the outermost repetition rule, eg. `Message` of `doc = *(Message dump)`. Time
+	// waiting for the first byte of a record isn't counted.
+	MaxRecordTime time.Duration
+
+	// MaxDecodedBytes is the maximum bytes decoded by a Decode rule (eg. `gunzip R`), to
+	// defend against zip bombs. Unlike other limits, zero means DefaultMaxDecodedBytes.
+	MaxDecodedBytes int64
+}
+
+// A LimitError is returned when matching is canceled (see MatchContext), or exceeds a
+// limit of the matching context (see Context.SetLimits). Unlike errors of matching
+// failures, it isn't wrapped by the rule where it occurs.
+//
+type LimitError struct {
+	Pos
+	Err error // ErrMaxBytes, ErrMaxNodes, ErrMaxRecordTime or error of context.Context
+}
+
+func (p *LimitError) Error() string {
+
+	return fmt.Sprintf("%v at %v", p.Err, &p.Pos)
+}
+
+// Unwrap returns the limit exceeded, or error of context.Context if it's canceled.
+//
+func (p *LimitError) Unwrap() error {
+
+	return p.Err
+}
+
+// IsLimitError returns if err is a LimitError, that is, matching is canceled or
+// exceeds a limit rather than fails.
+//
+func IsLimitError(err error) bool {
+
+	var e *LimitError
+	return errors.As(err, &e)
+}
+
+type limitState struct {
+	Limits
+	c     context.Context // nil: not matched by MatchContext
+	in    *bufio.Reader   // the top-level input stream
+	base  int64
+	nodes int       // nodes of the current record
+	start time.Time // when the current record starts
+}
+
+// -----------------------------------------------------------------------------
+
+// SetLimits sets resource limits of matching. If a limit is exceeded, matching fails
+// with a LimitError.
+//
+func (p *Context) SetLimits(lim Limits) {
+
+	p.limits().Limits = lim
+}
+
+func (p *Context) limits() *limitState {
+
+	st := p.st
+	if st.lim == nil {
+		st.lim = &limitState{start: time.Now()}
+	}
+	return st.lim
+}
+
+// MatchContext is the same as MatchStream, except that matching is canceled when `c`
+// is done. Cancellation is checked between rules, so a rule blocked on reading `in`
+// isn't interrupted until it returns (eg. the underlying connection is closed).
+//
+func MatchContext(c context.Context, r Ruler, in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	if c.Done() == nil { // never canceled, eg. context.Background()
+		return MatchStream(r, in, ctx)
+	}
+	lim := ctx.limits()
+	old := lim.c
+	lim.c = c
+	defer func() {
+		lim.c = old
+	}()
+	if err = ctx.check(in); err != nil {
+		return
+	}
+	return MatchStream(r, in, ctx)
+}
+
+// top records the top-level input stream, so bytes consumed from it can be limited,
+// and offsets of matching results can be tracked.
+//
+func (p *Context) top(in *bufio.Reader) {
+
+	if p.st.in == nil {
+		p.st.in = in
+	}
+	if lim := p.st.lim; lim != nil && lim.in == nil {
+		lim.in, lim.base = in, p.Tell(in)
+	}
+}
+
+// maxDecodedBytes returns the maximum bytes decoded by a Decode rule.
+//
+func (p *Context) maxDecodedBytes() int64 {
+
+	if lim := p.st.lim; lim != nil && lim.MaxDecodedBytes > 0 {
+		return lim.MaxDecodedBytes
+	}
+	return DefaultMaxDecodedBytes
+}
+
+// check returns a LimitError if matching is canceled or exceeds a limit. It's called
+// between rules.
+//
+func (p *Context) check(in *bufio.Reader) error {
+
+	lim := p.st.lim
+	if lim == nil {
+		return nil
+	}
+	if lim.c != nil {
+		if err := lim.c.Err(); err != nil {
+			return p.limitError(in, err)
+		}
+	}
+	if lim.MaxBytes > 0 && lim.in != nil && lim.base >= 0 {
+		if p.Tell(lim.in)-lim.base > lim.MaxBytes {
+			return p.limitError(in, ErrMaxBytes)
+		}
+	}
+	if lim.MaxRecordTime > 0 && time.Since(lim.start) > lim.MaxRecordTime {
+		return p.limitError(in, ErrMaxRecordTime)
+	}
+	return nil
+}
+
+// addNode counts a node of matching result.
+//
+func (p *Context) addNode(in *bufio.Reader) error {
+
+	lim := p.st.lim
+	if lim == nil {
+		return nil
+	}
+	lim.nodes++
+	if lim.MaxNodes > 0 && lim.nodes > lim.MaxNodes {
+		return p.limitError(in, ErrMaxNodes)
+	}
+	return nil
+}
+
+// beginRecord is called when a record starts.
+//
+func (p *Context) beginRecord(in *bufio.Reader) error {
+
+	lim := p.st.lim
+	if lim == nil {
+		return nil
+	}
+	if lim.MaxRecordTime > 0 {
+		lim.start = time.Now()
+	}
+	lim.nodes = 0
+	return p.check(in)
+}
+
+func (p *Context) limitError(in *bufio.Reader, err error) error {
+
+	return &LimitError{Pos: p.position(in), Err: err}
+}
+
+// -----------------------------------------------------------------------------
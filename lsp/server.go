@@ -0,0 +1,415 @@
+package lsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	bpl "qiniu.com/bpl/bpl.ext"
+)
+
+// -----------------------------------------------------------------------------
+
+type document struct {
+	uri  string
+	text string
+	mod  *bpl.Module // result of the last successful parsing
+}
+
+// A Server is a language server of bpl. It talks JSON-RPC with the client (an
+// editor) over a pair of streams, eg. stdin and stdout.
+//
+type Server struct {
+	out      io.Writer
+	docs     map[string]*document
+	shutdown bool
+}
+
+// NewServer returns a new language server.
+//
+func NewServer() *Server {
+
+	return &Server{docs: make(map[string]*document)}
+}
+
+// Serve serves requests read from `r`, and writes responses and notifications into
+// `w`. It returns nil after the `exit` notification is received.
+//
+func (p *Server) Serve(r io.Reader, w io.Writer) (err error) {
+
+	in := bufio.NewReader(r)
+	p.out = w
+	for {
+		b, err := readMessage(in)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		var req request
+		if err = json.Unmarshal(b, &req); err != nil {
+			p.reply(nil, nil, &responseError{codeParseError, err.Error()})
+			continue
+		}
+		if req.Method == "exit" {
+			return nil
+		}
+		result, rerr := p.handle(&req)
+		if req.ID != nil {
+			p.reply(req.ID, result, rerr)
+		}
+	}
+}
+
+func (p *Server) reply(id *json.RawMessage, result interface{}, rerr *responseError) {
+
+	writeMessage(p.out, &response{JSONRPC: "2.0", ID: id, Result: result, Error: rerr})
+}
+
+func (p *Server) notify(method string, params interface{}) {
+
+	writeMessage(p.out, &notification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+func (p *Server) handle(req *request) (result interface{}, rerr *responseError) {
+
+	defer func() {
+		if e := recover(); e != nil {
+			rerr = &responseError{codeInternalError, fmt.Sprint(e)}
+		}
+	}()
+
+	unmarshal := func(v interface{}) bool {
+		if err := json.Unmarshal(req.Params, v); err != nil {
+			rerr = &responseError{codeInvalidParams, err.Error()}
+			return false
+		}
+		return true
+	}
+
+	switch req.Method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync": map[string]interface{}{
+					"openClose": true,
+					"change":    1, // full
+					"save":      map[string]interface{}{"includeText": true},
+				},
+				"definitionProvider":     true,
+				"hoverProvider":          true,
+				"documentSymbolProvider": true,
+				"completionProvider": map[string]interface{}{
+					"triggerCharacters": []string{"."},
+				},
+			},
+			"serverInfo": map[string]interface{}{"name": "qbpl-lsp"},
+		}, nil
+	case "initialized", "$/cancelRequest", "workspace/didChangeConfiguration":
+		return
+	case "shutdown":
+		p.shutdown = true
+		return
+	case "textDocument/didOpen":
+		var params didOpenParams
+		if unmarshal(&params) {
+			doc := &document{uri: params.TextDocument.URI, text: params.TextDocument.Text}
+			p.docs[doc.uri] = doc
+			p.diagnose(doc)
+		}
+	case "textDocument/didChange":
+		var params didChangeParams
+		if unmarshal(&params) {
+			if doc, ok := p.docs[params.TextDocument.URI]; ok {
+				if n := len(params.ContentChanges); n > 0 {
+					doc.text = params.ContentChanges[n-1].Text
+				}
+				p.diagnose(doc)
+			}
+		}
+	case "textDocument/didSave":
+		var params didSaveParams
+		if unmarshal(&params) {
+			if doc, ok := p.docs[params.TextDocument.URI]; ok {
+				if params.Text != nil {
+					doc.text = *params.Text
+				}
+				p.diagnose(doc)
+			}
+		}
+	case "textDocument/didClose":
+		var params didSaveParams
+		if unmarshal(&params) {
+			delete(p.docs, params.TextDocument.URI)
+			p.notify("textDocument/publishDiagnostics", &publishDiagnosticsParams{
+				URI: params.TextDocument.URI, Diagnostics: []diagnostic{},
+			})
+		}
+	case "textDocument/definition":
+		var params textDocumentPositionParams
+		if unmarshal(&params) {
+			if doc, ok := p.docs[params.TextDocument.URI]; ok {
+				return doc.definition(params.Position), nil
+			}
+		}
+	case "textDocument/hover":
+		var params textDocumentPositionParams
+		if unmarshal(&params) {
+			if doc, ok := p.docs[params.TextDocument.URI]; ok {
+				return doc.hover(params.Position), nil
+			}
+		}
+	case "textDocument/completion":
+		var params textDocumentPositionParams
+		if unmarshal(&params) {
+			if doc, ok := p.docs[params.TextDocument.URI]; ok {
+				return doc.completion(params.Position), nil
+			}
+		}
+	case "textDocument/documentSymbol":
+		var params didSaveParams
+		if unmarshal(&params) {
+			if doc, ok := p.docs[params.TextDocument.URI]; ok {
+				return doc.symbols(), nil
+			}
+		}
+	default:
+		if req.ID != nil {
+			rerr = &responseError{codeMethodNotFound, "method not found: " + req.Method}
+		}
+	}
+	return
+}
+
+// -----------------------------------------------------------------------------
+
+func pathOf(uri string) string {
+
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	return u.Path
+}
+
+func isIdentChar(c byte) bool {
+
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func (p *document) line(n int) string {
+
+	lines := strings.Split(p.text, "\n")
+	if n < 0 || n >= len(lines) {
+		return ""
+	}
+	return strings.TrimRight(lines[n], "\r")
+}
+
+// wordAt returns the identifier at `pos` and where it starts.
+//
+func (p *document) wordAt(pos position) (word string, start int) {
+
+	line := p.line(pos.Line)
+	start, end := pos.Character, pos.Character
+	if end > len(line) {
+		start, end = len(line), len(line)
+	}
+	for start > 0 && isIdentChar(line[start-1]) {
+		start--
+	}
+	for end < len(line) && isIdentChar(line[end]) {
+		end++
+	}
+	return line[start:end], start
+}
+
+func (p *document) rangeOf(line, column, n int) textRange {
+
+	if line <= 0 {
+		return textRange{}
+	}
+	if n == 0 {
+		text := p.line(line - 1)
+		for i := column - 1; i < len(text) && isIdentChar(text[i]); i++ {
+			n++
+		}
+		if n == 0 {
+			n = 1
+		}
+	}
+	start := position{line - 1, column - 1}
+	return textRange{start, position{line - 1, column - 1 + n}}
+}
+
+func (p *document) diagnostics(err error) []diagnostic {
+
+	diags := []diagnostic{}
+	errs, ok := err.(bpl.ErrorList)
+	if !ok {
+		if err != nil {
+			diags = append(diags, diagnostic{Severity: 1, Source: "bpl", Message: err.Error()})
+		}
+		return diags
+	}
+	for _, e := range errs {
+		msg := e.Msg
+		if len(e.Suggestions) > 0 {
+			msg += ", did you mean `" + strings.Join(e.Suggestions, "`, `") + "`?"
+		}
+		diags = append(diags, diagnostic{
+			Range:    p.rangeOf(e.Line, e.Column, 0),
+			Severity: 1,
+			Source:   "bpl",
+			Message:  msg,
+		})
+	}
+	return diags
+}
+
+func (p *Server) diagnose(doc *document) {
+
+	mod, err := bpl.Analyze([]byte(doc.text), pathOf(doc.uri))
+	if mod != nil {
+		doc.mod = mod
+	}
+	p.notify("textDocument/publishDiagnostics", &publishDiagnosticsParams{
+		URI: doc.uri, Diagnostics: doc.diagnostics(err),
+	})
+}
+
+func (p *document) lookup(name string) (sym bpl.Symbol, ok bool) {
+
+	if p.mod == nil {
+		return
+	}
+	for _, sym = range p.mod.Symbols() {
+		if sym.Name == name {
+			return sym, true
+		}
+	}
+	return
+}
+
+func (p *document) definition(pos position) interface{} {
+
+	word, _ := p.wordAt(pos)
+	sym, ok := p.lookup(word)
+	if !ok {
+		return nil
+	}
+	return &location{URI: p.uri, Range: p.rangeOf(sym.Pos.Line, sym.Pos.Column, len(sym.Name))}
+}
+
+func (p *document) hover(pos position) interface{} {
+
+	word, start := p.wordAt(pos)
+	if word == "" || p.mod == nil {
+		return nil
+	}
+
+	var b bytes.Buffer
+	sym, isSym := p.lookup(word)
+	if isSym && sym.Kind != bpl.RuleSymbol {
+		if sym.Kind == bpl.GlobalSymbol {
+			fmt.Fprintf(&b, "global variable `%s`", word)
+		} else {
+			v, _ := p.mod.Const(word)
+			fmt.Fprintf(&b, "const `%s` = %v", word, v)
+		}
+	} else if r, ok := p.mod.Rule(word); ok {
+		kind := "builtin type"
+		if isSym {
+			kind = "rule"
+		}
+		fmt.Fprintf(&b, "%s `%s`\n\n", kind, word)
+		func() {
+			defer func() {
+				if recover() != nil {
+					b.WriteString("sizeof: unknown\n\ntype: unknown")
+				}
+			}()
+			if n := r.Impl.SizeOf(); n >= 0 {
+				fmt.Fprintf(&b, "sizeof: %d\n\n", n)
+			} else {
+				b.WriteString("sizeof: variable\n\n")
+			}
+			fmt.Fprintf(&b, "type: `%v`", r.Impl.RetType())
+		}()
+	} else {
+		return nil
+	}
+	rg := textRange{position{pos.Line, start}, position{pos.Line, start + len(word)}}
+	return &hover{Contents: markupContent{Kind: "markdown", Value: b.String()}, Range: &rg}
+}
+
+func (p *document) completion(pos position) []completionItem {
+
+	items := []completionItem{}
+	_, start := p.wordAt(pos)
+	line := p.line(pos.Line)
+	if start > 0 && start <= len(line) && line[start-1] == '.' {
+		mod, _ := p.wordAt(position{pos.Line, start - 1})
+		for _, name := range bpl.ModuleExports(mod) {
+			items = append(items, completionItem{Label: name, Kind: completionFunction, Detail: mod + "." + name})
+		}
+		return items
+	}
+
+	if p.mod != nil {
+		for _, sym := range p.mod.Symbols() {
+			switch sym.Kind {
+			case bpl.RuleSymbol:
+				items = append(items, completionItem{Label: sym.Name, Kind: completionStruct, Detail: "rule"})
+			case bpl.ConstSymbol:
+				items = append(items, completionItem{Label: sym.Name, Kind: completionConstant, Detail: "const"})
+			case bpl.GlobalSymbol:
+				items = append(items, completionItem{Label: sym.Name, Kind: completionVariable, Detail: "global"})
+			}
+		}
+	}
+	for _, name := range bpl.Builtins() {
+		items = append(items, completionItem{Label: name, Kind: completionStruct, Detail: "builtin type"})
+	}
+	for _, name := range bpl.Modules() {
+		items = append(items, completionItem{Label: name, Kind: completionModule, Detail: "qlang module"})
+	}
+	for _, name := range bpl.Keywords() {
+		items = append(items, completionItem{Label: name, Kind: completionKeyword})
+	}
+	return items
+}
+
+func (p *document) symbols() []documentSymbol {
+
+	syms := []documentSymbol{}
+	if p.mod == nil {
+		return syms
+	}
+	for _, sym := range p.mod.Symbols() {
+		kind, detail := symbolStruct, "rule"
+		switch sym.Kind {
+		case bpl.ConstSymbol:
+			kind, detail = symbolConstant, "const"
+		case bpl.GlobalSymbol:
+			kind, detail = symbolVariable, "global"
+		}
+		start := position{sym.Pos.Line - 1, sym.Pos.Column - 1}
+		end := position{sym.End.Line - 1, sym.End.Column - 1}
+		syms = append(syms, documentSymbol{
+			Name:           sym.Name,
+			Detail:         detail,
+			Kind:           kind,
+			Range:          textRange{start, end},
+			SelectionRange: p.rangeOf(sym.Pos.Line, sym.Pos.Column, len(sym.Name)),
+		})
+	}
+	return syms
+}
+
+// -----------------------------------------------------------------------------
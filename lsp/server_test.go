@@ -0,0 +1,173 @@
+package lsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// -----------------------------------------------------------------------------
+
+const codeSpec = `const (
+	MAGIC = 0x1234
+)
+
+header = {
+	magic uint16be
+	n     uint8
+}
+
+doc = {
+	global count = 0
+	hdr header
+	body [hdr.n]char
+	x   hedaer
+}
+`
+
+type message struct {
+	ID     *int            `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *responseError  `json:"error"`
+}
+
+func TestServer(t *testing.T) {
+
+	var in bytes.Buffer
+	id := 0
+	send := func(method string, params interface{}, isRequest bool) {
+		msg := map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params}
+		if isRequest {
+			id++
+			msg["id"] = id
+		}
+		writeMessage(&in, msg)
+	}
+	uri := "file:///tmp/test.bpl"
+	doc := map[string]interface{}{"uri": uri}
+	at := func(line, char int) map[string]interface{} {
+		return map[string]interface{}{
+			"textDocument": doc,
+			"position":     map[string]interface{}{"line": line, "character": char},
+		}
+	}
+
+	send("initialize", map[string]interface{}{}, true)
+	send("initialized", map[string]interface{}{}, false)
+	send("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri, "version": 1, "text": codeSpec},
+	}, false)
+	send("textDocument/definition", at(11, 7), true) // header
+	send("textDocument/hover", at(5, 10), true)      // uint16be
+	send("textDocument/hover", at(11, 6), true)      // header
+	send("textDocument/completion", at(12, 7), true) // [
+	send("textDocument/documentSymbol", map[string]interface{}{"textDocument": doc}, true)
+	send("textDocument/definition", at(10, 10), true) // count
+	send("textDocument/didChange", map[string]interface{}{
+		"textDocument":   map[string]interface{}{"uri": uri, "version": 2},
+		"contentChanges": []interface{}{map[string]interface{}{"text": strings.Replace(codeSpec, "hedaer", "header", 1)}},
+	}, false)
+	send("shutdown", nil, true)
+	send("exit", nil, false)
+
+	var out bytes.Buffer
+	err := NewServer().Serve(&in, &out)
+	if err != nil {
+		t.Fatal("Serve failed:", err)
+	}
+
+	var msgs []message
+	r := bufio.NewReader(&out)
+	for {
+		b, err := readMessage(r)
+		if err != nil {
+			break
+		}
+		var msg message
+		if err = json.Unmarshal(b, &msg); err != nil {
+			t.Fatal("json.Unmarshal failed:", err)
+		}
+		if msg.Error != nil {
+			t.Fatal("error:", msg.Error.Message)
+		}
+		msgs = append(msgs, msg)
+	}
+	if len(msgs) != 10 {
+		t.Fatal("messages:", len(msgs))
+	}
+
+	var diags publishDiagnosticsParams
+	json.Unmarshal(msgs[1].Params, &diags)
+	if msgs[1].Method != "textDocument/publishDiagnostics" || len(diags.Diagnostics) != 1 {
+		t.Fatal("diagnostics:", string(msgs[1].Params))
+	}
+	d := diags.Diagnostics[0]
+	if d.Range.Start != (position{13, 5}) || d.Range.End != (position{13, 11}) ||
+		!strings.Contains(d.Message, "did you mean `header`?") {
+		t.Fatal("diagnostic:", d)
+	}
+
+	var loc location
+	json.Unmarshal(msgs[2].Result, &loc)
+	if loc.URI != uri || loc.Range.Start != (position{4, 0}) || loc.Range.End != (position{4, 6}) {
+		t.Fatal("definition:", string(msgs[2].Result))
+	}
+
+	var h hover
+	json.Unmarshal(msgs[3].Result, &h)
+	if !strings.Contains(h.Contents.Value, "builtin type `uint16be`") || !strings.Contains(h.Contents.Value, "sizeof: 2") {
+		t.Fatal("hover:", h.Contents.Value)
+	}
+	json.Unmarshal(msgs[4].Result, &h)
+	if !strings.Contains(h.Contents.Value, "rule `header`") || !strings.Contains(h.Contents.Value, "sizeof: 3") {
+		t.Fatal("hover:", h.Contents.Value)
+	}
+
+	var items []completionItem
+	json.Unmarshal(msgs[5].Result, &items)
+	labels := make(map[string]bool)
+	for _, item := range items {
+		labels[item.Label] = true
+	}
+	if !labels["header"] || !labels["uint32be"] || !labels["strings"] || !labels["MAGIC"] {
+		t.Fatal("completion:", string(msgs[5].Result))
+	}
+
+	var syms []documentSymbol
+	json.Unmarshal(msgs[6].Result, &syms)
+	if len(syms) != 4 || syms[0].Name != "MAGIC" || syms[1].Name != "header" || syms[1].Range.End.Line != 7 {
+		t.Fatal("symbols:", string(msgs[6].Result))
+	}
+
+	json.Unmarshal(msgs[7].Result, &loc)
+	if loc.Range.Start != (position{10, 8}) {
+		t.Fatal("definition of global:", string(msgs[7].Result))
+	}
+
+	diags = publishDiagnosticsParams{}
+	json.Unmarshal(msgs[8].Params, &diags)
+	if msgs[8].Method != "textDocument/publishDiagnostics" || diags.Diagnostics == nil || len(diags.Diagnostics) != 0 {
+		t.Fatal("diagnostics after change:", string(msgs[8].Params))
+	}
+}
+
+func TestCompletionOfModule(t *testing.T) {
+
+	doc := &document{text: "doc = {\n\tlet a = strings.\n}\n"}
+	items := doc.completion(position{1, 17})
+	found := false
+	for _, item := range items {
+		if item.Label == "contains" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("completion:", items)
+	}
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,216 @@
+package lz4
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// -----------------------------------------------------------------------------
+
+var (
+	// ErrMagic is returned when the stream doesn't begin with the magic number of
+	// the LZ4 frame format.
+	ErrMagic = errors.New("lz4: invalid magic number")
+
+	// ErrHeader is returned when the frame descriptor is invalid.
+	ErrHeader = errors.New("lz4: invalid frame descriptor")
+
+	// ErrCorrupt is returned when a compressed block is corrupt.
+	ErrCorrupt = errors.New("lz4: corrupt block")
+)
+
+const (
+	frameMagic = 0x184d2204
+	windowSize = 64 << 10
+)
+
+// DecodeBlock decodes a LZ4 compressed block `src`, and appends the result to
+// `dst`. Matches of the block may refer to bytes of `dst`.
+//
+func DecodeBlock(dst, src []byte, maxSize int) ([]byte, error) {
+
+	limit := len(dst) + maxSize
+	for i := 0; i < len(src); {
+		token := src[i]
+		i++
+		n := int(token >> 4)
+		if n == 15 {
+			for {
+				if i >= len(src) {
+					return dst, ErrCorrupt
+				}
+				c := src[i]
+				i++
+				n += int(c)
+				if c != 255 {
+					break
+				}
+			}
+		}
+		if n > len(src)-i || len(dst)+n > limit {
+			return dst, ErrCorrupt
+		}
+		dst = append(dst, src[i:i+n]...)
+		i += n
+		if i == len(src) { // the last sequence has literals only
+			break
+		}
+
+		if i+2 > len(src) {
+			return dst, ErrCorrupt
+		}
+		off := int(src[i]) | int(src[i+1])<<8
+		i += 2
+		m := int(token&15) + 4
+		if token&15 == 15 {
+			for {
+				if i >= len(src) {
+					return dst, ErrCorrupt
+				}
+				c := src[i]
+				i++
+				m += int(c)
+				if c != 255 {
+					break
+				}
+			}
+		}
+		if off == 0 || off > len(dst) || len(dst)+m > limit {
+			return dst, ErrCorrupt
+		}
+		pos := len(dst) - off
+		for j := 0; j < m; j++ { // a match may overlap its own output
+			dst = append(dst, dst[pos+j])
+		}
+	}
+	return dst, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// A Reader decompresses a stream in the LZ4 frame format. It never reads beyond
+// the end of the frame. Checksums of the frame are skipped, not verified.
+//
+type Reader struct {
+	r          io.Reader
+	indep      bool // blocks are independent
+	blockSum   bool
+	contentSum bool
+	maxBlock   int
+	buf        []byte // history window and the decoded block
+	pos        int    // bytes of buf that have been read
+	src        []byte
+	err        error
+}
+
+// NewReader returns a Reader reading the LZ4 frame from r.
+//
+func NewReader(r io.Reader) (*Reader, error) {
+
+	p := &Reader{r: r}
+	if err := p.readHeader(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Reader) readHeader() (err error) {
+
+	var b [13]byte
+	if _, err = io.ReadFull(p.r, b[:4]); err != nil {
+		return
+	}
+	if binary.LittleEndian.Uint32(b[:4]) != frameMagic {
+		return ErrMagic
+	}
+	if _, err = io.ReadFull(p.r, b[:2]); err != nil {
+		return
+	}
+	flg, bd := b[0], b[1]
+	if flg>>6 != 1 || flg&0x02 != 0 || bd&0x8f != 0 || bd>>4 < 4 {
+		return ErrHeader
+	}
+	p.indep = flg&0x20 != 0
+	p.blockSum = flg&0x10 != 0
+	p.contentSum = flg&0x04 != 0
+	p.maxBlock = 1 << (8 + 2*uint(bd>>4))
+
+	n := 1 // header checksum
+	if flg&0x08 != 0 {
+		n += 8 // content size
+	}
+	if flg&0x01 != 0 {
+		n += 4 // dictionary id
+	}
+	_, err = io.ReadFull(p.r, b[:n])
+	return
+}
+
+func (p *Reader) readBlock() (err error) {
+
+	var b [4]byte
+	if _, err = io.ReadFull(p.r, b[:]); err != nil {
+		return
+	}
+	size := binary.LittleEndian.Uint32(b[:])
+	if size == 0 { // end mark
+		if p.contentSum {
+			if _, err = io.ReadFull(p.r, b[:]); err != nil {
+				return
+			}
+		}
+		return io.EOF
+	}
+
+	raw := size&0x80000000 != 0
+	size &= 0x7fffffff
+	if int(size) > p.maxBlock {
+		return ErrCorrupt
+	}
+	if cap(p.src) < int(size) {
+		p.src = make([]byte, size)
+	}
+	src := p.src[:size]
+	if _, err = io.ReadFull(p.r, src); err != nil {
+		return
+	}
+	if p.blockSum {
+		if _, err = io.ReadFull(p.r, b[:]); err != nil {
+			return
+		}
+	}
+
+	if p.indep || len(p.buf) <= windowSize {
+		if p.indep {
+			p.buf = p.buf[:0]
+		}
+	} else {
+		n := copy(p.buf, p.buf[len(p.buf)-windowSize:])
+		p.buf = p.buf[:n]
+	}
+	p.pos = len(p.buf)
+	if raw {
+		p.buf = append(p.buf, src...)
+		return nil
+	}
+	p.buf, err = DecodeBlock(p.buf, src, p.maxBlock)
+	return
+}
+
+// Read reads decompressed bytes.
+//
+func (p *Reader) Read(b []byte) (n int, err error) {
+
+	for p.pos == len(p.buf) {
+		if p.err != nil {
+			return 0, p.err
+		}
+		p.err = p.readBlock()
+	}
+	n = copy(b, p.buf[p.pos:])
+	p.pos += n
+	return
+}
+
+// -----------------------------------------------------------------------------
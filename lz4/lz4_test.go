@@ -0,0 +1,62 @@
+package lz4
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// -----------------------------------------------------------------------------
+
+// lz4 -BD -BX --content-size
+const frameCLI = "04224d187c4060040000000000003241000000f10d6c696e6520303a2074686520717569636b2062726f776e20666f780a1c001f311c00081f321c00081f331c00081f341c00080f8c00ffffffba5020666f780a2944399d00000000f22516b0"
+
+func TestReader(t *testing.T) {
+
+	var expected bytes.Buffer
+	for i := 0; i < 40; i++ {
+		fmt.Fprintf(&expected, "line %d: the quick brown fox\n", i%5)
+	}
+
+	frame, _ := hex.DecodeString(frameCLI)
+	in := bytes.NewReader(append(frame, 'X'))
+	r, err := NewReader(in)
+	if err != nil {
+		t.Fatal("NewReader failed:", err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(b, expected.Bytes()) {
+		t.Fatal("ReadAll:", err, string(b))
+	}
+	if in.Len() != 1 {
+		t.Fatal("read beyond the frame:", in.Len())
+	}
+}
+
+func TestDependentBlocks(t *testing.T) {
+
+	frame := []byte{
+		0x04, 0x22, 0x4d, 0x18, 0x40, 0x40, 0x00, // magic, FLG, BD, HC
+		0x03, 0x00, 0x00, 0x80, 'a', 'b', 'c', // uncompressed block
+		0x03, 0x00, 0x00, 0x00, 0x05, 0x03, 0x00, // match of the previous block
+		0x00, 0x00, 0x00, 0x00, // end mark
+	}
+	r, err := NewReader(bytes.NewReader(frame))
+	if err != nil {
+		t.Fatal("NewReader failed:", err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil || string(b) != strings.Repeat("abc", 4) {
+		t.Fatal("ReadAll:", err, string(b))
+	}
+
+	_, err = DecodeBlock(nil, []byte{0x05, 0x03, 0x00}, 64)
+	if err != ErrCorrupt {
+		t.Fatal("DecodeBlock:", err)
+	}
+}
+
+// -----------------------------------------------------------------------------
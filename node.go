@@ -0,0 +1,140 @@
+package bpl
+
+import (
+	"bufio"
+)
+
+// -----------------------------------------------------------------------------
+
+// A Node is a node of matching result with its position in the input stream. See
+// Context.TrackOffsets.
+//
+type Node struct {
+	Name     string      // name of the struct member, or "" (eg. an element of an array)
+	Value    interface{} // matching result, or partial matching result if it fails
+	Offset   int64       // where it starts in the input stream, or -1 if it's unknown
+	End      int64       // where it ends in the input stream, or -1 if it's unknown
+	Children []*Node     // members of a struct, or elements of an array, in matching order
+}
+
+// TrackOffsets enables tracking positions of matching results, which are returned by
+// Context.Node. Offsets are relative to the top-level input stream, that is, the
+// stream passed to MatchStream. Decoded bytes of `inflate R`, `gunzip R`, etc. are
+// other streams, so offsets of nodes inside R are -1. So are bytes of `eval <expr> do
+// R`, unless <expr> is a member of bytes, eg. `eval _body do R`.
+//
+func (p *Context) TrackOffsets() {
+
+	p.st.nodes = true
+}
+
+// Node returns matching result of the context (see Dom) with positions of its members
+// or elements. It returns nil if offsets aren't tracked (see TrackOffsets), or nothing
+// is matched.
+//
+func (p *Context) Node() *Node {
+
+	return p.node
+}
+
+// Offset returns current offset of `in` in the top-level input stream, or -1 if `in`
+// is another stream (see TrackOffsets).
+//
+func (p *Context) Offset(in *bufio.Reader) int64 {
+
+	st := p.st
+	if in == st.in {
+		return p.Tell(in)
+	}
+	if delta, ok := st.deltas[in]; ok {
+		if off := p.Tell(in); off >= 0 {
+			return off + delta
+		}
+	}
+	return -1
+}
+
+// track records that offsets of `in` are offsets of `parent` (a window of it, see
+// `read`), or offsets from `base` if parent is nil (bytes of `eval <expr> do R`).
+// It returns a function to forget `in`.
+//
+func (p *Context) track(in, parent *bufio.Reader, base int64) func() {
+
+	st := p.st
+	if !st.nodes {
+		return func() {}
+	}
+	if parent != nil {
+		if parent == st.in {
+			base = 0
+		} else if delta, ok := st.deltas[parent]; ok {
+			base = delta
+		} else {
+			base = -1
+		}
+	}
+	if base < 0 {
+		return func() {}
+	}
+	if st.deltas == nil {
+		st.deltas = make(map[*bufio.Reader]int64)
+	}
+	st.deltas[in] = base
+	return func() {
+		delete(st.deltas, in)
+	}
+}
+
+// bytesOffset returns offset of b in the top-level input stream if b is a matching
+// result of the context or its ancestors (eg. `_body` of `eval _body do R`), or -1.
+//
+func (p *Context) bytesOffset(b []byte) int64 {
+
+	if len(b) == 0 || !p.st.nodes {
+		return -1
+	}
+	for ctx := p; ctx != nil; ctx = ctx.Parent {
+		if ctx.node == nil {
+			continue
+		}
+		for _, child := range ctx.node.Children {
+			if v, ok := child.Value.([]byte); ok && len(v) >= len(b) && &v[0] == &b[0] {
+				return child.Offset
+			}
+		}
+	}
+	return -1
+}
+
+// beginNode returns a new node of the matching result of `sub` if offsets are tracked.
+//
+func (p *Context) beginNode(in *bufio.Reader, sub *Context, name string) *Node {
+
+	if !p.st.nodes {
+		return nil
+	}
+	node := &Node{Name: name, Offset: p.Offset(in)}
+	sub.node = node
+	return node
+}
+
+// endNode adds `node` returned by beginNode to children of the context's node.
+//
+func (p *Context) endNode(in *bufio.Reader, node *Node, v interface{}) {
+
+	if node == nil {
+		return
+	}
+	node.Value, node.End = v, p.Offset(in)
+	parent := p.node
+	if parent == nil { // eg. a record of `doc = *(Message dump)`
+		parent = &Node{Offset: node.Offset}
+		p.node = parent
+	}
+	if node.End > parent.End {
+		parent.End = node.End
+	}
+	parent.Children = append(parent.Children, node)
+}
+
+// -----------------------------------------------------------------------------
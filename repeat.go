@@ -8,47 +8,112 @@ import (
 
 // -----------------------------------------------------------------------------
 
-func directRepeat(R Ruler, in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+// Stats represents statistics of matching. See Context.Stats.
+//
+type Stats struct {
+	// Records is the number of records matched, that is, elements of the outermost
+	// repetition rule, eg. `Message` of `doc = *(Message dump)` or `msgs *Message`.
+	// Repetition rules matching bytes of `read`, `eval` or `decode` don't count.
+	Records int
 
-	_, err = R.Match(in, ctx)
-	if err != nil {
+	// Ended reports whether the input ends at a record boundary, that is, the
+	// outermost repetition rule matches until EOF.
+	Ended bool
+}
+
+// Stats returns statistics of matching. If the input ends inside a record, matching
+// fails with an ErrTruncated, which reports the record and its partial result.
+//
+func (p *Context) Stats() Stats {
+
+	st := p.st
+	return Stats{Records: st.records, Ended: st.ended}
+}
+
+// beginRepeat is called before a repetition rule matches `in`. It returns if elements
+// of the rule are records, that is, the rule is the outermost one, and matches the
+// top-level input stream.
+//
+func (p *Context) beginRepeat(in *bufio.Reader) (rec bool) {
+
+	st := p.st
+	st.repeats++
+	return st.repeats == 1 && in == st.in
+}
+
+// endRepeat is called after a repetition rule matches. `ended` is true if it matches
+// until EOF.
+//
+func (p *Context) endRepeat(rec, ended bool) {
+
+	st := p.st
+	st.repeats--
+	if rec {
+		st.ended = ended
+	}
+}
+
+// matchElem matches the i-th element of a repetition rule by R with `sub`, which is
+// the context of the element.
+//
+func (p *Context) matchElem(R Ruler, in *bufio.Reader, sub *Context, i int, rec bool) (v interface{}, err error) {
+
+	if !rec {
+		return R.Match(in, sub)
+	}
+	if err = p.beginRecord(in); err != nil {
 		return
 	}
-	for {
-		_, err = in.Peek(1)
-		if err != nil {
-			if err == io.EOF {
-				return nil, nil
-			}
-			return
-		}
-		_, err = R.Match(in, ctx)
-		if err != nil {
-			return
-		}
+	v, err = R.Match(in, sub)
+	if err != nil {
+		v = partialOf(v, sub)
+		p.st.failed, p.st.partial = i+1, v
+		return v, sub.inRecord(err, in, i, v)
 	}
+	p.st.records++
+	return
 }
 
-func repeat(R Ruler, in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+// inRecord reports that the input ends inside the i-th record, with its partial
+// matching result.
+//
+func (p *Context) inRecord(err error, in *bufio.Reader, i int, partial interface{}) error {
 
-	if _, ok := R.(*seq); ok {
-		return directRepeat(R, in, ctx)
+	e, ok := err.(*ErrTruncated)
+	if !ok {
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		e = &ErrTruncated{Pos: p.position(in), Needed: -1}
 	}
+	e.Record, e.Partial = i+1, partial
+	return e
+}
 
-	_, err = R.Match(in, ctx.NewSub())
-	if err != nil {
-		return
-	}
-	for {
-		_, err = in.Peek(1)
-		if err != nil {
-			if err == io.EOF {
-				return nil, nil
+// repeat matches R until EOF. The caller ensures that it isn't at EOF.
+//
+func repeat(R Ruler, in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	rec := ctx.beginRepeat(in)
+	defer func() {
+		ctx.endRepeat(rec, err == nil)
+	}()
+
+	_, direct := R.(*seq)
+	for i := 0; ; i++ {
+		if i > 0 {
+			if _, err = in.Peek(1); err != nil {
+				if err == io.EOF {
+					return nil, nil
+				}
+				return
 			}
-			return
 		}
-		_, err = R.Match(in, ctx.NewSub())
-		if err != nil {
+		sub := ctx
+		if !direct {
+			sub = ctx.NewSub()
+		}
+		if _, err = ctx.matchElem(R, in, sub, i, rec); err != nil {
 			return
 		}
 	}
@@ -65,6 +130,7 @@ func (p *repeat0) Match(in *bufio.Reader, ctx *Context) (v interface{}, err erro
 	_, err = in.Peek(1)
 	if err != nil {
 		if err == io.EOF {
+			ctx.endRepeat(ctx.beginRepeat(in), true)
 			return nil, nil
 		}
 		return
@@ -0,0 +1,416 @@
+package repl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"qiniu.com/bpl"
+	ext "qiniu.com/bpl/bpl.ext"
+	"qiniu.com/bpl/hex"
+	"qiniupkg.com/x/bufiox.v7"
+)
+
+// -----------------------------------------------------------------------------
+
+type definition struct {
+	name string
+	code string
+}
+
+// A Session represents an interactive session of exploring a binary file.
+//
+type Session struct {
+	data    []byte
+	off     int
+	base    string // code of the protocol file
+	defs    []definition
+	mod     *ext.Module
+	globals bpl.Globals
+	dom     interface{}
+	last    string // last matched rule
+	out     io.Writer
+}
+
+// NewSession returns a new Session that explores `data`. `code` is the initial
+// bpl source code (eg. the protocol file), and it can be empty.
+//
+func NewSession(data []byte, code string, out io.Writer) (s *Session, err error) {
+
+	s = &Session{data: data, base: code, globals: bpl.NewGlobals(), out: out}
+	s.globals.SetVar("BPL_SESSION", bpl.NewSession(0))
+	s.mod, err = ext.NewModule([]byte(code), "")
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Offset returns current offset of the session.
+//
+func (s *Session) Offset() int {
+
+	return s.off
+}
+
+// Dom returns the last matching result.
+//
+func (s *Session) Dom() interface{} {
+
+	return s.dom
+}
+
+// Source returns bpl source code of the session.
+//
+func (s *Session) Source() string {
+
+	var b bytes.Buffer
+	b.WriteString(s.base)
+	for _, def := range s.defs {
+		if b.Len() > 0 && !bytes.HasSuffix(b.Bytes(), []byte("\n\n")) {
+			b.WriteByte('\n')
+		}
+		b.WriteString(def.code)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// Save saves bpl source code of the session into a file.
+//
+func (s *Session) Save(fname string) error {
+
+	return ioutil.WriteFile(fname, []byte(s.Source()), 0666)
+}
+
+// Load replaces the protocol file of the session. Rules defined in the session
+// are kept.
+//
+func (s *Session) Load(fname string) (err error) {
+
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return
+	}
+	return s.compile(string(b), s.defs)
+}
+
+// Define defines (or redefines) a rule, eg. `header = {magic uint32; n uint16}`.
+//
+func (s *Session) Define(code string) (err error) {
+
+	code = strings.TrimSpace(code)
+	name := code
+	if m := reDefine.FindStringSubmatch(code); m != nil {
+		name = m[1]
+	}
+	defs := make([]definition, 0, len(s.defs)+1)
+	replaced := false
+	for _, def := range s.defs {
+		if def.name == name {
+			def.code, replaced = code, true
+		}
+		defs = append(defs, def)
+	}
+	if !replaced {
+		defs = append(defs, definition{name: name, code: code})
+	}
+	return s.compile(s.base, defs)
+}
+
+func (s *Session) compile(base string, defs []definition) (err error) {
+
+	old := s.defs
+	oldBase := s.base
+	s.base, s.defs = base, defs
+	mod, err := ext.NewModule([]byte(s.Source()), "")
+	if err != nil {
+		s.base, s.defs = oldBase, old
+		return
+	}
+	s.mod = mod
+	return
+}
+
+// Match matches rule `name` at current offset. It returns the matching result and
+// number of bytes matched. Current offset isn't changed.
+//
+func (s *Session) Match(name string) (dom interface{}, n int, err error) {
+
+	r, ok := s.mod.Rule(name)
+	if !ok {
+		return nil, 0, fmt.Errorf("rule `%s` not found", name)
+	}
+	s.last = name
+
+	rest := s.data[s.off:]
+	in := bufiox.NewReaderBuffer(rest)
+	ctx := ext.NewContext()
+	ctx.Globals = s.globals
+	dom, err = r.SafeMatch(in, ctx)
+	n = len(rest) - in.Buffered()
+	if err != nil {
+		return
+	}
+	s.dom = dom
+	return
+}
+
+// Step matches rule `name` at current offset and moves current offset forward.
+//
+func (s *Session) Step(name string) (dom interface{}, n int, err error) {
+
+	if s.off >= len(s.data) {
+		return nil, 0, io.EOF
+	}
+	dom, n, err = s.Match(name)
+	if err != nil {
+		return
+	}
+	s.off += n
+	return
+}
+
+// Seek moves current offset. `whence` is same as io.Seeker.
+//
+func (s *Session) Seek(offset int64, whence int) (ret int64, err error) {
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += int64(s.off)
+	case io.SeekEnd:
+		offset += int64(len(s.data))
+	default:
+		return 0, errors.New("repl.Session.Seek: invalid whence")
+	}
+	if offset < 0 || offset > int64(len(s.data)) {
+		return int64(s.off), fmt.Errorf("offset %d out of range [0, %d]", offset, len(s.data))
+	}
+	s.off = int(offset)
+	return offset, nil
+}
+
+// Eval evaluates a qlang expression. Variables of the expression are members of
+// the last matching result and global variables. The last matching result itself
+// is named `_`.
+//
+func (s *Session) Eval(expr string) (v interface{}, err error) {
+
+	e, err := ext.NewExpr(expr)
+	if err != nil {
+		return
+	}
+	vars := map[string]interface{}{"_": s.dom}
+	if dom, ok := s.dom.(map[string]interface{}); ok {
+		for k, v := range dom {
+			vars[k] = v
+		}
+	}
+	ctx := ext.NewContext()
+	ctx.Globals = s.globals
+	ctx.SetDom(vars)
+	return e.Eval(ctx)
+}
+
+// Hex writes hexdump of `n` bytes at current offset.
+//
+func (s *Session) Hex(w io.Writer, n int) {
+
+	end := s.off + n
+	if end > len(s.data) {
+		end = len(s.data)
+	}
+	hex.Dump(w, s.data[s.off:end], int64(s.off))
+}
+
+// -----------------------------------------------------------------------------
+
+var reDefine = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)\s*=[^=]`)
+
+// IsDefinition checks if a line defines a rule or constants.
+//
+func IsDefinition(line string) bool {
+
+	line = strings.TrimSpace(line)
+	return reDefine.MatchString(line) || strings.HasPrefix(line, "const") && strings.HasPrefix(strings.TrimSpace(line[5:]), "(")
+}
+
+// NeedMore checks if the bpl source code is incomplete (eg. braces aren't closed).
+//
+func NeedMore(code string) bool {
+
+	depth := 0
+	var quote byte
+	for i := 0; i < len(code); i++ {
+		c := code[i]
+		if quote != 0 {
+			if c == '\\' && quote != '`' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '"', '\'', '`':
+			quote = c
+		case '{', '(', '[':
+			depth++
+		case '}', ')', ']':
+			depth--
+		}
+	}
+	return depth > 0 || quote == '`'
+}
+
+const help = `Commands:
+  <name> = <rule>        define (or redefine) a rule, eg. header = {magic uint32be; n uint16}
+  const (...)            define constants
+  match, m <rule>        match <rule> at current offset, current offset isn't changed
+  step, s [<rule>] [<n>] match <rule> (default: last matched rule) n times and move forward
+  seek <offset>          move to <offset>. it can be relative (+n/-n) or from end (end-n)
+  hex, x [<n>]           hexdump n bytes (default: 64) at current offset
+  print, p <expr>        evaluate a qlang expression over the last result (named _) and globals
+  dom, d                 show the last matching result
+  rules                  list all rules
+  globals                list all global variables
+  source                 show bpl source code of the session
+  load <file.bpl>        load a protocol file
+  save <file.bpl>        save bpl source code of the session
+  help, ?                show this help
+  quit, q                exit
+`
+
+// ErrQuit is returned by Exec when the session should be terminated.
+//
+var ErrQuit = errors.New("quit")
+
+func (s *Session) dump(off int, dom interface{}) {
+
+	var b bytes.Buffer
+	ext.DumpDom(&b, dom, 0)
+	fmt.Fprintf(s.out, "[%#x] %s\n", off, b.String())
+}
+
+// Exec executes a command or a definition. Results are written into the output
+// of the session.
+//
+func (s *Session) Exec(line string) (err error) {
+
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	if IsDefinition(line) {
+		return s.Define(line)
+	}
+
+	cmd, arg := line, ""
+	if pos := strings.IndexAny(line, " \t"); pos >= 0 {
+		cmd, arg = line[:pos], strings.TrimSpace(line[pos+1:])
+	}
+	switch cmd {
+	case "match", "m":
+		if arg == "" {
+			return errors.New("usage: match <rule>")
+		}
+		dom, n, err := s.Match(arg)
+		if err != nil {
+			return fmt.Errorf("%v (at offset %#x)", err, s.off+n)
+		}
+		s.dump(s.off, dom)
+		fmt.Fprintf(s.out, "%d bytes matched\n", n)
+	case "step", "s":
+		name, count := s.last, 1
+		for _, a := range strings.Fields(arg) {
+			if n, err := strconv.Atoi(a); err == nil {
+				count = n
+			} else {
+				name = a
+			}
+		}
+		if name == "" {
+			return errors.New("usage: step <rule> [<n>]")
+		}
+		for i := 0; i < count; i++ {
+			off := s.off
+			dom, n, err := s.Step(name)
+			if err != nil {
+				if err == io.EOF {
+					return errors.New("end of data")
+				}
+				return fmt.Errorf("%v (at offset %#x)", err, off+n)
+			}
+			s.dump(off, dom)
+		}
+	case "seek":
+		whence := io.SeekStart
+		if strings.HasPrefix(arg, "+") || strings.HasPrefix(arg, "-") {
+			whence = io.SeekCurrent
+		} else if strings.HasPrefix(arg, "end") {
+			whence, arg = io.SeekEnd, strings.TrimSpace(arg[3:])
+			if arg == "" {
+				arg = "0"
+			}
+		}
+		off, err := strconv.ParseInt(arg, 0, 64)
+		if err != nil {
+			return errors.New("usage: seek <offset>")
+		}
+		_, err = s.Seek(off, whence)
+		return err
+	case "hex", "x":
+		n := 64
+		if arg != "" {
+			if n, err = strconv.Atoi(arg); err != nil {
+				return errors.New("usage: hex [<n>]")
+			}
+		}
+		s.Hex(s.out, n)
+	case "print", "p":
+		v, err := s.Eval(arg)
+		if err != nil {
+			return err
+		}
+		var b bytes.Buffer
+		ext.DumpDom(&b, v, 0)
+		fmt.Fprintln(s.out, b.String())
+	case "dom", "d":
+		s.dump(s.off, s.dom)
+	case "rules":
+		fmt.Fprintln(s.out, strings.Join(s.mod.Rules(), " "))
+	case "globals":
+		names := make([]string, 0, len(s.globals.Impl))
+		for name := range s.globals.Impl {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintln(s.out, strings.Join(names, " "))
+	case "source":
+		io.WriteString(s.out, s.Source())
+	case "load", "save":
+		if arg == "" {
+			return fmt.Errorf("usage: %s <file.bpl>", cmd)
+		}
+		if cmd == "load" {
+			return s.Load(arg)
+		}
+		return s.Save(arg)
+	case "help", "?":
+		io.WriteString(s.out, help)
+	case "quit", "q", "exit":
+		return ErrQuit
+	default:
+		return fmt.Errorf("unknown command `%s`, type `help` for usage", cmd)
+	}
+	return
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,101 @@
+package repl
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// -----------------------------------------------------------------------------
+
+const codeHeader = `
+
+header = {
+	magic [4]char
+	n     uint16be
+}
+`
+
+func TestSession(t *testing.T) {
+
+	data := []byte{
+		'b', 'p', 'l', '!', 0x00, 0x02,
+		1, 2,
+		3, 4,
+	}
+
+	var out bytes.Buffer
+	s, err := NewSession(data, codeHeader, &out)
+	if err != nil {
+		t.Fatal("NewSession failed:", err)
+	}
+
+	exec := func(line string) string {
+		out.Reset()
+		if err := s.Exec(line); err != nil {
+			t.Fatalf("Exec `%s` failed: %v", line, err)
+		}
+		return out.String()
+	}
+
+	if ret := exec("match header"); !strings.Contains(ret, `magic: "bpl!"`) || s.Offset() != 0 {
+		t.Fatal("match:", ret)
+	}
+	exec("step header")
+	if s.Offset() != 6 {
+		t.Fatal("step: offset =", s.Offset())
+	}
+	if ret := exec("print n * 10"); ret != "20\n" {
+		t.Fatal("print:", ret)
+	}
+
+	if !IsDefinition("item = {a uint8; b uint8}") || IsDefinition("print a == 1") {
+		t.Fatal("IsDefinition")
+	}
+	if !NeedMore("item = {\n\ta uint8\n") || NeedMore("item = {a uint8}") {
+		t.Fatal("NeedMore")
+	}
+	exec("item = {\n\ta uint8\n\tb uint8\n}")
+	exec("step item 2")
+	if s.Offset() != 10 {
+		t.Fatal("step: offset =", s.Offset())
+	}
+	if err = s.Exec("step"); err == nil {
+		t.Fatal("step: end of data isn't reported")
+	}
+	if err = s.Exec("bad = {"); err == nil {
+		t.Fatal("define: syntax error isn't reported")
+	}
+
+	exec("seek -4")
+	if ret := exec("hex"); ret != "00000006  01 02 03 04                                       |....|\n" {
+		t.Fatalf("hex: %q", ret)
+	}
+	exec("item = {a uint16be}")
+	if ret := exec("m item"); !strings.Contains(ret, "a: 258") {
+		t.Fatal("redefine:", ret)
+	}
+
+	f, err := ioutil.TempFile("", "repl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	exec("save " + f.Name())
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != codeHeader+"\nitem = {a uint16be}\n" {
+		t.Fatalf("save: %q", string(b))
+	}
+	if err = s.Exec("quit"); err != ErrQuit {
+		t.Fatal("quit:", err)
+	}
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,60 @@
+package repl
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"qlang.io/qlang/terminal"
+)
+
+// -----------------------------------------------------------------------------
+
+// Run runs an interactive session on the terminal. `historyFile` can be empty.
+//
+func Run(s *Session, historyFile string) (err error) {
+
+	term := terminal.New("", "", nil)
+	defer term.Close()
+
+	if historyFile != "" {
+		term.LoadHistroy(historyFile)
+		defer term.SaveHistroy(historyFile)
+	}
+
+	fmt.Fprintf(s.out, "%d bytes loaded. type `help` for usage.\n", len(s.data))
+	for {
+		var all string
+		prompt := fmt.Sprintf("bpl %#x> ", s.off)
+		for {
+			line, err := term.Prompt(prompt)
+			if err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				if err != terminal.ErrPromptAborted {
+					return err
+				}
+				all = ""
+				break
+			}
+			if strings.TrimSpace(line) != "" {
+				term.AppendHistory(line)
+			}
+			all += line + "\n"
+			if !IsDefinition(all) || !NeedMore(all) {
+				break
+			}
+			prompt = "... "
+		}
+		if err = s.Exec(all); err != nil {
+			if err == ErrQuit {
+				return nil
+			}
+			fmt.Fprintln(os.Stderr, "error:", err)
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,140 @@
+package bpl
+
+import (
+	"reflect"
+	"sync"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+// MaxSessionPending is the maximum number of requests that a Session keeps. If it's
+// exceeded, the oldest request is dropped, eg. a request without response.
+//
+var MaxSessionPending = 4096
+
+type sessionEntry struct {
+	val   interface{}
+	start time.Time
+	done  chan bool // closed when the request is put
+}
+
+// A Session correlates responses with requests of a connection. It's shared by the
+// matching contexts of both directions of the connection as the global variable
+// `BPL_SESSION`, so it's safe for concurrent use. For example:
+//
+//	do BPL_SESSION.put(header.requestID, request)
+//	let request, latency, _ok = BPL_SESSION.take(header.responseTo)
+//
+type Session struct {
+	mutex   sync.Mutex
+	pending map[interface{}]*sessionEntry
+	wait    time.Duration
+}
+
+// NewSession returns a new Session. `wait` is how long Take waits for a request that
+// isn't put yet, when requests and responses are matched concurrently, so a response
+// may be matched before its request. It should be zero if matching is on the data
+// path, eg. qbplproxy forwards bytes while they are matched, so waiting would stall
+// the connection.
+//
+func NewSession(wait time.Duration) *Session {
+
+	return &Session{pending: make(map[interface{}]*sessionEntry), wait: wait}
+}
+
+func sessionKey(key interface{}) interface{} {
+
+	v := reflect.ValueOf(key)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return int64(v.Uint())
+	}
+	return key
+}
+
+func (p *Session) entry(key interface{}) *sessionEntry {
+
+	e, ok := p.pending[key]
+	if !ok {
+		if len(p.pending) >= MaxSessionPending {
+			p.dropOldest()
+		}
+		e = &sessionEntry{done: make(chan bool)}
+		p.pending[key] = e
+	}
+	return e
+}
+
+func (p *Session) dropOldest() {
+
+	var oldest interface{}
+	var start time.Time
+	for key, e := range p.pending {
+		if oldest == nil || e.start.Before(start) {
+			oldest, start = key, e.start
+		}
+	}
+	delete(p.pending, oldest)
+}
+
+// Put records a request `val` identified by `key`, and the time it's seen.
+//
+func (p *Session) Put(key, val interface{}) {
+
+	key = sessionKey(key)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	e := p.entry(key)
+	select {
+	case <-e.done: // put again
+	default:
+		close(e.done)
+	}
+	e.val, e.start = val, time.Now()
+}
+
+// Take removes the request identified by `key`, and returns it with the latency
+// in milliseconds since it's seen. If the request isn't put yet, it waits at most
+// the `wait` duration of the Session.
+//
+func (p *Session) Take(key interface{}) (val interface{}, latency float64, ok bool) {
+
+	now := time.Now()
+	key = sessionKey(key)
+	p.mutex.Lock()
+	e := p.entry(key)
+	p.mutex.Unlock()
+
+	if p.wait > 0 {
+		select {
+		case <-e.done:
+			ok = true
+		case <-time.After(p.wait):
+		}
+	} else {
+		select {
+		case <-e.done:
+			ok = true
+		default:
+		}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.pending[key] == e {
+		delete(p.pending, key)
+	}
+	if !ok {
+		return
+	}
+	if d := now.Sub(e.start); d > 0 {
+		latency = float64(d/time.Microsecond) / 1000
+	}
+	return e.val, latency, true
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,47 @@
+package bpl
+
+import (
+	"testing"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+func TestSession(t *testing.T) {
+
+	p := NewSession(100 * time.Millisecond)
+	p.Put(int32(1), "find")
+	if val, latency, ok := p.Take(1); !ok || val != "find" || latency < 0 { // int32 and int keys are the same
+		t.Fatal("Take:", val, latency, ok)
+	}
+	if _, _, ok := p.Take(uint8(1)); ok {
+		t.Fatal("Take: request isn't removed")
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		p.Put(2, "insert")
+	}()
+	if val, _, ok := p.Take(2); !ok || val != "insert" { // the response is matched before its request
+		t.Fatal("Take:", val, ok)
+	}
+
+	if _, _, ok := p.Take(6); ok || len(p.pending) != 0 {
+		t.Fatal("Take: request doesn't exist")
+	}
+	if _, _, ok := NewSession(0).Take(6); ok {
+		t.Fatal("Take: request doesn't exist")
+	}
+
+	old := MaxSessionPending
+	MaxSessionPending = 2
+	defer func() { MaxSessionPending = old }()
+	p.Put(3, "a")
+	p.Put(4, "b")
+	p.Put(5, "c")
+	if len(p.pending) != 2 || p.pending[int64(3)] != nil {
+		t.Fatal("oldest request isn't dropped:", len(p.pending))
+	}
+}
+
+// -----------------------------------------------------------------------------
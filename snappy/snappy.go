@@ -0,0 +1,134 @@
+package snappy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// -----------------------------------------------------------------------------
+
+var (
+	// ErrCorrupt is returned when a compressed block is corrupt.
+	ErrCorrupt = errors.New("snappy: corrupt block")
+
+	// ErrTooLarge is returned when the decoded length of a block is too large.
+	ErrTooLarge = errors.New("snappy: decoded block is too large")
+)
+
+const (
+	tagLiteral = 0
+	tagCopy1   = 1
+	tagCopy2   = 2
+	tagCopy4   = 3
+)
+
+// DecodedLen returns the decoded length of a snappy compressed block `src`, and
+// the length of its preamble.
+//
+func DecodedLen(src []byte) (n int, preamble int, err error) {
+
+	v, preamble := binary.Uvarint(src)
+	if preamble <= 0 || v > 0xffffffff {
+		return 0, 0, ErrCorrupt
+	}
+	return int(v), preamble, nil
+}
+
+// Decode decodes a snappy compressed block `src` (the block format, not the framing
+// format). It fails with ErrTooLarge if the decoded length is larger than maxSize.
+//
+func Decode(src []byte, maxSize int) ([]byte, error) {
+
+	n, i, err := DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxSize {
+		return nil, ErrTooLarge
+	}
+
+	dst := make([]byte, 0, n)
+	for i < len(src) {
+		tag := src[i]
+		var length, off int
+		switch tag & 3 {
+		case tagLiteral:
+			length = int(tag >> 2)
+			i++
+			if length >= 60 { // length-1 in the next 1..4 bytes
+				m := length - 59
+				if i+m > len(src) {
+					return nil, ErrCorrupt
+				}
+				length = 0
+				for j := m - 1; j >= 0; j-- {
+					length = length<<8 | int(src[i+j])
+				}
+				i += m
+			}
+			length++
+			if length > len(src)-i || length > n-len(dst) {
+				return nil, ErrCorrupt
+			}
+			dst = append(dst, src[i:i+length]...)
+			i += length
+			continue
+		case tagCopy1:
+			if i+2 > len(src) {
+				return nil, ErrCorrupt
+			}
+			length = 4 + int(tag>>2&7)
+			off = int(tag&0xe0)<<3 | int(src[i+1])
+			i += 2
+		case tagCopy2:
+			if i+3 > len(src) {
+				return nil, ErrCorrupt
+			}
+			length = 1 + int(tag>>2)
+			off = int(binary.LittleEndian.Uint16(src[i+1:]))
+			i += 3
+		case tagCopy4:
+			if i+5 > len(src) {
+				return nil, ErrCorrupt
+			}
+			length = 1 + int(tag>>2)
+			off = int(binary.LittleEndian.Uint32(src[i+1:]))
+			i += 5
+		}
+		if off == 0 || off > len(dst) || length > n-len(dst) {
+			return nil, ErrCorrupt
+		}
+		pos := len(dst) - off
+		for j := 0; j < length; j++ { // a copy may overlap its own output
+			dst = append(dst, dst[pos+j])
+		}
+	}
+	if len(dst) != n {
+		return nil, ErrCorrupt
+	}
+	return dst, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// NewReader reads all data of r as a snappy compressed block, and returns a reader
+// of the decoded data. A snappy block isn't self-delimited, so r is usually limited
+// to the size of the block.
+//
+func NewReader(r io.Reader, maxSize int) (io.Reader, error) {
+
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := Decode(src, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(dst), nil
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,59 @@
+package snappy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// -----------------------------------------------------------------------------
+
+func TestDecode(t *testing.T) {
+
+	long := strings.Repeat("x", 70)
+	cases := []struct {
+		src []byte
+		ret string
+	}{
+		{[]byte{0x00}, ""},
+		{[]byte{0x0c, 0x08, 'a', 'b', 'c', 0x15, 0x03}, strings.Repeat("abc", 4)},       // copy1
+		{[]byte{0x0c, 0x08, 'a', 'b', 'c', 0x22, 0x03, 0x00}, strings.Repeat("abc", 4)}, // copy2
+		{[]byte{0x05, 0x00, 'a', 0x0f, 0x01, 0x00, 0x00, 0x00}, strings.Repeat("a", 5)}, // copy4
+		{append([]byte{70, 60 << 2, 69}, long...), long},                                // 1-byte literal length
+		{append([]byte{70, 61 << 2, 69, 0}, long...), long},                             // 2-byte literal length
+	}
+	for _, c := range cases {
+		b, err := Decode(c.src, 1024)
+		if err != nil || string(b) != c.ret {
+			t.Fatal("Decode:", c.src, err, string(b))
+		}
+	}
+
+	r, err := NewReader(bytes.NewReader(cases[1].src), 1024)
+	if err != nil {
+		t.Fatal("NewReader failed:", err)
+	}
+	if b, err := ioutil.ReadAll(r); err != nil || string(b) != cases[1].ret {
+		t.Fatal("ReadAll:", err, string(b))
+	}
+
+	errs := []struct {
+		src []byte
+		err error
+	}{
+		{[]byte{}, ErrCorrupt},
+		{[]byte{0x0c, 0x08, 'a', 'b', 'c'}, ErrCorrupt},             // too short
+		{[]byte{0x03, 0x08, 'a', 'b', 'c', 0x15, 0x03}, ErrCorrupt}, // too long
+		{[]byte{0x0c, 0x08, 'a', 'b', 'c', 0x15, 0x04}, ErrCorrupt}, // offset out of range
+		{[]byte{0x0c, 0x08, 'a', 'b'}, ErrCorrupt},
+		{[]byte{0x80, 0x10}, ErrTooLarge},
+	}
+	for _, c := range errs {
+		if _, err := Decode(c.src, 1024); err != c.err {
+			t.Fatal("Decode:", c.src, err)
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
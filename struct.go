@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
+	"sync/atomic"
 
 	"qiniupkg.com/x/log.v7"
 )
@@ -53,12 +54,33 @@ type Member struct {
 //
 func (p *Member) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
 
-	v, err = p.Type.Match(in, ctx.NewSub())
+	sub := ctx.NewSub()
+	sub.member = p.Name
+	var node *Node
+	if p.Name != "_" {
+		node = ctx.beginNode(in, sub, p.Name)
+	}
+	vis := ctx.visitor()
+	var offset int64
+	if vis != nil {
+		offset = ctx.Tell(in)
+	}
+	v, err = p.Type.Match(in, sub)
 	if err != nil {
+		if p.Name != "_" {
+			v = partialOf(v, sub)
+			ctx.setPartial(p.Name, v)
+			ctx.endNode(in, node, v)
+		}
 		return
 	}
 	if p.Name != "_" {
 		ctx.SetVar(p.Name, v)
+		ctx.endNode(in, node, v)
+		if vis != nil && !sub.visited {
+			vis.Field(p.Name, v, offset)
+		}
+		err = ctx.addNode(in)
 	}
 	return
 }
@@ -81,18 +103,23 @@ func (p *Member) SizeOf() int {
 
 type structType struct {
 	rulers []Ruler
-	size   int
+	size   int32 // -2: unknown yet. it's cached atomically, see SizeOf
 }
 
 func (p *structType) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
 
+	vis := ctx.beginStruct(in)
 	for _, r := range p.rulers {
 		_, err = r.Match(in, ctx)
 		if err != nil {
 			return
 		}
 	}
-	return ctx.Dom(), nil
+	v = ctx.Dom()
+	if vis != nil {
+		vis.EndStruct(ctx.name(), v, ctx.Tell(in))
+	}
+	return
 }
 
 func (p *structType) RetType() reflect.Type {
@@ -102,10 +129,12 @@ func (p *structType) RetType() reflect.Type {
 
 func (p *structType) SizeOf() int {
 
-	if p.size == -2 {
-		p.size = p.sizeof()
+	size := atomic.LoadInt32(&p.size)
+	if size == -2 { // members may be TypeVars, so it's computed after they are assigned
+		size = int32(p.sizeof())
+		atomic.StoreInt32(&p.size, size)
 	}
-	return p.size
+	return int(size)
 }
 
 func (p *structType) sizeof() int {
@@ -0,0 +1,185 @@
+package bpl
+
+import (
+	"bufio"
+	"io"
+	"strings"
+
+	"qiniupkg.com/x/bufiox.v7"
+)
+
+// -----------------------------------------------------------------------------
+
+// A Tracer traces matching of named rules (members of structs and rules assigned
+// in bpl source code). Offsets are relative to the beginning of the input stream,
+// or -1 if it is unknown. Bytes of `eval <expr> do R` are another stream, so
+// offsets inside R are relative to the result of <expr>. So are decoded bytes of
+// `inflate R`, `gunzip R`, etc.
+//
+type Tracer interface {
+	// Enter is called before a rule is matched. `path` is the rule stack, and its
+	// last element is name of the rule.
+	Enter(path []string, offset int64)
+
+	// Exit is called after a rule is matched. `offset` is the offset where the rule
+	// ends (or fails).
+	Exit(path []string, offset int64, v interface{}, err error)
+}
+
+type readerInfo struct {
+	cr     *countReader // cr != nil: a stream returned by Context.NewReader
+	base   int64        // cr == nil: a buffer starts at `base` of the stream
+	size   int
+	parent *bufio.Reader // the stream has offsets of parent, eg. a window of `read`
+}
+
+type matchState struct {
+	tracer  Tracer
+	visitor Visitor
+	emit    int // depth of Emit rules being matched
+	zcopy   bool
+	lazy    bool
+	nodes   bool                    // offsets of matching results are tracked
+	in      *bufio.Reader           // the top-level input stream
+	deltas  map[*bufio.Reader]int64 // offset in the top-level input stream = Tell + delta
+	lim     *limitState             // nil: no limits
+	repeats int                     // depth of repetition rules being matched
+	records int                     // records matched, see Stats
+	ended   bool                    // the input ends at a record boundary
+	failed  int                     // 1-based index of the failing record, or 0
+	partial interface{}             // partial matching result of the failing record
+	path    []string
+	readers map[*bufio.Reader]readerInfo
+	errAt   error
+	errPos  Pos // where errAt occurs
+}
+
+func newMatchState() *matchState {
+
+	return &matchState{readers: make(map[*bufio.Reader]readerInfo)}
+}
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (p *countReader) Read(b []byte) (n int, err error) {
+
+	n, err = p.r.Read(b)
+	p.n += int64(n)
+	return
+}
+
+// -----------------------------------------------------------------------------
+
+// SetTracer sets a Tracer to trace matching of rules.
+//
+func (p *Context) SetTracer(tracer Tracer) {
+
+	p.st.tracer = tracer
+}
+
+// NewReader returns a buffered reader of `r`, whose offsets can be told by Tell.
+//
+func (p *Context) NewReader(r io.Reader) *bufio.Reader {
+
+	cr := &countReader{r: r}
+	in := bufio.NewReader(cr)
+	p.st.readers[in] = readerInfo{cr: cr}
+	return in
+}
+
+// Tell returns current offset of `in`, or -1 if it is unknown. `in` should be a
+// reader returned by NewReader or NewReaderBuffer.
+//
+func (p *Context) Tell(in *bufio.Reader) int64 {
+
+	if r, ok := p.st.readers[in]; ok {
+		if r.cr != nil {
+			return r.cr.n - int64(in.Buffered())
+		}
+		if r.base < 0 {
+			return -1
+		}
+		return r.base + int64(r.size-in.Buffered())
+	}
+	if bufiox.IsReaderBuffer(in) {
+		return int64(len(bufiox.Buffer(in)) - in.Buffered())
+	}
+	return -1
+}
+
+// RulePath returns names of the rules being matched, eg. `doc > message > query`.
+//
+func (p *Context) RulePath() string {
+
+	return strings.Join(p.st.path, " > ")
+}
+
+// buffer records that offsets of `in`, a buffer returned by newReaderBuffer, start at
+// `base`. It returns a function to forget `in`.
+//
+func (p *Context) buffer(in *bufio.Reader, base int64) func() {
+
+	p.st.readers[in] = readerInfo{base: base, size: in.Buffered()}
+	return func() {
+		delete(p.st.readers, in)
+	}
+}
+
+// window records that `in`, a buffer returned by newReaderBuffer, is bytes of `parent`
+// starting at `base`. It returns a function to forget `in`.
+//
+func (p *Context) window(in, parent *bufio.Reader, base int64) func() {
+
+	p.st.readers[in] = readerInfo{base: base, size: in.Buffered(), parent: parent}
+	undo := p.track(in, parent, 0)
+	return func() {
+		delete(p.st.readers, in)
+		undo()
+	}
+}
+
+// nested returns if offsets of `in` are offsets of a nested stream (eg. bytes of `eval`
+// or decoded data) rather than the top-level input stream.
+//
+func (p *Context) nested(in *bufio.Reader) bool {
+
+	st := p.st
+	for in != st.in {
+		r, ok := st.readers[in]
+		if !ok || r.parent == nil {
+			return true
+		}
+		in = r.parent
+	}
+	return false
+}
+
+// position returns where matching `in` is.
+//
+func (p *Context) position(in *bufio.Reader) Pos {
+
+	return Pos{Path: p.RulePath(), Offset: p.Tell(in), Nested: p.nested(in)}
+}
+
+func (p *Context) enter(name string, in *bufio.Reader) {
+
+	st := p.st
+	st.path = append(st.path, name)
+	if st.tracer != nil {
+		st.tracer.Enter(st.path, p.Tell(in))
+	}
+}
+
+func (p *Context) exit(in *bufio.Reader, v interface{}, err error) {
+
+	st := p.st
+	if st.tracer != nil {
+		st.tracer.Exit(st.path, p.Tell(in), v, err)
+	}
+	st.path = st.path[:len(st.path)-1]
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,145 @@
+package bpl
+
+import (
+	"bufio"
+	"reflect"
+)
+
+// -----------------------------------------------------------------------------
+
+// A Visitor receives matching results of `Emit(R)` as a stream of events, like a
+// SAX parser. Matching result of R is dropped after its events are sent, so memory
+// stays constant no matter how many records are emitted, eg. `doc = emit *record`.
+//
+// `name` of an event is name of the struct member. If a struct isn't a member (eg.
+// an emitted record, or an element of an array), it is name of the rule being
+// matched. Other elements of an array, and an array which isn't a member, have no
+// name. Offsets are the same as offsets of Tracer, or -1 if they are unknown (eg.
+// offsets of variables assigned by `let`).
+//
+type Visitor interface {
+	// BeginStruct is called before members of a struct are matched.
+	BeginStruct(name string, offset int64)
+
+	// EndStruct is called after a struct is matched. `v` is its matching result,
+	// which is the value returned by `return` if any.
+	EndStruct(name string, v interface{}, offset int64)
+
+	// BeginArray is called before elements of an array are matched.
+	BeginArray(name string, offset int64)
+
+	// EndArray is called after an array is matched.
+	EndArray(name string, offset int64)
+
+	// Field is called after a member of a struct (or an element of an array) which
+	// isn't a struct or an array is matched, or a variable is assigned by `let`.
+	// `offset` is where the member starts.
+	Field(name string, v interface{}, offset int64)
+}
+
+// SetVisitor sets a Visitor to receive matching results of emitted rules.
+//
+func (p *Context) SetVisitor(visitor Visitor) {
+
+	p.st.visitor = visitor
+}
+
+func (p *Context) visitor() Visitor {
+
+	if st := p.st; st.emit > 0 {
+		return st.visitor
+	}
+	return nil
+}
+
+func (p *Context) name() string {
+
+	if p.member != "" {
+		return p.member
+	}
+	if path := p.st.path; len(path) > 0 {
+		return path[len(path)-1]
+	}
+	return ""
+}
+
+// beginStruct sends BeginStruct event if the struct owns the context, that is, it
+// isn't a block of `if`, `read`, `case`, etc. It returns the visitor to receive
+// EndStruct event.
+//
+func (p *Context) beginStruct(in *bufio.Reader) Visitor {
+
+	if vis := p.visitor(); vis != nil && !p.visited {
+		p.visited = true
+		vis.BeginStruct(p.name(), p.Tell(in))
+		return vis
+	}
+	return nil
+}
+
+func (p *Context) beginArray(in *bufio.Reader) Visitor {
+
+	if vis := p.visitor(); vis != nil {
+		p.visited = true
+		vis.BeginArray(p.member, p.Tell(in))
+		return vis
+	}
+	return nil
+}
+
+func (p *Context) newElem(vis Visitor, in *bufio.Reader) (sub *Context, offset int64) {
+
+	sub = p.NewSub()
+	p.beginNode(in, sub, "")
+	if vis != nil {
+		offset = p.Tell(in)
+	}
+	return
+}
+
+func (p *Context) endElem(vis Visitor, in *bufio.Reader, sub *Context, v interface{}, offset int64) {
+
+	p.endNode(in, sub.node, v)
+	if vis != nil && !sub.visited {
+		vis.Field("", v, offset)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+type emit struct {
+	r Ruler
+}
+
+func (p *emit) Match(in *bufio.Reader, ctx *Context) (v interface{}, err error) {
+
+	if st := ctx.st; st.visitor != nil {
+		st.emit++
+		defer func() {
+			st.emit--
+		}()
+	}
+	_, err = p.r.Match(in, ctx.NewSub())
+	return
+}
+
+func (p *emit) RetType() reflect.Type {
+
+	return TyInterface
+}
+
+func (p *emit) SizeOf() int {
+
+	return p.r.SizeOf()
+}
+
+// Emit returns a matching unit that matches R, and sends its matching result to
+// the Visitor of the context (see SetVisitor) as events. Matching result of R is
+// dropped, and Emit returns nil.
+//
+func Emit(R Ruler) Ruler {
+
+	return &emit{r: R}
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,69 @@
+package bpl
+
+import (
+	"bufio"
+	"io"
+
+	"qiniupkg.com/x/bufiox.v7"
+)
+
+// -----------------------------------------------------------------------------
+
+// SetZeroCopy sets zero-copy mode of in-memory inputs (readers returned by
+// bufiox.NewReaderBuffer, eg. inputs of MatchBuffer). In zero-copy mode, `[n]byte`,
+// `read n do R` and ReadBytes return sub-slices of the input buffer instead of
+// copies, so the buffer must not be modified while matching results are in use.
+//
+func (p *Context) SetZeroCopy(zeroCopy bool) {
+
+	p.st.zcopy = zeroCopy
+}
+
+// ReadBytes reads n bytes from `in`. In zero-copy mode (see SetZeroCopy), it returns
+// a sub-slice of `in` if `in` is an in-memory input.
+//
+func (p *Context) ReadBytes(in *bufio.Reader, n int) (b []byte, err error) {
+
+	if b = p.sliceBytes(in, n); b != nil {
+		return
+	}
+	b = make([]byte, n)
+	nr, err := io.ReadFull(in, b)
+	if err != nil {
+		return nil, truncated(err, n, nr)
+	}
+	return
+}
+
+// sliceBytes reads n bytes from `in` without copying them in zero-copy mode. It
+// returns nil if `in` isn't an in-memory input or it has less than n bytes.
+//
+func (p *Context) sliceBytes(in *bufio.Reader, n int) []byte {
+
+	if p == nil || !p.st.zcopy || !bufiox.IsReaderBuffer(in) || in.Buffered() < n {
+		return nil
+	}
+	buf := bufiox.Buffer(in)
+	off := len(buf) - in.Buffered()
+	if off < 0 {
+		return nil
+	}
+	in.Discard(n)
+	return buf[off : off+n : off+n]
+}
+
+// readAll reads all bytes of `in`. If `in` is an in-memory input, it returns the rest
+// of the buffer without copying.
+//
+func (p *Context) readAll(in *bufio.Reader) ([]byte, error) {
+
+	if !bufiox.IsReaderBuffer(in) {
+		return bufiox.ReadAll(in)
+	}
+	buf := bufiox.Buffer(in)
+	b := buf[len(buf)-in.Buffered():]
+	in.Discard(len(b))
+	return b, nil
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,47 @@
+package zstd
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// -----------------------------------------------------------------------------
+
+const (
+	frame1 = "28b52ffd24f09d00006068656c6c6f2c2062706c21200100e1532509922aa897" // with checksum
+	frame2 = "28b52ffd200f5d00002870696e67200100d88a16"
+)
+
+func TestReader(t *testing.T) {
+
+	b1, _ := hex.DecodeString(frame1)
+	b2, _ := hex.DecodeString(frame2)
+	ret1 := strings.Repeat("hello, bpl! ", 20)
+	ret2 := strings.Repeat("ping ", 3)
+
+	b, err := ioutil.ReadAll(NewReader(bytes.NewReader(append(b1, b2...))))
+	if err != nil || string(b) != ret1+ret2 {
+		t.Fatal("ReadAll:", err, string(b))
+	}
+
+	in := bytes.NewReader(append(b2, "tail"...))
+	b, err = ioutil.ReadAll(NewFrameReader(in))
+	if err != nil || string(b) != ret2 || in.Len() != 4 {
+		t.Fatal("ReadAll:", err, string(b), in.Len())
+	}
+
+	bad := append([]byte(nil), b1...)
+	bad[len(bad)-1] ^= 1
+	if _, err = ioutil.ReadAll(NewReader(bytes.NewReader(bad))); err == nil {
+		t.Fatal("ReadAll: checksum mismatch isn't reported")
+	}
+	if _, err = ioutil.ReadAll(NewReader(bytes.NewReader(b1[:20]))); err == nil || !strings.Contains(err.Error(), io.ErrUnexpectedEOF.Error()) {
+		t.Fatal("ReadAll:", err)
+	}
+}
+
+// -----------------------------------------------------------------------------